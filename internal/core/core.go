@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/qcasey/viper"
@@ -14,6 +15,8 @@ import (
 type Core struct {
 	mutex       sync.RWMutex
 	subscribers map[string][]chan Message
+	// dropped counts the messages each subscriber was too far behind to receive
+	dropped map[chan Message]*uint64
 
 	Settings  *viper.Viper
 	Session   *viper.Viper
@@ -24,6 +27,7 @@ type Core struct {
 type Message struct {
 	Content   interface{}
 	WriteDate time.Time // time it was inserted
+	Topic     string    // topic it was published to
 }
 
 // New creates a publish / subscribe interface for administering the program
@@ -33,6 +37,7 @@ func New(settingsFile string) *Core {
 		Session:     viper.New(),
 		StartTime:   time.Now(),
 		subscribers: make(map[string][]chan Message),
+		dropped:     make(map[chan Message]*uint64),
 	}
 
 	core.Settings.SetConfigName(settingsFile) // name of config file (without extension)
@@ -50,13 +55,31 @@ func New(settingsFile string) *Core {
 }
 
 // Subscribe will add the given channel as a listener to a topic
-// Topic is expected to be compatible with a Viper selector
-// Channel is expected to be buffered
+// Topic is expected to be compatible with a Viper selector, where * matches
+// any one part of a topic and a trailing # matches the rest, i.e. session.gps.*
+// or session.#
+// Channel is expected to be buffered, messages that don't fit are dropped and counted by Dropped.
+// A channel subscribed to several patterns matching a topic receives its messages once.
 func (core *Core) Subscribe(topic string, ch chan Message) {
 	core.mutex.Lock()
 	defer core.mutex.Unlock()
 
 	core.subscribers[topic] = append(core.subscribers[topic], ch)
+	if _, ok := core.dropped[ch]; !ok {
+		core.dropped[ch] = new(uint64)
+	}
+}
+
+// Dropped returns how many messages a subscribed channel missed because it was full
+func (core *Core) Dropped(ch chan Message) uint64 {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+
+	dropped, ok := core.dropped[ch]
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(dropped)
 }
 
 // Publish a given message to all subscribed entities
@@ -78,10 +101,115 @@ func (core *Core) Publish(topic string, m Message) {
 
 	// Append time written
 	m.WriteDate = time.Now()
+	core.notify(topic, m)
+}
+
+// SessionValue returns the value of a session key, read while holding the mutex
+func (core *Core) SessionValue(key string) interface{} {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.Get(fmt.Sprintf("%s.value", key))
+}
+
+// SessionString returns the value of a session key as a string, read while holding the mutex
+func (core *Core) SessionString(key string) string {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.GetString(fmt.Sprintf("%s.value", key))
+}
+
+// SessionBool returns the value of a session key as a bool, read while holding the mutex
+func (core *Core) SessionBool(key string) bool {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.GetBool(fmt.Sprintf("%s.value", key))
+}
+
+// SessionInt returns the value of a session key as a int, read while holding the mutex
+func (core *Core) SessionInt(key string) int {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.GetInt(fmt.Sprintf("%s.value", key))
+}
+
+// SessionFloat64 returns the value of a session key as a float64, read while holding the mutex
+func (core *Core) SessionFloat64(key string) float64 {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.GetFloat64(fmt.Sprintf("%s.value", key))
+}
+
+// SessionWrite returns the value of a session key and when it was last written, read while holding the mutex
+func (core *Core) SessionWrite(key string) (interface{}, time.Time) {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.Get(fmt.Sprintf("%s.value", key)), core.Session.GetTime(fmt.Sprintf("%s.write_date", key))
+}
+
+// SessionKey returns a session key as it's stored, with its value, write date and writes, read while holding the mutex
+func (core *Core) SessionKey(key string) (interface{}, bool) {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	if !core.Session.IsSet(key) {
+		return nil, false
+	}
+	return core.Session.Get(key), true
+}
+
+// SessionAll returns the entire session, read while holding the mutex
+func (core *Core) SessionAll() map[string]interface{} {
+	core.mutex.RLock()
+	defer core.mutex.RUnlock()
+	return core.Session.AllSettings()
+}
+
+// notify sends a message to every subscriber matching its topic, the mutex must be held
+func (core *Core) notify(topic string, m Message) {
+	m.Topic = topic
+	var sent map[chan Message]bool
+	for pattern, channels := range core.subscribers {
+		if !MatchTopic(pattern, topic) {
+			continue
+		}
+		for _, ch := range channels {
+			if sent[ch] {
+				continue
+			}
+			if sent == nil {
+				sent = make(map[chan Message]bool)
+			}
+			sent[ch] = true
+
+			// Waiting on a full subscriber while holding the mutex would freeze every publisher
+			select {
+			case ch <- m:
+			default:
+				atomic.AddUint64(core.dropped[ch], 1)
+			}
+		}
+	}
+}
+
+// MatchTopic checks a topic against a subscription pattern, see Subscribe
+func MatchTopic(pattern string, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*#") {
+		return false
+	}
 
-	for _, ch := range core.subscribers[topic] {
-		ch <- m
+	patternParts := strings.Split(pattern, ".")
+	topicParts := strings.Split(topic, ".")
+	for i, part := range patternParts {
+		if part == "#" && i == len(patternParts)-1 {
+			return true
+		}
+		if i >= len(topicParts) || (part != "*" && part != topicParts[i]) {
+			return false
+		}
 	}
+	return len(patternParts) == len(topicParts)
 }
 
 func (core *Core) addToSession(key string, value interface{}) {
@@ -12,7 +12,7 @@ func GetAll(c *core.Core) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//requestingMin := r.URL.Query().Get("min") == "1"
 		response := core.JSONResponse{OK: true}
-		response.Output = c.Session.AllSettings()
+		response.Output = c.SessionAll()
 		response.Write(&w, r)
 	}
 }
@@ -23,9 +23,9 @@ func Get(c *core.Core) http.HandlerFunc {
 
 		params := mux.Vars(r)
 
-		sessionValue := c.Session.Get(params["name"])
+		sessionValue, ok := c.SessionKey(params["name"])
 		response := core.JSONResponse{Output: sessionValue, OK: true}
-		if !c.Session.IsSet(params["name"]) {
+		if !ok {
 			response.Output = "Does not exist"
 			response.OK = false
 		}
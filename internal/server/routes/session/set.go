@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -55,9 +56,9 @@ func Set(c *core.Core) http.HandlerFunc {
 			return
 		}
 
-		// Call the setter
-		newdata.Name = params["name"]
-		c.Session.Set(params["name"], newdata.Value)
+		// Publish under the key's value like every other session writer, topics are lowercase like viper's keys
+		newdata.Name = strings.ToLower(params["name"])
+		c.Publish("session."+newdata.Name, core.Message{Content: newdata.Value})
 
 		// Craft OK response
 		response.OK = true
@@ -4,6 +4,13 @@ import (
 	"flag"
 
 	"github.com/qcasey/MDroid-Core/internal/server"
+	"github.com/qcasey/MDroid-Core/pkg/bluetooth"
+	"github.com/qcasey/MDroid-Core/pkg/db"
+	"github.com/qcasey/MDroid-Core/pkg/mserial"
+	"github.com/qcasey/MDroid-Core/pkg/pybus"
+	"github.com/qcasey/MDroid-Core/pkg/stereo"
+	"github.com/qcasey/MDroid-Core/pkg/tracker"
+	"github.com/qcasey/MDroid-Core/routes/commands"
 	"github.com/qcasey/MDroid-Core/routes/serial"
 	"github.com/qcasey/MDroid-Core/routes/shutdown"
 	"github.com/rs/zerolog/log"
@@ -18,6 +25,7 @@ func main() {
 
 	// Create new MDroid Core program
 	srv := server.New(settingsFile)
+	tracker.Setup(srv.Core)
 	addRoutes(srv)
 
 	//settings.ParseConfig(settingsFile)
@@ -49,10 +57,11 @@ func main() {
 	//addCustomHooks()
 
 	// Setup conventional modules
-	//mserial.Setup(router)
-	//bluetooth.Setup(router)
-	//pybus.Setup(router)
-	//db.Setup()
+	mserial.Start(srv.Core)
+	bluetooth.Setup(srv.Core, srv.Router)
+	stereo.Setup(srv.Core, srv.Router)
+	db.Setup(srv.Core, srv.Router)
+	pybus.Setup(srv.Core, srv.Router)
 
 	// Start MDroid Core
 	srv.Start()
@@ -66,5 +75,8 @@ func addRoutes(srv *server.Server) {
 	// Module Routes
 	//
 	srv.Router.HandleFunc("/shutdown", shutdown.Shutdown(srv.Core)).Methods("GET")
+	srv.Router.HandleFunc("/serial-stats", serial.Stats(srv.Core)).Methods("GET")
 	srv.Router.HandleFunc("/serial/{command}", serial.WriteSerial(srv.Core)).Methods("POST", "GET")
+	srv.Router.HandleFunc("/serial/{device}/{command}", serial.WriteSerial(srv.Core)).Methods("POST", "GET")
+	srv.Router.HandleFunc("/commands/{id}", commands.Get(srv.Core)).Methods("GET")
 }
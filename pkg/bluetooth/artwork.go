@@ -0,0 +1,192 @@
+package bluetooth
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/gorilla/mux"
+	"github.com/gosimple/slug"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// artworkMaxAge is how long clients may cache fetched artwork, which never changes for an album
+	artworkMaxAge = 30 * 24 * time.Hour
+	// artworkRetry is how long to wait before fetching artwork again after a failure
+	artworkRetry = time.Minute
+)
+
+// artwork caches album images on disk, keyed by their slug, i.e. artist/album.jpg
+type artwork struct {
+	dir         string
+	placeholder []byte
+	fetcher     CoverArt
+
+	mutex    sync.Mutex
+	fetching map[string]bool
+	failed   map[string]time.Time
+}
+
+var covers *artwork
+
+// setupArtwork prepares the artwork cache from settings, i.e.
+//
+//	bluetooth:
+//	  artwork_dir: /var/cache/mdroid/artwork
+//	  artwork_placeholder: /opt/mdroid/no-artwork.png
+//
+// Cover art is fetched from devices over OBEX when the session bus is available.
+func setupArtwork(c *core.Core, router *mux.Router) {
+	dir := c.Settings.GetString("bluetooth.artwork_dir")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "mdroid-artwork")
+	}
+	covers = &artwork{dir: dir, fetching: make(map[string]bool), failed: make(map[string]time.Time)}
+
+	if path := c.Settings.GetString("bluetooth.artwork_placeholder"); path != "" {
+		placeholder, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error().Msgf("Failed to read artwork placeholder %s: %s", path, err.Error())
+		}
+		covers.placeholder = placeholder
+	}
+	if covers.placeholder == nil {
+		covers.placeholder = defaultPlaceholder()
+	}
+
+	if conn, err := dbus.SessionBus(); err != nil {
+		log.Warn().Msgf("Failed to connect to the session bus, album artwork won't be fetched from devices: %s", err.Error())
+	} else {
+		covers.fetcher = NewObexClient(conn)
+	}
+
+	router.HandleFunc("/bluetooth/artwork/{artist}/{album}", GetArtwork).Methods("GET")
+}
+
+// artworkSlug returns the cache key for an album, or an empty string without both an artist and album
+func artworkSlug(artist string, album string) string {
+	album = strings.TrimSuffix(album, ".jpg")
+	if artist == "" || album == "" {
+		return ""
+	}
+	return slug.Make(artist) + "/" + slug.Make(album) + ".jpg"
+}
+
+// path returns where an album's artwork is cached
+func (a *artwork) path(key string) string {
+	return filepath.Join(a.dir, filepath.FromSlash(key))
+}
+
+// cached returns if an album's artwork is on disk
+func (a *artwork) cached(key string) bool {
+	info, err := os.Stat(a.path(key))
+	return err == nil && info.Size() > 0
+}
+
+// fetch downloads the artwork of the player's track in the background, unless it's cached or unavailable.
+// The artwork session key is published once it's ready.
+func (a *artwork) fetch(c *core.Core, address string, player Player) {
+	key := artworkSlug(player.Track.Artist, player.Track.Album)
+	if key == "" || a.cached(key) || a.fetcher == nil || player.ObexPort == 0 || player.Track.ImgHandle == "" {
+		return
+	}
+
+	a.mutex.Lock()
+	if a.fetching[key] || time.Since(a.failed[key]) < artworkRetry {
+		a.mutex.Unlock()
+		return
+	}
+	a.fetching[key] = true
+	a.mutex.Unlock()
+
+	go func() {
+		err := a.download(address, player, key)
+
+		a.mutex.Lock()
+		delete(a.fetching, key)
+		if err != nil {
+			a.failed[key] = time.Now()
+		}
+		a.mutex.Unlock()
+
+		if err != nil {
+			log.Error().Msgf("Failed to fetch artwork for %s: %s", key, err.Error())
+			return
+		}
+		log.Info().Msgf("Fetched artwork for %s", key)
+		publishPlayer(c)
+	}()
+}
+
+// download fetches artwork to a temporary file, moving it into the cache once complete
+func (a *artwork) download(address string, player Player, key string) error {
+	path := a.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// obexd writes the file itself, so it needs an absolute path
+	partial, err := filepath.Abs(path + ".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+
+	if err := a.fetcher.Fetch(strings.Replace(address, "_", ":", -1), player.ObexPort, player.Track.ImgHandle, partial); err != nil {
+		return err
+	}
+	if info, err := os.Stat(partial); err != nil || info.Size() == 0 {
+		return fmt.Errorf("transfer finished without an image")
+	}
+	return os.Rename(partial, path)
+}
+
+// defaultPlaceholder draws a plain gray square for albums without artwork
+func defaultPlaceholder() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0x40, 0x40, 0x40, 0xff}}, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// GetArtwork serves an album's cached artwork, or the placeholder if it isn't available
+func GetArtwork(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	key := artworkSlug(params["artist"], params["album"])
+
+	if covers != nil && key != "" {
+		if file, err := os.Open(covers.path(key)); err == nil {
+			defer file.Close()
+			if info, err := file.Stat(); err == nil && info.Size() > 0 {
+				w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(artworkMaxAge.Seconds())))
+				w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size()))
+				http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+				return
+			}
+		}
+	}
+
+	// The real artwork may show up later, don't let clients hold on to the placeholder
+	placeholder := defaultPlaceholder()
+	if covers != nil {
+		placeholder = covers.placeholder
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", http.DetectContentType(placeholder))
+	w.Write(placeholder)
+}
@@ -1,41 +1,80 @@
-// Package bluetooth is a rudimentary interface between MDroid-Core and underlying BT dbus
+// Package bluetooth is a rudimentary interface between MDroid-Core and BlueZ over D-Bus
 package bluetooth
 
 import (
 	"fmt"
 	"net/http"
-	"regexp"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/godbus/dbus/v5"
 	"github.com/gorilla/mux"
-	"github.com/gosimple/slug"
 	"github.com/qcasey/MDroid-Core/internal/core"
-	"github.com/qcasey/MDroid-Core/internal/core/settings"
 	"github.com/rs/zerolog/log"
 )
 
 // Bluetooth is the modular implementation of Bluetooth controls
 var (
-	BluetoothAddress string
-	replySerialRegex *regexp.Regexp
-	findStringRegex  *regexp.Regexp
-	cleanRegex       *regexp.Regexp
+	bus BlueZ
+
+	// address is the device commands are routed to, read from D-Bus signals and HTTP handlers alike
+	address string
+	// chosen is set when the user picked the address, so it isn't replaced while it's connected
+	chosen      bool
+	addressLock sync.RWMutex
 )
 
-func init() {
-	replySerialRegex = regexp.MustCompile(`(.*reply_serial=2\n\s*variant\s*)array`)
-	findStringRegex = regexp.MustCompile(`string\s"(.*)"|uint32\s(\d)+`)
-	cleanRegex = regexp.MustCompile(`(string|uint32|\")+`)
+// errUnavailable is returned when the system bus couldn't be reached
+var errUnavailable = fmt.Errorf("Bluetooth is unavailable")
+
+// defaultAdapter is used when BlueZ doesn't report any adapters
+const defaultAdapter = dbus.ObjectPath("/org/bluez/hci0")
+
+// MediaInfo is the current track and the status of the player playing it
+type MediaInfo struct {
+	Track
+	Status       string `json:"Status"`
+	Position     uint32 `json:"Position"`
+	AlbumArtwork string `json:"Album_Artwork,omitempty"`
 }
 
-// Setup bluetooth with address
-func Setup(router *mux.Router) {
-	SetAddress(settings.Data.GetString("mdroid.BLUETOOTH_ADDRESS"))
-	go startAutoRefresh()
+// Setup connects to BlueZ and the phone backend on the system bus, and adds bluetooth routes
+func Setup(c *core.Core, router *mux.Router) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		log.Error().Msgf("Failed to connect to the system bus, bluetooth will be unavailable: %s", err.Error())
+	}
+	var client BlueZ
+	if conn != nil {
+		// The shared connection is replaced by dbus.SystemBus if the bus goes away, i.e. it restarts
+		if client, err = DialClient(dbus.SystemBus); err != nil {
+			log.Error().Msgf("Failed to connect to BlueZ: %s", err.Error())
+			client = nil
+		}
+	}
+	SetupWithBus(c, router, client, newPhoneBackend(c, conn))
+}
 
-	// Connect bluetooth device on startup
-	go Connect()
+// SetupWithBus adds bluetooth routes backed by the given BlueZ and phone, i.e. a Client on a private bus
+func SetupWithBus(c *core.Core, router *mux.Router, b BlueZ, p PhoneBackend) {
+	bus = b
+	// Only addresses the user chose are saved
+	setAddress(c.Settings.GetString("mdroid.BLUETOOTH_ADDRESS"), true)
+	setupArtwork(c, router)
+
+	if bus != nil {
+		go watch(c)
+		go watchPower(c)
+
+		// Connect bluetooth device on startup
+		go func() {
+			if err := autoConnect(c); err != nil {
+				log.Warn().Msgf("Failed to connect bluetooth on startup: %s", err.Error())
+			}
+		}()
+	}
 
 	//
 	// Bluetooth routes
@@ -49,181 +88,262 @@ func Setup(router *mux.Router) {
 	router.HandleFunc("/bluetooth/next", Next).Methods("GET")
 	router.HandleFunc("/bluetooth/pause", HandlePause).Methods("GET")
 	router.HandleFunc("/bluetooth/play", HandlePlay).Methods("GET")
-	router.HandleFunc("/bluetooth/refresh", ForceRefresh).Methods("GET")
+	router.HandleFunc("/bluetooth/refresh", ForceRefresh(c)).Methods("GET")
+	addDeviceRoutes(c, router)
+	addControlRoutes(router)
+	setupPhone(c, router, p)
 }
 
-// startAutoRefresh will begin go routine for refreshing bt media device address
-func startAutoRefresh() {
-	for {
-		getConnectedAddress()
-		time.Sleep(1000 * time.Millisecond)
+// ForceRefresh to immediately reload every bluetooth object and republish the media state
+func ForceRefresh(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Info().Msg("Forcing refresh of BT objects")
+		if err := refresh(c); err != nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+			return
+		}
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
 	}
 }
 
-// ForceRefresh to immediately reload bt address
-func ForceRefresh(w http.ResponseWriter, r *http.Request) {
-	log.Info().Msg("Forcing refresh of BT address")
-	go getConnectedAddress()
+// Address returns the address bluetooth commands are routed to, formatted for dbus
+func Address() string {
+	addressLock.RLock()
+	defer addressLock.RUnlock()
+	return address
 }
 
-// SetAddress makes address given in args available to all dbus functions
-func SetAddress(address string) {
-	// Format address for dbus
-	if address != "" {
-		BluetoothAddress = strings.Replace(strings.TrimSpace(address), ":", "_", -1)
-		log.Info().Msg("Now routing Bluetooth commands to " + BluetoothAddress)
+// source returns the active address, and if the user chose it
+func source() (string, bool) {
+	addressLock.RLock()
+	defer addressLock.RUnlock()
+	return address, chosen
+}
+
+// SetAddress routes bluetooth commands to the address until the next restart
+func SetAddress(newAddress string) {
+	setAddress(newAddress, false)
+}
 
-		// Set new address to persist in settings file
-		settings.Data.Set("mdroid.BLUETOOTH_ADDRESS", BluetoothAddress)
+// ChooseAddress routes bluetooth commands to an address the user picked, saving it in settings so it's used after restarting
+func ChooseAddress(c *core.Core, newAddress string) {
+	setAddress(newAddress, true)
+	if newAddress = Address(); newAddress != "" && c.Settings.GetString("mdroid.BLUETOOTH_ADDRESS") != newAddress {
+		c.Publish("settings.mdroid.BLUETOOTH_ADDRESS", core.Message{Content: newAddress})
 	}
 }
 
-// HandleConnect wrapper for connect
-func HandleConnect(w http.ResponseWriter, r *http.Request) {
-	Connect()
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+// setAddress formats and stores the active address, ignoring empty ones
+func setAddress(newAddress string, isChosen bool) {
+	if newAddress == "" {
+		return
+	}
+	newAddress = formatAddress(newAddress)
+
+	addressLock.Lock()
+	changed := address != newAddress
+	address = newAddress
+	chosen = isChosen
+	addressLock.Unlock()
+
+	if changed {
+		log.Info().Msg("Now routing Bluetooth commands to " + newAddress)
+	}
 }
 
-// Connect bluetooth device
-func Connect() {
-	ScanOn()
-	log.Info().Msg("Connecting to bluetooth device...")
-	time.Sleep(5 * time.Second)
+// addressFromPath pulls the address out of a device path, i.e. /org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF
+func addressFromPath(device dbus.ObjectPath) string {
+	return strings.TrimPrefix(path.Base(string(device)), "dev_")
+}
 
-	SendDBusCommand(
-		[]string{"/org/bluez/hci0/dev_" + BluetoothAddress, "org.bluez.Device1.Connect"},
-		false,
-		true)
+// adapterPath returns the first adapter BlueZ knows about
+func adapterPath(snapshot Objects) dbus.ObjectPath {
+	adapters := snapshot.Adapters()
+	if len(adapters) == 0 {
+		return defaultAdapter
+	}
+	return adapters[0].Path
+}
 
-	log.Info().Msg("Connection successful.")
+// devicePath returns the object path of the device commands are routed to
+func devicePath() (dbus.ObjectPath, error) {
+	if bus == nil {
+		return "", errUnavailable
+	}
+	active := Address()
+	if active == "" {
+		return "", fmt.Errorf("No valid BT Address to run command")
+	}
+	return dbus.ObjectPath(fmt.Sprintf("%s/dev_%s", adapterPath(objects.only(adapterInterface)), active)), nil
 }
 
-// HandleDisconnect bluetooth device
-func HandleDisconnect(w http.ResponseWriter, r *http.Request) {
-	err := Disconnect()
+// playerFor returns the media player of a device
+func playerFor(snapshot Objects, device dbus.ObjectPath) (Player, bool) {
+	for _, player := range snapshot.Players() {
+		if player.Device == device {
+			return player, true
+		}
+	}
+	return Player{}, false
+}
+
+// currentPlayer returns the media player of the device commands are routed to
+func currentPlayer() (Player, error) {
+	device, err := devicePath()
 	if err != nil {
-		log.Error().Msg(err.Error())
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Could not lookup user", OK: false})
+		return Player{}, err
+	}
+	player, ok := playerFor(objects.only(playerInterface), device)
+	if !ok {
+		return Player{}, fmt.Errorf("Device %s has no media player", Address())
+	}
+	return player, nil
+}
+
+// HandleConnect wrapper for connect, scanning for as long as the optional scan duration, i.e. ?scan=5s
+func HandleConnect(w http.ResponseWriter, r *http.Request) {
+	var scan time.Duration
+	if value := r.URL.Query().Get("scan"); value != "" {
+		var err error
+		if scan, err = time.ParseDuration(value); err != nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+			return
+		}
+	}
+	if err := Connect(scan); err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
 	}
 	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
 }
 
-// Disconnect bluetooth device
-func Disconnect() error {
-	log.Info().Msg("Disconnecting from bluetooth device...")
+// Connect bluetooth device, scanning for the given time first so it can be found if it isn't cached.
+// Devices BlueZ doesn't know about are scanned for discoveryTime without one.
+func Connect(scan time.Duration) error {
+	device, err := devicePath()
+	if err != nil {
+		log.Warn().Msg(err.Error())
+		return err
+	}
+
+	if _, err := findDevice(Address()); err != nil && scan == 0 {
+		scan = discoveryTime
+	}
+	if scan > 0 {
+		stopDiscovery := discover(scan)
+		defer stopDiscovery()
+	}
 
-	SendDBusCommand(
-		[]string{"/org/bluez/hci0/dev_" + BluetoothAddress,
-			"org.bluez.Device1.Disconnect"},
-		false,
-		true)
+	log.Info().Msg("Connecting to bluetooth device...")
 
+	if err := bus.Connect(device); err != nil {
+		log.Error().Msgf("Failed to connect to bluetooth device %s: %s", Address(), err.Error())
+		return err
+	}
+	log.Info().Msg("Connection successful.")
 	return nil
 }
 
-func askDeviceInfo() map[string]string {
-	log.Info().Msg("Getting device info...")
-
-	deviceMessage := []string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.freedesktop.DBus.Properties.Get", "string:org.bluez.MediaPlayer1", "string:Status"}
-	result, ok := SendDBusCommand(deviceMessage, true, false)
-	if !ok {
-		return nil
-	}
-	if result == "" {
-		// empty response
-		log.Warn().Msg(fmt.Sprintf("Empty dbus response when querying device, not attempting to clean. We asked: \n%s", strings.Join(deviceMessage, " ")))
-		return nil
+// HandleDisconnect bluetooth device
+func HandleDisconnect(w http.ResponseWriter, r *http.Request) {
+	if err := Disconnect(); err != nil {
+		log.Error().Msg(err.Error())
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
 	}
-	return cleanDBusOutput(result)
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
 }
 
-func askMediaInfo() map[string]string {
-	log.Info().Msg("Getting media info...")
-	mediaMessage := []string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.freedesktop.DBus.Properties.Get", "string:org.bluez.MediaPlayer1", "string:Track"}
-	result, ok := SendDBusCommand(mediaMessage, true, false)
-	if !ok {
-		return nil
-	}
-	if result == "" {
-		// empty response
-		log.Warn().Msg(fmt.Sprintf("Empty dbus response when querying media, not attempting to clean. We asked: \n%s", strings.Join(mediaMessage, " ")))
-		return nil
+// Disconnect bluetooth device
+func Disconnect() error {
+	log.Info().Msg("Disconnecting from bluetooth device...")
+	device, err := devicePath()
+	if err != nil {
+		return err
 	}
-	return cleanDBusOutput(result)
+	return bus.Disconnect(device)
 }
 
 // GetDeviceInfo attempts to get metadata about connected device
 func GetDeviceInfo(w http.ResponseWriter, r *http.Request) {
-	deviceStatus := askDeviceInfo()
-	if deviceStatus == nil {
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Error getting media info", Status: "fail", OK: false})
+	player, err := currentPlayer()
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), Status: "fail", OK: false})
 		return
 	}
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: deviceStatus, Status: "success", OK: true})
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: player, Status: "success", OK: true})
 }
 
 // GetMediaInfo attempts to get metadata about current track
 func GetMediaInfo(w http.ResponseWriter, r *http.Request) {
-	deviceStatus := askDeviceInfo()
-	if deviceStatus == nil {
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Error getting media info", Status: "fail", OK: false})
-		return
-	}
-
-	resp := askMediaInfo()
-	if resp == nil {
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Error getting media info", Status: "fail", OK: false})
+	player, err := currentPlayer()
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), Status: "fail", OK: false})
 		return
 	}
 
-	// Append device status to media info
-	resp["Status"] = deviceStatus["Meta"]
+	resp := MediaInfo{Track: player.Track, Status: player.Status, Position: player.Position}
 
 	// Append Album / Artwork slug if both exist
-	album, albumOK := resp["Album"]
-	artist, artistOK := resp["Artist"]
-	if albumOK && artistOK {
-		resp["Album_Artwork"] = slug.Make(artist) + "/" + slug.Make(album) + ".jpg"
-	}
+	resp.AlbumArtwork = artworkSlug(resp.Artist, resp.Album)
 
 	// Echo back all info
 	core.WriteNewResponse(&w, r, core.JSONResponse{Output: resp, Status: "success", OK: true})
 }
 
+// control runs a media player command against the current player
+func control(name string, command func(dbus.ObjectPath) error) error {
+	player, err := currentPlayer()
+	if err != nil {
+		log.Warn().Msgf("Can't %s: %s", name, err.Error())
+		return err
+	}
+	if err := command(player.Path); err != nil {
+		log.Error().Msgf("Failed to %s: %s", name, err.Error())
+		return err
+	}
+	return nil
+}
+
+// writeControl responds to a media player command
+func writeControl(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+}
+
 // Prev skips to previous track
 func Prev(w http.ResponseWriter, r *http.Request) {
 	log.Info().Msg("Going to previous track...")
-	go SendDBusCommand([]string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.bluez.MediaPlayer1.Previous"}, false, false)
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+	writeControl(w, r, control("go to previous track", func(player dbus.ObjectPath) error { return bus.Previous(player) }))
 }
 
 // Next skips to next track
 func Next(w http.ResponseWriter, r *http.Request) {
 	log.Info().Msg("Going to next track...")
-	go SendDBusCommand([]string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.bluez.MediaPlayer1.Next"}, false, false)
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+	writeControl(w, r, control("go to next track", func(player dbus.ObjectPath) error { return bus.Next(player) }))
 }
 
 // HandlePlay attempts to play bluetooth media
 func HandlePlay(w http.ResponseWriter, r *http.Request) {
-	Play()
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+	writeControl(w, r, Play())
 }
 
 // Play attempts to play bluetooth media
-func Play() {
+func Play() error {
 	log.Info().Msg("Attempting to play media...")
-	SendDBusCommand([]string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.bluez.MediaPlayer1.Play"}, false, false)
+	return control("play media", func(player dbus.ObjectPath) error { return bus.Play(player) })
 }
 
 // HandlePause attempts to pause bluetooth media
 func HandlePause(w http.ResponseWriter, r *http.Request) {
-	Pause()
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+	writeControl(w, r, Pause())
 }
 
 // Pause attempts to pause bluetooth media
-func Pause() {
+func Pause() error {
 	log.Info().Msg("Attempting to pause media...")
-	go SendDBusCommand([]string{"/org/bluez/hci0/dev_" + BluetoothAddress + "/player0", "org.bluez.MediaPlayer1.Pause"}, false, false)
+	return control("pause media", func(player dbus.ObjectPath) error { return bus.Pause(player) })
 }
@@ -0,0 +1,491 @@
+package bluetooth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// BlueZ D-Bus names
+const (
+	bluezService       = "org.bluez"
+	adapterInterface   = "org.bluez.Adapter1"
+	deviceInterface    = "org.bluez.Device1"
+	playerInterface    = "org.bluez.MediaPlayer1"
+	folderInterface    = "org.bluez.MediaFolder1"
+	itemInterface      = "org.bluez.MediaItem1"
+	transportInterface = "org.bluez.MediaTransport1"
+)
+
+// Adapter is a local Bluetooth controller, i.e. hci0
+type Adapter struct {
+	Path        dbus.ObjectPath `json:"path"`
+	Address     string          `json:"address"`
+	Name        string          `json:"name"`
+	Powered     bool            `json:"powered"`
+	Discovering bool            `json:"discovering"`
+}
+
+// Device is a remote Bluetooth device known to an adapter
+type Device struct {
+	Path      dbus.ObjectPath `json:"path"`
+	Adapter   dbus.ObjectPath `json:"adapter"`
+	Address   string          `json:"address"`
+	Name      string          `json:"name"`
+	Alias     string          `json:"alias"`
+	Paired    bool            `json:"paired"`
+	Trusted   bool            `json:"trusted"`
+	Connected bool            `json:"connected"`
+}
+
+// Track is the metadata of the song a media player is playing
+type Track struct {
+	Title          string `json:"Title,omitempty"`
+	Artist         string `json:"Artist,omitempty"`
+	Album          string `json:"Album,omitempty"`
+	Genre          string `json:"Genre,omitempty"`
+	Duration       uint32 `json:"Duration,omitempty"`
+	TrackNumber    uint32 `json:"TrackNumber,omitempty"`
+	NumberOfTracks uint32 `json:"NumberOfTracks,omitempty"`
+	ImgHandle      string `json:"ImgHandle,omitempty"`
+}
+
+// Player is a remote device's media player, controlled over AVRCP
+type Player struct {
+	Path     dbus.ObjectPath `json:"path"`
+	Device   dbus.ObjectPath `json:"device"`
+	Name     string          `json:"name"`
+	Status   string          `json:"status"`
+	Position uint32          `json:"position"`
+	Shuffle  string          `json:"shuffle,omitempty"`
+	Repeat   string          `json:"repeat,omitempty"`
+	Playlist dbus.ObjectPath `json:"playlist,omitempty"`
+	ObexPort uint16          `json:"obexPort,omitempty"`
+	Track    Track           `json:"track"`
+}
+
+// MediaItem is a track or folder on a player that supports browsing
+type MediaItem struct {
+	Path       dbus.ObjectPath `json:"path"`
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	FolderType string          `json:"folderType,omitempty"`
+	Playable   bool            `json:"playable"`
+	Track      Track           `json:"track"`
+}
+
+// Transport is an audio stream from a remote device. Devices with one are actively connected for media.
+type Transport struct {
+	Path   dbus.ObjectPath `json:"path"`
+	Device dbus.ObjectPath `json:"device"`
+	State  string          `json:"state"`
+	Volume uint16          `json:"volume"`
+}
+
+// BlueZ is the set of BlueZ calls the bluetooth module makes.
+// Client implements it over D-Bus, and can be handed a private bus so a fake BlueZ can stand in.
+type BlueZ interface {
+	ManagedObjects() (Objects, error)
+	Watch() (<-chan Event, error)
+
+	Adapters() ([]Adapter, error)
+	Devices() ([]Device, error)
+	Players() ([]Player, error)
+	Transports() ([]Transport, error)
+
+	StartDiscovery(adapter dbus.ObjectPath) error
+	StopDiscovery(adapter dbus.ObjectPath) error
+
+	Connect(device dbus.ObjectPath) error
+	Disconnect(device dbus.ObjectPath) error
+	Pair(device dbus.ObjectPath) error
+	SetTrusted(device dbus.ObjectPath, trusted bool) error
+	RemoveDevice(adapter dbus.ObjectPath, device dbus.ObjectPath) error
+
+	Play(player dbus.ObjectPath) error
+	Pause(player dbus.ObjectPath) error
+	Next(player dbus.ObjectPath) error
+	Previous(player dbus.ObjectPath) error
+	FastForward(player dbus.ObjectPath) error
+	Rewind(player dbus.ObjectPath) error
+	SetShuffle(player dbus.ObjectPath, mode string) error
+	SetRepeat(player dbus.ObjectPath, mode string) error
+	SetVolume(transport dbus.ObjectPath, volume uint16) error
+
+	ListItems(player dbus.ObjectPath) ([]MediaItem, error)
+	ChangeFolder(player dbus.ObjectPath, folder dbus.ObjectPath) error
+	PlayItem(item dbus.ObjectPath) error
+}
+
+// Client talks to BlueZ over a D-Bus connection
+type Client struct {
+	service string
+	// dial reconnects to the bus once the connection closes, if it's set
+	dial func() (*dbus.Conn, error)
+
+	mutex sync.Mutex
+	conn  *dbus.Conn
+	// signals and stop belong to the last Watch, so they can be removed before watching again
+	signals chan *dbus.Signal
+	stop    chan struct{}
+}
+
+// NewClient creates a BlueZ client on the given connection, usually dbus.SystemBus()
+func NewClient(conn *dbus.Conn) *Client {
+	return &Client{conn: conn, service: bluezService}
+}
+
+// DialClient creates a BlueZ client that reconnects with dial whenever its connection closes, i.e. dbus.SystemBus
+func DialClient(dial func() (*dbus.Conn, error)) (*Client, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, service: bluezService, dial: dial}, nil
+}
+
+// getConn returns the current connection, which is replaced when it's redialed
+func (client *Client) getConn() *dbus.Conn {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.conn
+}
+
+// Objects are every object BlueZ exports, by path then interface then property
+type Objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// ManagedObjects lists everything BlueZ knows about in a single call
+func (client *Client) ManagedObjects() (Objects, error) {
+	objects := make(Objects)
+	err := client.getConn().Object(client.service, "/").
+		Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).
+		Store(&objects)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// withInterface returns the sorted paths of objects implementing the interface
+func (objects Objects) withInterface(iface string) []dbus.ObjectPath {
+	var paths []dbus.ObjectPath
+	for path, interfaces := range objects {
+		if _, ok := interfaces[iface]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+	return paths
+}
+
+// Adapters returns every local Bluetooth controller
+func (client *Client) Adapters() ([]Adapter, error) {
+	objects, err := client.ManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	return objects.Adapters(), nil
+}
+
+// Devices returns every remote device known to any adapter
+func (client *Client) Devices() ([]Device, error) {
+	objects, err := client.ManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	return objects.Devices(), nil
+}
+
+// Players returns the media players of every connected device
+func (client *Client) Players() ([]Player, error) {
+	objects, err := client.ManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	return objects.Players(), nil
+}
+
+// Transports returns every open audio stream
+func (client *Client) Transports() ([]Transport, error) {
+	objects, err := client.ManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+	return objects.Transports(), nil
+}
+
+// Adapters parses every adapter in the objects
+func (objects Objects) Adapters() []Adapter {
+	var adapters []Adapter
+	for _, path := range objects.withInterface(adapterInterface) {
+		adapters = append(adapters, parseAdapter(path, objects[path][adapterInterface]))
+	}
+	return adapters
+}
+
+// Devices parses every device in the objects
+func (objects Objects) Devices() []Device {
+	var devices []Device
+	for _, path := range objects.withInterface(deviceInterface) {
+		devices = append(devices, parseDevice(path, objects[path][deviceInterface]))
+	}
+	return devices
+}
+
+// Players parses every media player in the objects
+func (objects Objects) Players() []Player {
+	var players []Player
+	for _, path := range objects.withInterface(playerInterface) {
+		players = append(players, parsePlayer(path, objects[path][playerInterface]))
+	}
+	return players
+}
+
+// Transports parses every media transport in the objects
+func (objects Objects) Transports() []Transport {
+	var transports []Transport
+	for _, path := range objects.withInterface(transportInterface) {
+		transports = append(transports, parseTransport(path, objects[path][transportInterface]))
+	}
+	return transports
+}
+
+// StartDiscovery scans for nearby devices on the adapter
+func (client *Client) StartDiscovery(adapter dbus.ObjectPath) error {
+	return client.call(adapter, adapterInterface, "StartDiscovery")
+}
+
+// StopDiscovery stops scanning on the adapter
+func (client *Client) StopDiscovery(adapter dbus.ObjectPath) error {
+	return client.call(adapter, adapterInterface, "StopDiscovery")
+}
+
+// Connect all of the device's profiles
+func (client *Client) Connect(device dbus.ObjectPath) error {
+	return client.call(device, deviceInterface, "Connect")
+}
+
+// Disconnect all of the device's profiles
+func (client *Client) Disconnect(device dbus.ObjectPath) error {
+	return client.call(device, deviceInterface, "Disconnect")
+}
+
+// Pair with the device, which may need to be confirmed on it
+func (client *Client) Pair(device dbus.ObjectPath) error {
+	return client.call(device, deviceInterface, "Pair")
+}
+
+// SetTrusted allows or disallows the device to connect without being confirmed
+func (client *Client) SetTrusted(device dbus.ObjectPath, trusted bool) error {
+	return client.setProperty(device, deviceInterface, "Trusted", trusted)
+}
+
+// RemoveDevice unpairs the device and forgets it
+func (client *Client) RemoveDevice(adapter dbus.ObjectPath, device dbus.ObjectPath) error {
+	return client.call(adapter, adapterInterface, "RemoveDevice", device)
+}
+
+// Play resumes the player
+func (client *Client) Play(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "Play")
+}
+
+// Pause the player
+func (client *Client) Pause(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "Pause")
+}
+
+// Next skips the player to the next track
+func (client *Client) Next(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "Next")
+}
+
+// Previous skips the player to the previous track
+func (client *Client) Previous(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "Previous")
+}
+
+// FastForward the player until it's told to play or pause
+func (client *Client) FastForward(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "FastForward")
+}
+
+// Rewind the player until it's told to play or pause
+func (client *Client) Rewind(player dbus.ObjectPath) error {
+	return client.call(player, playerInterface, "Rewind")
+}
+
+// SetShuffle sets the player's shuffle mode, one of off, alltracks or group
+func (client *Client) SetShuffle(player dbus.ObjectPath, mode string) error {
+	return client.setProperty(player, playerInterface, "Shuffle", mode)
+}
+
+// SetRepeat sets the player's repeat mode, one of off, singletrack, alltracks or group
+func (client *Client) SetRepeat(player dbus.ObjectPath, mode string) error {
+	return client.setProperty(player, playerInterface, "Repeat", mode)
+}
+
+// SetVolume sets the absolute volume of the stream, from 0 to 127
+func (client *Client) SetVolume(transport dbus.ObjectPath, volume uint16) error {
+	return client.setProperty(transport, transportInterface, "Volume", volume)
+}
+
+// ListItems lists the contents of the player's current folder
+func (client *Client) ListItems(player dbus.ObjectPath) ([]MediaItem, error) {
+	if player == "" {
+		return nil, fmt.Errorf("no player to list items of")
+	}
+
+	listed := make(map[dbus.ObjectPath]map[string]dbus.Variant)
+	err := client.getConn().Object(client.service, player).
+		Call(folderInterface+".ListItems", 0, map[string]dbus.Variant{}).
+		Store(&listed)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]MediaItem, 0, len(listed))
+	for path, props := range listed {
+		items = append(items, parseItem(path, props))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	return items, nil
+}
+
+// ChangeFolder browses the player into a folder, i.e. its now playing list
+func (client *Client) ChangeFolder(player dbus.ObjectPath, folder dbus.ObjectPath) error {
+	return client.call(player, folderInterface, "ChangeFolder", folder)
+}
+
+// PlayItem plays a track from a browsed folder
+func (client *Client) PlayItem(item dbus.ObjectPath) error {
+	return client.call(item, itemInterface, "Play")
+}
+
+// setProperty sets a single property of an object
+func (client *Client) setProperty(path dbus.ObjectPath, iface string, name string, value interface{}) error {
+	if path == "" {
+		return fmt.Errorf("no object to set %s.%s on", iface, name)
+	}
+	return client.getConn().Object(client.service, path).SetProperty(iface+"."+name, dbus.MakeVariant(value))
+}
+
+// call a method without arguments or a reply
+func (client *Client) call(path dbus.ObjectPath, iface string, method string, args ...interface{}) error {
+	if path == "" {
+		return fmt.Errorf("no object to call %s.%s on", iface, method)
+	}
+	return client.getConn().Object(client.service, path).Call(iface+"."+method, 0, args...).Err
+}
+
+func parseAdapter(path dbus.ObjectPath, props map[string]dbus.Variant) Adapter {
+	return Adapter{
+		Path:        path,
+		Address:     propString(props, "Address"),
+		Name:        propString(props, "Name"),
+		Powered:     propBool(props, "Powered"),
+		Discovering: propBool(props, "Discovering"),
+	}
+}
+
+func parseDevice(path dbus.ObjectPath, props map[string]dbus.Variant) Device {
+	return Device{
+		Path:      path,
+		Adapter:   propPath(props, "Adapter"),
+		Address:   propString(props, "Address"),
+		Name:      propString(props, "Name"),
+		Alias:     propString(props, "Alias"),
+		Paired:    propBool(props, "Paired"),
+		Trusted:   propBool(props, "Trusted"),
+		Connected: propBool(props, "Connected"),
+	}
+}
+
+func parsePlayer(path dbus.ObjectPath, props map[string]dbus.Variant) Player {
+	player := Player{
+		Path:     path,
+		Device:   propPath(props, "Device"),
+		Name:     propString(props, "Name"),
+		Status:   propString(props, "Status"),
+		Position: propUint32(props, "Position"),
+		Shuffle:  propString(props, "Shuffle"),
+		Repeat:   propString(props, "Repeat"),
+		Playlist: propPath(props, "Playlist"),
+	}
+	if port, ok := props["ObexPort"].Value().(uint16); ok {
+		player.ObexPort = port
+	}
+	if track, ok := props["Track"]; ok {
+		if metadata, ok := track.Value().(map[string]dbus.Variant); ok {
+			player.Track = parseTrack(metadata)
+		}
+	}
+	return player
+}
+
+func parseItem(path dbus.ObjectPath, props map[string]dbus.Variant) MediaItem {
+	item := MediaItem{
+		Path:       path,
+		Name:       propString(props, "Name"),
+		Type:       propString(props, "Type"),
+		FolderType: propString(props, "FolderType"),
+		Playable:   propBool(props, "Playable"),
+	}
+	if metadata, ok := props["Metadata"].Value().(map[string]dbus.Variant); ok {
+		item.Track = parseTrack(metadata)
+	}
+	return item
+}
+
+func parseTrack(props map[string]dbus.Variant) Track {
+	return Track{
+		Title:          propString(props, "Title"),
+		Artist:         propString(props, "Artist"),
+		Album:          propString(props, "Album"),
+		Genre:          propString(props, "Genre"),
+		Duration:       propUint32(props, "Duration"),
+		TrackNumber:    propUint32(props, "TrackNumber"),
+		NumberOfTracks: propUint32(props, "NumberOfTracks"),
+		ImgHandle:      propString(props, "ImgHandle"),
+	}
+}
+
+func parseTransport(path dbus.ObjectPath, props map[string]dbus.Variant) Transport {
+	transport := Transport{
+		Path:   path,
+		Device: propPath(props, "Device"),
+		State:  propString(props, "State"),
+	}
+	if volume, ok := props["Volume"].Value().(uint16); ok {
+		transport.Volume = volume
+	}
+	return transport
+}
+
+func propString(props map[string]dbus.Variant, name string) string {
+	value, _ := props[name].Value().(string)
+	return value
+}
+
+func propBool(props map[string]dbus.Variant, name string) bool {
+	value, _ := props[name].Value().(bool)
+	return value
+}
+
+func propUint32(props map[string]dbus.Variant, name string) uint32 {
+	value, _ := props[name].Value().(uint32)
+	return value
+}
+
+func propPath(props map[string]dbus.Variant, name string) dbus.ObjectPath {
+	value, _ := props[name].Value().(dbus.ObjectPath)
+	return value
+}
+
+// formatAddress converts between a device's MAC address and the form BlueZ uses in object paths
+func formatAddress(address string) string {
+	return strings.ToUpper(strings.Replace(strings.TrimSpace(address), ":", "_", -1))
+}
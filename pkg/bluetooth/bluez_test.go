@@ -0,0 +1,340 @@
+package bluetooth
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	testAdapter = dbus.ObjectPath("/org/bluez/hci0")
+	testDevice  = dbus.ObjectPath("/org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF")
+	testPlayer  = dbus.ObjectPath("/org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF/player0")
+)
+
+// startBus runs a private session bus for the test, skipping it if dbus-daemon isn't installed
+func startBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon isn't installed")
+	}
+
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// fakeBlueZ exports an adapter, a device and its player under org.bluez, recording the calls made to them
+type fakeBlueZ struct {
+	conn *dbus.Conn
+
+	mutex   sync.Mutex
+	objects Objects
+	calls   []string
+}
+
+func newFakeBlueZ(t *testing.T, address string) *fakeBlueZ {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeBlueZ{conn: conn, objects: Objects{
+		testAdapter: {adapterInterface: {
+			"Address": dbus.MakeVariant("00:11:22:33:44:55"),
+			"Name":    dbus.MakeVariant("car"),
+			"Powered": dbus.MakeVariant(true),
+		}},
+		testDevice: {deviceInterface: {
+			"Adapter":   dbus.MakeVariant(testAdapter),
+			"Address":   dbus.MakeVariant("AA:BB:CC:DD:EE:FF"),
+			"Alias":     dbus.MakeVariant("phone"),
+			"Paired":    dbus.MakeVariant(true),
+			"Connected": dbus.MakeVariant(false),
+		}},
+		testPlayer: {playerInterface: {
+			"Device": dbus.MakeVariant(testDevice),
+			"Status": dbus.MakeVariant("paused"),
+			"Track": dbus.MakeVariant(map[string]dbus.Variant{
+				"Title":  dbus.MakeVariant("Song"),
+				"Artist": dbus.MakeVariant("Artist"),
+			}),
+		}},
+	}}
+
+	export := func(methods map[string]interface{}, path dbus.ObjectPath, iface string) {
+		if err := conn.ExportMethodTable(methods, path, iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export(map[string]interface{}{
+		"GetManagedObjects": func() (Objects, *dbus.Error) {
+			fake.mutex.Lock()
+			defer fake.mutex.Unlock()
+			return fake.objects, nil
+		},
+	}, "/", objectManagerInterface)
+	export(map[string]interface{}{
+		"StartDiscovery": func() *dbus.Error { return fake.set(testAdapter, adapterInterface, "Discovering", true) },
+		"StopDiscovery":  func() *dbus.Error { return fake.set(testAdapter, adapterInterface, "Discovering", false) },
+	}, testAdapter, adapterInterface)
+	export(map[string]interface{}{
+		"Connect":    func() *dbus.Error { return fake.set(testDevice, deviceInterface, "Connected", true) },
+		"Disconnect": func() *dbus.Error { return fake.set(testDevice, deviceInterface, "Connected", false) },
+	}, testDevice, deviceInterface)
+	export(map[string]interface{}{
+		"Play":  func() *dbus.Error { return fake.set(testPlayer, playerInterface, "Status", "playing") },
+		"Pause": func() *dbus.Error { return fake.set(testPlayer, playerInterface, "Status", "paused") },
+	}, testPlayer, playerInterface)
+	for _, path := range []dbus.ObjectPath{testAdapter, testDevice, testPlayer} {
+		path := path
+		export(map[string]interface{}{
+			"Set": func(iface string, name string, value dbus.Variant) *dbus.Error {
+				return fake.set(path, iface, name, value.Value())
+			},
+		}, path, propertiesInterface)
+	}
+
+	reply, err := conn.RequestName(bluezService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Failed to own %s: %v", bluezService, err)
+	}
+	return fake
+}
+
+// set records a call that changes a property, and signals the change like BlueZ does
+func (fake *fakeBlueZ) set(path dbus.ObjectPath, iface string, name string, value interface{}) *dbus.Error {
+	fake.mutex.Lock()
+	fake.objects[path][iface][name] = dbus.MakeVariant(value)
+	fake.calls = append(fake.calls, string(path)+" "+name)
+	fake.mutex.Unlock()
+
+	changed := map[string]dbus.Variant{name: dbus.MakeVariant(value)}
+	if err := fake.conn.Emit(path, propertiesInterface+".PropertiesChanged", iface, changed, []string{}); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+func (fake *fakeBlueZ) called(call string) bool {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, made := range fake.calls {
+		if made == call {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestClient connects a client to the private bus, redialing it like the system bus
+func newTestClient(t *testing.T, address string) *Client {
+	client, err := DialClient(func() (*dbus.Conn, error) { return dbus.Connect(address) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.getConn().Close() })
+	return client
+}
+
+// nextEvent waits for an event, failing if none arrives or the channel closes
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("Events closed while waiting for one")
+		}
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return Event{}
+}
+
+// expectClosed fails unless the events channel closes
+func expectClosed(t *testing.T, events <-chan Event) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Events of an old subscription weren't closed")
+		}
+	}
+}
+
+func TestClientObjects(t *testing.T) {
+	address := startBus(t)
+	newFakeBlueZ(t, address)
+	client := newTestClient(t, address)
+
+	adapters, err := client.Adapters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adapters) != 1 || adapters[0].Path != testAdapter || adapters[0].Name != "car" || !adapters[0].Powered {
+		t.Fatalf("Unexpected adapters %+v", adapters)
+	}
+
+	devices, err := client.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Adapter != testAdapter || devices[0].Alias != "phone" || devices[0].Connected {
+		t.Fatalf("Unexpected devices %+v", devices)
+	}
+
+	players, err := client.Players()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(players) != 1 || players[0].Device != testDevice || players[0].Track.Title != "Song" || players[0].Track.Artist != "Artist" {
+		t.Fatalf("Unexpected players %+v", players)
+	}
+}
+
+func TestClientCalls(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeBlueZ(t, address)
+	client := newTestClient(t, address)
+
+	events, err := client.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.StartDiscovery(testAdapter); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Path != testAdapter || event.Properties["Discovering"].Value() != true {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if err := client.Connect(testDevice); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Path != testDevice || event.Interface != deviceInterface || event.Properties["Connected"].Value() != true {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if err := client.Play(testPlayer); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Path != testPlayer || event.Properties["Status"].Value() != "playing" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	if err := client.SetShuffle(testPlayer, "alltracks"); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Properties["Shuffle"].Value() != "alltracks" {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+
+	for _, call := range []string{
+		string(testAdapter) + " Discovering",
+		string(testDevice) + " Connected",
+		string(testPlayer) + " Status",
+		string(testPlayer) + " Shuffle",
+	} {
+		if !fake.called(call) {
+			t.Errorf("Expected %s to be called", call)
+		}
+	}
+
+	// Calls without an object are refused before reaching the bus
+	if err := client.Connect(""); err == nil {
+		t.Fatal("Expected connecting without a device to fail")
+	}
+}
+
+func TestClientRewatch(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeBlueZ(t, address)
+	client := newTestClient(t, address)
+
+	first, err := client.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, first)
+
+	// The old signal channel and match rules are gone, so each change arrives once
+	fake.set(testDevice, deviceInterface, "Connected", true)
+	fake.set(testDevice, deviceInterface, "Connected", false)
+	if event := nextEvent(t, second); event.Properties["Connected"].Value() != true {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if event := nextEvent(t, second); event.Properties["Connected"].Value() != false {
+		t.Fatalf("Expected the second change, got duplicate %+v", event)
+	}
+}
+
+func TestClientRedial(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeBlueZ(t, address)
+	client := newTestClient(t, address)
+
+	events, err := client.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the connection closes the events, and watching again redials
+	client.getConn().Close()
+	expectClosed(t, events)
+	if err := client.Connect(testDevice); err == nil {
+		t.Fatal("Expected calls on the closed connection to fail")
+	}
+
+	events, err = client.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.getConn().Connected() {
+		t.Fatal("Client didn't redial")
+	}
+	if err := client.Connect(testDevice); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events); event.Path != testDevice || event.Properties["Connected"].Value() != true {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if !fake.called(string(testDevice) + " Connected") {
+		t.Fatal("Connect didn't reach BlueZ after redialing")
+	}
+
+	// Without a way to redial, a closed client stays closed
+	closed := NewClient(client.getConn())
+	closed.getConn().Close()
+	if _, err := closed.Watch(); err == nil {
+		t.Fatal("Expected watching a closed connection to fail")
+	}
+}
@@ -0,0 +1,172 @@
+package bluetooth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// maxVolume is the top of the AVRCP absolute volume range
+const maxVolume = 127
+
+var (
+	shuffleModes = map[string]bool{"off": true, "alltracks": true, "group": true}
+	repeatModes  = map[string]bool{"off": true, "singletrack": true, "alltracks": true, "group": true}
+)
+
+// addControlRoutes adds routes for AVRCP controls beyond play, pause and skipping
+func addControlRoutes(router *mux.Router) {
+	router.HandleFunc("/bluetooth/volume", GetVolume).Methods("GET")
+	router.HandleFunc("/bluetooth/volume/{volume}", SetVolume).Methods("GET")
+	router.HandleFunc("/bluetooth/fastforward", FastForward).Methods("GET")
+	router.HandleFunc("/bluetooth/rewind", Rewind).Methods("GET")
+	router.HandleFunc("/bluetooth/shuffle/{mode}", SetShuffle).Methods("GET")
+	router.HandleFunc("/bluetooth/repeat/{mode}", SetRepeat).Methods("GET")
+	router.HandleFunc("/bluetooth/browse", Browse).Methods("GET")
+	router.HandleFunc("/bluetooth/browse/nowplaying", BrowseNowPlaying).Methods("GET")
+	router.HandleFunc("/bluetooth/browse/folder/{item:.+}", BrowseFolder).Methods("GET")
+	router.HandleFunc("/bluetooth/browse/play/{item:.+}", PlayItem).Methods("GET")
+}
+
+// currentTransport returns the audio stream of the device commands are routed to
+func currentTransport() (Transport, error) {
+	device, err := devicePath()
+	if err != nil {
+		return Transport{}, err
+	}
+	for _, transport := range objects.only(transportInterface).Transports() {
+		if transport.Device == device {
+			return transport, nil
+		}
+	}
+	return Transport{}, fmt.Errorf("Device %s isn't streaming audio", Address())
+}
+
+// volumePercent converts an AVRCP volume to a percentage
+func volumePercent(volume uint16) int {
+	return int(math.Round(float64(volume) * 100 / maxVolume))
+}
+
+// GetVolume responds with the volume of the current stream, as a percentage
+func GetVolume(w http.ResponseWriter, r *http.Request) {
+	transport, err := currentTransport()
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: volumePercent(transport.Volume), OK: true})
+}
+
+// SetVolume sets the volume of the current stream, as a percentage
+func SetVolume(w http.ResponseWriter, r *http.Request) {
+	percent, err := strconv.ParseFloat(mux.Vars(r)["volume"], 64)
+	if err != nil || percent < 0 || percent > 100 {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Volume must be a percentage from 0 to 100", OK: false})
+		return
+	}
+
+	transport, err := currentTransport()
+	if err == nil {
+		log.Info().Msgf("Setting bluetooth volume to %v%%...", percent)
+		err = bus.SetVolume(transport.Path, uint16(math.Round(percent*maxVolume/100)))
+	}
+	writeControl(w, r, err)
+}
+
+// FastForward seeks forward through the track until play or pause
+func FastForward(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("Fast forwarding...")
+	writeControl(w, r, control("fast forward", func(player dbus.ObjectPath) error { return bus.FastForward(player) }))
+}
+
+// Rewind seeks backward through the track until play or pause
+func Rewind(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("Rewinding...")
+	writeControl(w, r, control("rewind", func(player dbus.ObjectPath) error { return bus.Rewind(player) }))
+}
+
+// SetShuffle sets the player's shuffle mode, one of off, alltracks or group
+func SetShuffle(w http.ResponseWriter, r *http.Request) {
+	mode := strings.ToLower(mux.Vars(r)["mode"])
+	if !shuffleModes[mode] {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("Unknown shuffle mode %s", mode), OK: false})
+		return
+	}
+	writeControl(w, r, control("set shuffle", func(player dbus.ObjectPath) error { return bus.SetShuffle(player, mode) }))
+}
+
+// SetRepeat sets the player's repeat mode, one of off, singletrack, alltracks or group
+func SetRepeat(w http.ResponseWriter, r *http.Request) {
+	mode := strings.ToLower(mux.Vars(r)["mode"])
+	if !repeatModes[mode] {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("Unknown repeat mode %s", mode), OK: false})
+		return
+	}
+	writeControl(w, r, control("set repeat", func(player dbus.ObjectPath) error { return bus.SetRepeat(player, mode) }))
+}
+
+// browse lists a folder on the current player, changing to it first unless it's empty
+func browse(w http.ResponseWriter, r *http.Request, folder func(Player) (dbus.ObjectPath, error)) {
+	player, err := currentPlayer()
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+
+	path, err := folder(player)
+	if err == nil && path != "" {
+		err = bus.ChangeFolder(player.Path, path)
+	}
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+
+	items, err := bus.ListItems(player.Path)
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: items, OK: true})
+}
+
+// itemPath resolves an item given relative to the player, i.e. Filesystem/item1
+func itemPath(player Player, item string) dbus.ObjectPath {
+	return dbus.ObjectPath(fmt.Sprintf("%s/%s", player.Path, strings.Trim(item, "/")))
+}
+
+// Browse lists the player's current folder
+func Browse(w http.ResponseWriter, r *http.Request) {
+	browse(w, r, func(Player) (dbus.ObjectPath, error) { return "", nil })
+}
+
+// BrowseNowPlaying lists the tracks queued on the player
+func BrowseNowPlaying(w http.ResponseWriter, r *http.Request) {
+	browse(w, r, func(player Player) (dbus.ObjectPath, error) {
+		if player.Playlist == "" {
+			return "", fmt.Errorf("Player %s has no now playing list", player.Name)
+		}
+		return player.Playlist, nil
+	})
+}
+
+// BrowseFolder changes into a folder on the player, given relative to it, and lists it
+func BrowseFolder(w http.ResponseWriter, r *http.Request) {
+	browse(w, r, func(player Player) (dbus.ObjectPath, error) {
+		return itemPath(player, mux.Vars(r)["item"]), nil
+	})
+}
+
+// PlayItem plays a track on the player, given relative to it
+func PlayItem(w http.ResponseWriter, r *http.Request) {
+	writeControl(w, r, control("play item", func(player dbus.ObjectPath) error {
+		return bus.PlayItem(itemPath(Player{Path: player}, mux.Vars(r)["item"]))
+	}))
+}
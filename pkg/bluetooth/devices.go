@@ -0,0 +1,340 @@
+package bluetooth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// KnownDevice is a device BlueZ knows about, and where it stands for auto-connecting
+type KnownDevice struct {
+	Device
+	// Priority is the device's position in the auto-connect order, or -1 if it isn't in it
+	Priority int  `json:"priority"`
+	Active   bool `json:"active"`
+}
+
+const (
+	// powerQueue is how many acc_power updates can wait to be read
+	powerQueue = 16
+	// discoveryTime is how long to scan before connecting, so devices missing from BlueZ's cache can be found
+	discoveryTime = 5 * time.Second
+)
+
+// connectLock lets only one auto-connect run at a time, the next finds the device it connected
+var connectLock sync.Mutex
+
+// addDeviceRoutes adds routes for managing devices other than the active one
+func addDeviceRoutes(c *core.Core, router *mux.Router) {
+	router.HandleFunc("/bluetooth/devices", ListDevices(c)).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/pair", PairDevice).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/trust", TrustDevice(true)).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/untrust", TrustDevice(false)).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/remove", RemoveDevice(c)).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/connect", ConnectDevice(c)).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/disconnect", DisconnectDevice).Methods("GET")
+	router.HandleFunc("/bluetooth/devices/{address}/activate", ActivateDevice(c)).Methods("GET")
+	router.HandleFunc("/bluetooth/priority", GetPriority(c)).Methods("GET")
+	router.HandleFunc("/bluetooth/priority", SetPriority(c)).Methods("POST")
+}
+
+// Priority returns the addresses of devices to auto-connect to, most preferred first
+func Priority(c *core.Core) []string {
+	var addresses []string
+	for _, address := range c.Settings.GetStringSlice("bluetooth.priority") {
+		if address = formatAddress(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// knownDevices lists every device BlueZ knows about, with its auto-connect priority
+func knownDevices(c *core.Core) []KnownDevice {
+	priority := make(map[string]int)
+	for i, address := range Priority(c) {
+		priority[address] = i
+	}
+
+	active := Address()
+	var known []KnownDevice
+	for _, d := range objects.only(deviceInterface).Devices() {
+		address := formatAddress(d.Address)
+		rank, ok := priority[address]
+		if !ok {
+			rank = -1
+		}
+		known = append(known, KnownDevice{Device: d, Priority: rank, Active: address == active})
+	}
+	return known
+}
+
+// findDevice returns the object path of a known device by its address
+func findDevice(address string) (dbus.ObjectPath, error) {
+	if bus == nil {
+		return "", errUnavailable
+	}
+	address = formatAddress(address)
+	for _, d := range objects.only(deviceInterface).Devices() {
+		if formatAddress(d.Address) == address {
+			return d.Path, nil
+		}
+	}
+	return "", fmt.Errorf("Bluetooth device %s is unknown", address)
+}
+
+// watchPower auto-connects whenever acc_power turns on
+func watchPower(c *core.Core) {
+	updates := make(chan core.Message, powerQueue)
+	c.Subscribe("session.acc_power", updates)
+
+	powered := isOn(c.SessionValue("acc_power"))
+	for m := range updates {
+		isPowered := isOn(m.Content)
+		if isPowered && !powered {
+			log.Info().Msg("Power turned on, auto-connecting bluetooth")
+
+			// Connecting can take a while, keep reading updates so publishers aren't held up
+			go func() {
+				if err := autoConnect(c); err != nil {
+					log.Error().Msgf("Failed to auto-connect bluetooth: %s", err.Error())
+				}
+			}()
+		}
+		powered = isPowered
+	}
+}
+
+// isOn reads a power value, which may be a bool, a number or text like TRUE
+func isOn(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case int:
+		return value != 0
+	case float64:
+		return value != 0
+	case string:
+		on, _ := strconv.ParseBool(value)
+		return on
+	}
+	return false
+}
+
+// autoConnect connects to the first reachable device in priority order, making it the active media source.
+// Without a priority order, the last active device is connected.
+func autoConnect(c *core.Core) error {
+	connectLock.Lock()
+	defer connectLock.Unlock()
+
+	candidates := Priority(c)
+	if active := Address(); len(candidates) == 0 && active != "" {
+		candidates = []string{active}
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("No bluetooth devices to connect to")
+	}
+
+	// A preferred device may have reconnected on its own
+	connected := make(map[string]bool)
+	for _, d := range objects.only(deviceInterface).Devices() {
+		connected[formatAddress(d.Address)] = d.Connected
+	}
+	for _, address := range candidates {
+		if connected[address] {
+			log.Info().Msgf("Bluetooth device %s is already connected", address)
+			activate(c, address, false)
+			return nil
+		}
+	}
+
+	// Scanning only helps find devices missing from BlueZ's cache
+	for _, address := range candidates {
+		if _, err := findDevice(address); err != nil {
+			stopDiscovery := discover(discoveryTime)
+			defer stopDiscovery()
+			break
+		}
+	}
+
+	for _, address := range candidates {
+		device, err := findDevice(address)
+		if err != nil {
+			log.Warn().Msg(err.Error())
+			continue
+		}
+		log.Info().Msgf("Connecting to bluetooth device %s...", address)
+		if err := bus.Connect(device); err != nil {
+			log.Warn().Msgf("Failed to connect to bluetooth device %s: %s", address, err.Error())
+			continue
+		}
+		log.Info().Msg("Connection successful.")
+		activate(c, address, false)
+		return nil
+	}
+	return fmt.Errorf("None of %d bluetooth devices could be connected", len(candidates))
+}
+
+// discover scans for devices for the given time so they can be found, returning a function to stop scanning
+func discover(wait time.Duration) func() {
+	adapter := adapterPath(objects.only(adapterInterface))
+	log.Info().Msg("Turning scan on...")
+	if err := bus.StartDiscovery(adapter); err != nil {
+		log.Warn().Msgf("Failed to start bluetooth discovery: %s", err.Error())
+	}
+	time.Sleep(wait)
+	return func() { bus.StopDiscovery(adapter) }
+}
+
+// activate routes media commands to the device and republishes the media state.
+// Devices the user chose are saved in settings, devices connected automatically aren't.
+func activate(c *core.Core, address string, chosen bool) {
+	if chosen {
+		ChooseAddress(c, address)
+	} else {
+		SetAddress(address)
+	}
+	publishState(c)
+}
+
+// publishDevices publishes the state of every known device under bluetooth.devices.<address>,
+// and if the active one is connected
+func publishDevices(c *core.Core) {
+	active := Address()
+	connected := false
+	for _, d := range objects.only(deviceInterface).Devices() {
+		address := formatAddress(d.Address)
+		if address == "" {
+			continue
+		}
+		key := fmt.Sprintf("bluetooth.devices.%s", address)
+		publish(c, key+".name", d.Alias)
+		publish(c, key+".paired", d.Paired)
+		publish(c, key+".trusted", d.Trusted)
+		publish(c, key+".connected", d.Connected)
+		publish(c, key+".active", address == active)
+		if address == active {
+			connected = d.Connected
+		}
+	}
+	publish(c, "bluetooth.connected", connected)
+}
+
+// ListDevices responds with every device BlueZ knows about
+func ListDevices(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bus == nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: errUnavailable.Error(), OK: false})
+			return
+		}
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: knownDevices(c), OK: true})
+	}
+}
+
+// deviceCommand runs a command against the device named in the route
+func deviceCommand(w http.ResponseWriter, r *http.Request, name string, command func(dbus.ObjectPath) error) {
+	address := mux.Vars(r)["address"]
+	device, err := findDevice(address)
+	if err == nil {
+		log.Info().Msgf("Attempting to %s bluetooth device %s...", name, address)
+		err = command(device)
+	}
+	writeControl(w, r, err)
+}
+
+// PairDevice pairs with a discovered device
+func PairDevice(w http.ResponseWriter, r *http.Request) {
+	deviceCommand(w, r, "pair", func(device dbus.ObjectPath) error { return bus.Pair(device) })
+}
+
+// TrustDevice allows or disallows a device to connect without confirmation
+func TrustDevice(trusted bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceCommand(w, r, "trust", func(device dbus.ObjectPath) error { return bus.SetTrusted(device, trusted) })
+	}
+}
+
+// RemoveDevice unpairs and forgets a device, dropping it from the priority order
+func RemoveDevice(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceCommand(w, r, "remove", func(device dbus.ObjectPath) error {
+			if err := bus.RemoveDevice(adapterPath(objects.only(adapterInterface)), device); err != nil {
+				return err
+			}
+
+			removed := formatAddress(mux.Vars(r)["address"])
+			var remaining []string
+			for _, address := range Priority(c) {
+				if address != removed {
+					remaining = append(remaining, address)
+				}
+			}
+			c.Publish("settings.bluetooth.priority", core.Message{Content: remaining})
+			return nil
+		})
+	}
+}
+
+// ConnectDevice connects a device and makes it the active media source
+func ConnectDevice(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceCommand(w, r, "connect", func(device dbus.ObjectPath) error {
+			if err := bus.Connect(device); err != nil {
+				return err
+			}
+			activate(c, mux.Vars(r)["address"], true)
+			return nil
+		})
+	}
+}
+
+// DisconnectDevice disconnects a device
+func DisconnectDevice(w http.ResponseWriter, r *http.Request) {
+	deviceCommand(w, r, "disconnect", func(device dbus.ObjectPath) error { return bus.Disconnect(device) })
+}
+
+// ActivateDevice makes a connected device the active media source
+func ActivateDevice(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deviceCommand(w, r, "activate", func(device dbus.ObjectPath) error {
+			if connected, _ := objects.property(device, deviceInterface, "Connected").Value().(bool); !connected {
+				return fmt.Errorf("Bluetooth device %s isn't connected", mux.Vars(r)["address"])
+			}
+			activate(c, mux.Vars(r)["address"], true)
+			return nil
+		})
+	}
+}
+
+// GetPriority responds with the auto-connect order
+func GetPriority(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: Priority(c), OK: true})
+	}
+}
+
+// SetPriority replaces the auto-connect order with a JSON list of addresses, most preferred first
+func SetPriority(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var addresses []string
+		if err := json.NewDecoder(r.Body).Decode(&addresses); err != nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+			return
+		}
+		for i := range addresses {
+			addresses[i] = formatAddress(addresses[i])
+		}
+
+		c.Publish("settings.bluetooth.priority", core.Message{Content: addresses})
+		publishState(c)
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: addresses, OK: true})
+	}
+}
@@ -0,0 +1,53 @@
+package bluetooth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/qcasey/MDroid-Core/internal/server/routes/session"
+)
+
+func TestIsOn(t *testing.T) {
+	values := map[interface{}]bool{
+		nil:     false,
+		true:    true,
+		false:   false,
+		1:       true,
+		0:       false,
+		1.0:     true,
+		0.0:     false,
+		"TRUE":  true,
+		"false": false,
+		"1":     true,
+		"on":    false,
+	}
+	for value, expected := range values {
+		if isOn(value) != expected {
+			t.Errorf("Expected %#v to be on: %t", value, expected)
+		}
+	}
+}
+
+func TestPowerAtStartup(t *testing.T) {
+	c := core.New("devices_test")
+	router := mux.NewRouter()
+	router.HandleFunc("/session/{name}", session.Set(c)).Methods("POST")
+
+	if isOn(c.SessionValue("acc_power")) {
+		t.Fatal("Expected power to be off before pyBus reports it")
+	}
+
+	// watchPower starts from the value pyBus last posted, not off
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/session/ACC_POWER", strings.NewReader(`{"value": "TRUE"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Failed to post acc_power: %s", recorder.Body.String())
+	}
+	if !isOn(c.SessionValue("acc_power")) {
+		t.Fatalf("Expected posted power to be on, session has %v", c.SessionValue("acc_power"))
+	}
+}
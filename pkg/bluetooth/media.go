@@ -0,0 +1,183 @@
+package bluetooth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// resubscribeDelay is how long to wait before listening for BlueZ signals again after losing them
+const resubscribeDelay = 5 * time.Second
+
+var (
+	// published holds the last value of each session key, so only changes are published
+	published     = make(map[string]interface{})
+	publishedLock sync.Mutex
+)
+
+// watch keeps the mirror of BlueZ's objects current from its signals, publishing media state as it changes
+func watch(c *core.Core) {
+	for {
+		events, err := bus.Watch()
+		if err != nil {
+			log.Error().Msgf("Failed to subscribe to BlueZ signals: %s", err.Error())
+			time.Sleep(resubscribeDelay)
+			continue
+		}
+
+		// Signals are only changes, start from everything BlueZ knows about
+		if err := refresh(c); err != nil {
+			log.Error().Msgf("Failed to list BlueZ objects: %s", err.Error())
+		}
+
+		for event := range events {
+			objects.apply(event)
+			publishEvent(c, event)
+		}
+
+		log.Warn().Msg("Lost BlueZ signals, resubscribing")
+		time.Sleep(resubscribeDelay)
+	}
+}
+
+// refresh replaces the mirror with a full listing of BlueZ's objects
+func refresh(c *core.Core) error {
+	if bus == nil {
+		return errUnavailable
+	}
+	snapshot, err := bus.ManagedObjects()
+	if err != nil {
+		return err
+	}
+	objects.reset(snapshot)
+	publishState(c)
+	return nil
+}
+
+// publishState publishes the whole media state, i.e. after listing every object
+func publishState(c *core.Core) {
+	selectSource(c)
+	publishDevices(c)
+	publishPlayer(c)
+	publishVolume(c)
+}
+
+// publishEvent publishes only the state an event can change.
+// Players update their position every second while playing, which is published on its own.
+func publishEvent(c *core.Core, event Event) {
+	switch event.Interface {
+	case deviceInterface:
+		selectSource(c)
+		publishDevices(c)
+		publishPlayer(c)
+		publishVolume(c)
+	case transportInterface:
+		publishVolume(c)
+	case playerInterface:
+		if _, ok := event.Properties["Position"]; ok && len(event.Properties) == 1 && !event.Removed {
+			publishPosition(c, event)
+			return
+		}
+		publishPlayer(c)
+	}
+}
+
+// selectSource picks the device media commands are routed to.
+// A device the user chose is kept while it's connected, otherwise the first connected device in priority order is.
+// Without a connected device in the priority order, the active device is left alone.
+func selectSource(c *core.Core) {
+	active, chosen := source()
+	connected := make(map[string]bool)
+	for _, d := range objects.only(deviceInterface).Devices() {
+		connected[formatAddress(d.Address)] = d.Connected
+	}
+
+	selected := ""
+	if !chosen || !connected[active] {
+		for _, address := range Priority(c) {
+			if connected[address] {
+				selected = address
+				break
+			}
+		}
+	}
+	if selected == "" && connected[active] {
+		selected = active
+	}
+
+	if selected != "" && selected != active {
+		log.Info().Msg("Found new connected media device with address: " + selected)
+		SetAddress(selected)
+	}
+	publish(c, "connected_bluetooth_address", selected)
+}
+
+// publishPlayer publishes what the active device is playing
+func publishPlayer(c *core.Core) {
+	device, err := devicePath()
+	if err != nil {
+		return
+	}
+
+	player, _ := playerFor(objects.only(playerInterface), device)
+	publish(c, "bluetooth.status", player.Status)
+	publish(c, "bluetooth.title", player.Track.Title)
+	publish(c, "bluetooth.artist", player.Track.Artist)
+	publish(c, "bluetooth.album", player.Track.Album)
+	publish(c, "bluetooth.position", player.Position)
+	publish(c, "bluetooth.duration", player.Track.Duration)
+	publish(c, "bluetooth.shuffle", player.Shuffle)
+	publish(c, "bluetooth.repeat", player.Repeat)
+
+	// Artwork is published once it's cached, so clients don't fetch the placeholder
+	artwork := ""
+	if key := artworkSlug(player.Track.Artist, player.Track.Album); key != "" && covers != nil {
+		covers.fetch(c, Address(), player)
+		if covers.cached(key) {
+			artwork = key
+		}
+	}
+	publish(c, "bluetooth.artwork", artwork)
+}
+
+// publishPosition publishes a player's new position, if it's the active device's player
+func publishPosition(c *core.Core, event Event) {
+	device, err := devicePath()
+	if err != nil {
+		return
+	}
+	if owner, _ := objects.property(event.Path, playerInterface, "Device").Value().(dbus.ObjectPath); owner != device {
+		return
+	}
+	position, _ := event.Properties["Position"].Value().(uint32)
+	publish(c, "bluetooth.position", position)
+}
+
+// publishVolume publishes the volume of the active device's audio stream, or -1 without one
+func publishVolume(c *core.Core) {
+	volume := -1
+	if device, err := devicePath(); err == nil {
+		for _, transport := range objects.only(transportInterface).Transports() {
+			if transport.Device == device {
+				volume = volumePercent(transport.Volume)
+			}
+		}
+	}
+	publish(c, "bluetooth.volume", volume)
+}
+
+// publish a session value if it changed since it was last published
+func publish(c *core.Core, key string, value interface{}) {
+	publishedLock.Lock()
+	last, ok := published[key]
+	published[key] = value
+	publishedLock.Unlock()
+
+	if ok && last == value {
+		return
+	}
+	c.Publish("session."+key, core.Message{Content: value})
+}
@@ -0,0 +1,80 @@
+package bluetooth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// obexd D-Bus names
+const (
+	obexService        = "org.bluez.obex"
+	obexClientPath     = dbus.ObjectPath("/org/bluez/obex")
+	obexClientIface    = "org.bluez.obex.Client1"
+	obexImageIface     = "org.bluez.obex.Image1"
+	obexTransferIface  = "org.bluez.obex.Transfer1"
+	obexTransferPoll   = 200 * time.Millisecond
+	obexTransferWindow = 30 * time.Second
+)
+
+// CoverArt downloads album artwork from a remote device
+type CoverArt interface {
+	// Fetch saves the image with the given handle to a file, using the player's OBEX PSM
+	Fetch(address string, psm uint16, handle string, file string) error
+}
+
+// ObexClient fetches cover art over AVRCP's Basic Imaging Profile through obexd,
+// which usually lives on the session bus
+type ObexClient struct {
+	conn *dbus.Conn
+}
+
+// NewObexClient creates a cover art client on the given connection, usually dbus.SessionBus()
+func NewObexClient(conn *dbus.Conn) *ObexClient {
+	return &ObexClient{conn: conn}
+}
+
+// Fetch opens a BIP session to the device, downloads the image and waits for the transfer to finish
+func (client *ObexClient) Fetch(address string, psm uint16, handle string, file string) error {
+	var session dbus.ObjectPath
+	err := client.conn.Object(obexService, obexClientPath).
+		Call(obexClientIface+".CreateSession", 0, address, map[string]dbus.Variant{
+			"Target": dbus.MakeVariant("bip-avrcp"),
+			"PSM":    dbus.MakeVariant(psm),
+		}).
+		Store(&session)
+	if err != nil {
+		return err
+	}
+	defer client.conn.Object(obexService, obexClientPath).Call(obexClientIface+".RemoveSession", 0, session)
+
+	var (
+		transfer   dbus.ObjectPath
+		properties map[string]dbus.Variant
+	)
+	err = client.conn.Object(obexService, session).
+		Call(obexImageIface+".Get", 0, file, handle, map[string]dbus.Variant{}).
+		Store(&transfer, &properties)
+	if err != nil {
+		return err
+	}
+
+	// Transfers run in the background, poll until it's done
+	deadline := time.Now().Add(obexTransferWindow)
+	for time.Now().Before(deadline) {
+		status, err := client.conn.Object(obexService, transfer).GetProperty(obexTransferIface + ".Status")
+		if err != nil {
+			// Finished transfers are removed, whether the file made it is checked by the caller
+			return nil
+		}
+		switch status.Value() {
+		case "complete":
+			return nil
+		case "error":
+			return fmt.Errorf("cover art transfer %s failed", transfer)
+		}
+		time.Sleep(obexTransferPoll)
+	}
+	return fmt.Errorf("cover art transfer %s timed out", transfer)
+}
@@ -0,0 +1,200 @@
+package bluetooth
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// oFono D-Bus names
+const (
+	ofonoService          = "org.ofono"
+	ofonoManagerIface     = "org.ofono.Manager"
+	ofonoCallManagerIface = "org.ofono.VoiceCallManager"
+	ofonoCallIface        = "org.ofono.VoiceCall"
+)
+
+// Ofono reads and controls calls on handsets connected over HFP, through oFono
+type Ofono struct {
+	// dial reconnects to the bus once the connection closes, if it's set
+	dial func() (*dbus.Conn, error)
+
+	mutex sync.Mutex
+	conn  *dbus.Conn
+	// signals and stop belong to the last Watch, so they can be removed before watching again
+	signals chan *dbus.Signal
+	stop    chan struct{}
+}
+
+// NewOfono creates an oFono phone backend on the given connection, usually dbus.SystemBus()
+func NewOfono(conn *dbus.Conn) *Ofono {
+	return &Ofono{conn: conn}
+}
+
+// DialOfono creates an oFono phone backend that reconnects with dial whenever its connection closes, i.e. dbus.SystemBus
+func DialOfono(dial func() (*dbus.Conn, error)) (*Ofono, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return &Ofono{conn: conn, dial: dial}, nil
+}
+
+// getConn returns the current connection, which is replaced when it's redialed
+func (o *Ofono) getConn() *dbus.Conn {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.conn
+}
+
+// ofonoObject is a path and its properties, as oFono lists modems and calls
+type ofonoObject struct {
+	Path       dbus.ObjectPath
+	Properties map[string]dbus.Variant
+}
+
+// modems returns the modems that can make voice calls, one per connected handset
+func (o *Ofono) modems() ([]dbus.ObjectPath, error) {
+	var modems []ofonoObject
+	if err := o.getConn().Object(ofonoService, "/").Call(ofonoManagerIface+".GetModems", 0).Store(&modems); err != nil {
+		return nil, err
+	}
+
+	var paths []dbus.ObjectPath
+	for _, modem := range modems {
+		interfaces, _ := modem.Properties["Interfaces"].Value().([]string)
+		for _, iface := range interfaces {
+			if iface == ofonoCallManagerIface {
+				paths = append(paths, modem.Path)
+				break
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Calls returns every call on every handset
+func (o *Ofono) Calls() ([]Call, error) {
+	modems, err := o.modems()
+	if err != nil {
+		return nil, err
+	}
+
+	var calls []Call
+	for _, modem := range modems {
+		var listed []ofonoObject
+		if err := o.getConn().Object(ofonoService, modem).Call(ofonoCallManagerIface+".GetCalls", 0).Store(&listed); err != nil {
+			return nil, err
+		}
+		for _, call := range listed {
+			calls = append(calls, Call{
+				ID:     string(call.Path),
+				State:  propString(call.Properties, "State"),
+				Number: propString(call.Properties, "LineIdentification"),
+				Name:   propString(call.Properties, "Name"),
+			})
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].ID < calls[j].ID })
+	return calls, nil
+}
+
+// Answer an incoming call
+func (o *Ofono) Answer(id string) error {
+	return o.callMethod(id, "Answer")
+}
+
+// Hangup ends a call, or rejects it if it's incoming
+func (o *Ofono) Hangup(id string) error {
+	return o.callMethod(id, "Hangup")
+}
+
+func (o *Ofono) callMethod(id string, method string) error {
+	if !dbus.ObjectPath(id).IsValid() {
+		return fmt.Errorf("invalid call %s", id)
+	}
+	return o.getConn().Object(ofonoService, dbus.ObjectPath(id)).Call(ofonoCallIface+"."+method, 0).Err
+}
+
+// Watch notifies whenever a modem or call is added or removed, or a call changes state.
+// The channel is closed when the connection is, or when Watch is called again.
+// A closed connection is redialed if the backend can, and the last subscription is always removed first.
+func (o *Ofono) Watch() (<-chan struct{}, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.unwatch()
+	if !o.conn.Connected() {
+		if o.dial == nil {
+			return nil, fmt.Errorf("connection to oFono is closed")
+		}
+		conn, err := o.dial()
+		if err != nil {
+			return nil, err
+		}
+		o.conn = conn
+	}
+
+	for i, match := range ofonoMatches {
+		if err := o.conn.AddMatchSignal(match...); err != nil {
+			for _, added := range ofonoMatches[:i] {
+				o.conn.RemoveMatchSignal(added...)
+			}
+			return nil, err
+		}
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	stop := make(chan struct{})
+	o.conn.Signal(signals)
+	o.signals, o.stop = signals, stop
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		for {
+			select {
+			case <-stop:
+				return
+			case signal, ok := <-signals:
+				if !ok {
+					return
+				}
+				switch signal.Name {
+				case ofonoManagerIface + ".ModemAdded", ofonoManagerIface + ".ModemRemoved",
+					ofonoCallManagerIface + ".CallAdded", ofonoCallManagerIface + ".CallRemoved",
+					ofonoCallIface + ".PropertyChanged":
+					notify(changes)
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// ofonoMatches are the match rules of oFono's modem and call signals
+var ofonoMatches = [][]dbus.MatchOption{
+	{dbus.WithMatchSender(ofonoService), dbus.WithMatchInterface(ofonoManagerIface)},
+	{dbus.WithMatchSender(ofonoService), dbus.WithMatchInterface(ofonoCallManagerIface)},
+	{dbus.WithMatchSender(ofonoService), dbus.WithMatchInterface(ofonoCallIface)},
+}
+
+// unwatch removes the last subscription's signal channel and match rules, closing its changes. The caller holds the mutex.
+func (o *Ofono) unwatch() {
+	if o.signals == nil {
+		return
+	}
+	close(o.stop)
+	o.conn.RemoveSignal(o.signals)
+	if o.conn.Connected() {
+		for _, match := range ofonoMatches {
+			if err := o.conn.RemoveMatchSignal(match...); err != nil {
+				log.Warn().Msgf("Failed to remove oFono match rule: %s", err.Error())
+			}
+		}
+	}
+	o.signals, o.stop = nil, nil
+}
@@ -0,0 +1,219 @@
+package bluetooth
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	testModem = dbus.ObjectPath("/hfp/org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF")
+	testCall  = dbus.ObjectPath("/hfp/org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF/voicecall01")
+)
+
+// fakeOfono exports a handset's modem under org.ofono, ringing and answering a single call
+type fakeOfono struct {
+	conn *dbus.Conn
+
+	mutex sync.Mutex
+	calls []ofonoObject
+}
+
+func newFakeOfono(t *testing.T, address string) *fakeOfono {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fake := &fakeOfono{conn: conn}
+	export := func(methods map[string]interface{}, path dbus.ObjectPath, iface string) {
+		if err := conn.ExportMethodTable(methods, path, iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	export(map[string]interface{}{
+		"GetModems": func() ([]ofonoObject, *dbus.Error) {
+			return []ofonoObject{{Path: testModem, Properties: map[string]dbus.Variant{
+				"Interfaces": dbus.MakeVariant([]string{"org.ofono.Handsfree", ofonoCallManagerIface}),
+			}}}, nil
+		},
+	}, "/", ofonoManagerIface)
+	export(map[string]interface{}{
+		"GetCalls": func() ([]ofonoObject, *dbus.Error) {
+			fake.mutex.Lock()
+			defer fake.mutex.Unlock()
+			return append([]ofonoObject{}, fake.calls...), nil
+		},
+	}, testModem, ofonoCallManagerIface)
+	export(map[string]interface{}{
+		"Answer": func() *dbus.Error { return fake.setState("active") },
+	}, testCall, ofonoCallIface)
+
+	reply, err := conn.RequestName(ofonoService, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("Failed to own %s: %v", ofonoService, err)
+	}
+	return fake
+}
+
+// ring adds an incoming call, signalling it like oFono does
+func (fake *fakeOfono) ring(t *testing.T) {
+	props := map[string]dbus.Variant{
+		"State":              dbus.MakeVariant("incoming"),
+		"LineIdentification": dbus.MakeVariant("5551234"),
+		"Name":               dbus.MakeVariant("Alice"),
+	}
+	fake.mutex.Lock()
+	fake.calls = []ofonoObject{{Path: testCall, Properties: props}}
+	fake.mutex.Unlock()
+
+	if err := fake.conn.Emit(testModem, ofonoCallManagerIface+".CallAdded", testCall, props); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (fake *fakeOfono) setState(state string) *dbus.Error {
+	fake.mutex.Lock()
+	fake.calls[0].Properties["State"] = dbus.MakeVariant(state)
+	fake.mutex.Unlock()
+
+	if err := fake.conn.Emit(testCall, ofonoCallIface+".PropertyChanged", "State", dbus.MakeVariant(state)); err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	return nil
+}
+
+// newTestOfono connects an oFono backend to the private bus, redialing it like the system bus
+func newTestOfono(t *testing.T, address string) *Ofono {
+	ofono, err := DialOfono(func() (*dbus.Conn, error) { return dbus.Connect(address) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ofono.getConn().Close() })
+	return ofono
+}
+
+// nextChange waits for a change, failing if none arrives or the channel closes
+func nextChange(t *testing.T, changes <-chan struct{}) {
+	select {
+	case _, ok := <-changes:
+		if !ok {
+			t.Fatal("Changes closed while waiting for one")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a change")
+	}
+}
+
+// expectChangesClosed fails unless the changes channel closes
+func expectChangesClosed(t *testing.T, changes <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Changes of an old subscription weren't closed")
+		}
+	}
+}
+
+func TestOfonoCalls(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeOfono(t, address)
+	ofono := newTestOfono(t, address)
+
+	changes, err := ofono.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.ring(t)
+	nextChange(t, changes)
+	calls, err := ofono.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].ID != string(testCall) || calls[0].State != "incoming" || calls[0].Number != "5551234" || calls[0].Name != "Alice" {
+		t.Fatalf("Unexpected calls %+v", calls)
+	}
+
+	if err := ofono.Answer(string(testCall)); err != nil {
+		t.Fatal(err)
+	}
+	nextChange(t, changes)
+	if calls, _ := ofono.Calls(); len(calls) != 1 || calls[0].State != "active" {
+		t.Fatalf("Expected the call to be answered, got %+v", calls)
+	}
+
+	if err := ofono.Hangup("not a path"); err == nil {
+		t.Fatal("Expected hanging up an invalid call to fail")
+	}
+}
+
+func TestOfonoRewatch(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeOfono(t, address)
+	ofono := newTestOfono(t, address)
+
+	first, err := ofono.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ofono.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChangesClosed(t, first)
+
+	// Only the latest subscription's signal channel is left on the connection
+	fake.ring(t)
+	nextChange(t, second)
+	ofono.mutex.Lock()
+	if ofono.signals == nil || ofono.stop == nil {
+		t.Error("Watch didn't keep its subscription to remove later")
+	}
+	ofono.mutex.Unlock()
+}
+
+func TestOfonoRedial(t *testing.T) {
+	address := startBus(t)
+	fake := newFakeOfono(t, address)
+	ofono := newTestOfono(t, address)
+
+	changes, err := ofono.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing the connection closes the changes, and watching again redials
+	ofono.getConn().Close()
+	expectChangesClosed(t, changes)
+	if _, err := ofono.Calls(); err == nil {
+		t.Fatal("Expected calls on the closed connection to fail")
+	}
+
+	changes, err = ofono.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ofono.getConn().Connected() {
+		t.Fatal("oFono backend didn't redial")
+	}
+	fake.ring(t)
+	nextChange(t, changes)
+	if calls, err := ofono.Calls(); err != nil || len(calls) != 1 {
+		t.Fatalf("Expected the call after redialing, got %+v: %v", calls, err)
+	}
+
+	// Without a way to redial, a closed backend stays closed
+	closed := NewOfono(ofono.getConn())
+	closed.getConn().Close()
+	if _, err := closed.Watch(); err == nil {
+		t.Fatal("Expected watching a closed connection to fail")
+	}
+}
@@ -0,0 +1,278 @@
+package bluetooth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// Call is a phone call on a connected handset.
+// States follow oFono: incoming, waiting, dialing, alerting, active, held or disconnected.
+type Call struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	Number string `json:"number"`
+	Name   string `json:"name"`
+}
+
+// PhoneBackend reads and controls calls. Ofono talks to handsets over HFP, FakePhone stands in without one.
+type PhoneBackend interface {
+	Calls() ([]Call, error)
+	Answer(id string) error
+	Hangup(id string) error
+	// Watch notifies whenever calls change, closing the channel if notifications stop
+	Watch() (<-chan struct{}, error)
+}
+
+var phone PhoneBackend
+
+// callPriority ranks call states, the highest is the call the phone is on as far as the car is concerned
+var callPriority = map[string]int{
+	"incoming": 6,
+	"waiting":  5,
+	"active":   4,
+	"dialing":  3,
+	"alerting": 2,
+	"held":     1,
+}
+
+// newPhoneBackend creates the phone backend named in settings, i.e.
+//
+//	bluetooth:
+//	  phone: ofono # or fake, none
+func newPhoneBackend(c *core.Core, conn *dbus.Conn) PhoneBackend {
+	switch strings.ToLower(c.Settings.GetString("bluetooth.phone")) {
+	case "", "ofono":
+		if conn == nil {
+			return nil
+		}
+		// Like BlueZ, oFono's connection is redialed through dbus.SystemBus if the bus goes away
+		ofono, err := DialOfono(dbus.SystemBus)
+		if err != nil {
+			log.Error().Msgf("Failed to connect to oFono: %s", err.Error())
+			return nil
+		}
+		return ofono
+	case "fake":
+		log.Info().Msg("Using a fake phone for bluetooth calls")
+		return NewFakePhone()
+	}
+	return nil
+}
+
+// setupPhone starts publishing call state and adds phone routes
+func setupPhone(c *core.Core, router *mux.Router, backend PhoneBackend) {
+	phone = backend
+	if phone != nil {
+		go watchCalls(c)
+	}
+
+	router.HandleFunc("/bluetooth/phone", GetCalls).Methods("GET")
+	router.HandleFunc("/bluetooth/phone/answer", AnswerCall).Methods("GET")
+	router.HandleFunc("/bluetooth/phone/hangup", HangupCall).Methods("GET")
+
+	// A fake phone can be rung to try out the car's call handling
+	if fake, ok := phone.(*FakePhone); ok {
+		router.HandleFunc("/bluetooth/phone/ring/{number}", func(w http.ResponseWriter, r *http.Request) {
+			id := fake.Ring(mux.Vars(r)["number"], r.URL.Query().Get("name"))
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: id, OK: true})
+		}).Methods("GET")
+	}
+}
+
+// watchCalls publishes call state whenever the backend reports a change
+func watchCalls(c *core.Core) {
+	for {
+		changes, err := phone.Watch()
+		if err != nil {
+			log.Error().Msgf("Failed to watch phone calls: %s", err.Error())
+			time.Sleep(resubscribeDelay)
+			continue
+		}
+
+		publishCalls(c)
+		for range changes {
+			publishCalls(c)
+		}
+
+		log.Warn().Msg("Lost phone call notifications, resubscribing")
+		time.Sleep(resubscribeDelay)
+	}
+}
+
+// currentCall returns the call that matters most, i.e. an incoming call over a held one
+func currentCall(calls []Call) (Call, bool) {
+	var (
+		current Call
+		found   bool
+	)
+	for _, call := range calls {
+		if callPriority[call.State] > callPriority[current.State] {
+			current = call
+			found = true
+		}
+	}
+	return current, found
+}
+
+// publishCalls publishes the current call under phone.*
+func publishCalls(c *core.Core) {
+	calls, err := phone.Calls()
+	if err != nil {
+		log.Error().Msgf("Failed to list phone calls: %s", err.Error())
+		return
+	}
+
+	call, ok := currentCall(calls)
+	if !ok {
+		call = Call{State: "idle"}
+	}
+	publish(c, "phone.active", ok)
+	publish(c, "phone.state", call.State)
+	publish(c, "phone.number", call.Number)
+	publish(c, "phone.name", call.Name)
+	publish(c, "phone.calls", len(calls))
+}
+
+// GetCalls responds with every call on connected handsets
+func GetCalls(w http.ResponseWriter, r *http.Request) {
+	if phone == nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Phone calls are unavailable", OK: false})
+		return
+	}
+	calls, err := phone.Calls()
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: calls, OK: true})
+}
+
+// callCommand runs a command against the first call in one of the given states
+func callCommand(name string, states []string, command func(id string) error) error {
+	if phone == nil {
+		return fmt.Errorf("Phone calls are unavailable")
+	}
+	calls, err := phone.Calls()
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		for _, call := range calls {
+			if call.State == state {
+				log.Info().Msgf("Attempting to %s call from %s...", name, call.Number)
+				return command(call.ID)
+			}
+		}
+	}
+	return fmt.Errorf("No call to %s", name)
+}
+
+// AnswerCall answers an incoming call, or one waiting behind the active call
+func AnswerCall(w http.ResponseWriter, r *http.Request) {
+	writeControl(w, r, callCommand("answer", []string{"incoming", "waiting"}, func(id string) error { return phone.Answer(id) }))
+}
+
+// HangupCall ends the current call, or rejects an incoming one
+func HangupCall(w http.ResponseWriter, r *http.Request) {
+	writeControl(w, r, callCommand("hang up", []string{"incoming", "active", "dialing", "alerting", "waiting", "held"}, func(id string) error { return phone.Hangup(id) }))
+}
+
+// FakePhone is an in-memory phone backend, used when no handset is available
+type FakePhone struct {
+	mutex   sync.Mutex
+	calls   []Call
+	next    int
+	changes chan struct{}
+}
+
+// NewFakePhone creates a fake phone without any calls
+func NewFakePhone() *FakePhone {
+	return &FakePhone{changes: make(chan struct{}, 1)}
+}
+
+// Ring adds an incoming call, returning its ID. It waits if another call is active.
+func (p *FakePhone) Ring(number string, name string) string {
+	p.mutex.Lock()
+	p.next++
+	id := fmt.Sprintf("/fake/call%02d", p.next)
+	state := "incoming"
+	for _, call := range p.calls {
+		if call.State == "active" {
+			state = "waiting"
+		}
+	}
+	p.calls = append(p.calls, Call{ID: id, State: state, Number: number, Name: name})
+	p.mutex.Unlock()
+	notify(p.changes)
+	return id
+}
+
+// Calls returns every call on the fake phone
+func (p *FakePhone) Calls() ([]Call, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]Call{}, p.calls...), nil
+}
+
+// Answer an incoming call, holding any active one
+func (p *FakePhone) Answer(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	index := p.find(id)
+	if index < 0 || (p.calls[index].State != "incoming" && p.calls[index].State != "waiting") {
+		return fmt.Errorf("no incoming call %s", id)
+	}
+	for i := range p.calls {
+		if p.calls[i].State == "active" {
+			p.calls[i].State = "held"
+		}
+	}
+	p.calls[index].State = "active"
+	notify(p.changes)
+	return nil
+}
+
+// Hangup ends a call
+func (p *FakePhone) Hangup(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	index := p.find(id)
+	if index < 0 {
+		return fmt.Errorf("no call %s", id)
+	}
+	p.calls = append(p.calls[:index], p.calls[index+1:]...)
+	notify(p.changes)
+	return nil
+}
+
+// Watch notifies whenever a call is added, answered or hung up
+func (p *FakePhone) Watch() (<-chan struct{}, error) {
+	return p.changes, nil
+}
+
+func (p *FakePhone) find(id string) int {
+	for i, call := range p.calls {
+		if call.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// notify signals a change without blocking, a pending notification already covers it
+func notify(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
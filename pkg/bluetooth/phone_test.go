@@ -0,0 +1,211 @@
+package bluetooth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+)
+
+// newTestPhone routes a fake phone through a fresh core, publishing its calls like a handset would
+func newTestPhone(t *testing.T) (*core.Core, *mux.Router, *FakePhone) {
+	// Session values are only published when they change, forget the last test's
+	publishedLock.Lock()
+	published = make(map[string]interface{})
+	publishedLock.Unlock()
+
+	c := core.New("phone_test")
+	router := mux.NewRouter()
+	fake := NewFakePhone()
+	setupPhone(c, router, fake)
+	return c, router, fake
+}
+
+// waitForSession polls a session key until it has the value or the timeout passes
+func waitForSession(t *testing.T, c *core.Core, key string, value interface{}) {
+	deadline := time.Now().Add(2 * time.Second)
+	for c.SessionValue(key) != value {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s to be %v, it's %v", key, value, c.SessionValue(key))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// request makes a GET request to the router, returning its decoded response
+func request(t *testing.T, router *mux.Router, url string) core.JSONResponse {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+
+	var response core.JSONResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response to %s: %s", url, err.Error())
+	}
+	return response
+}
+
+// callStates returns the state of each call on the fake phone, in the order they rang
+func callStates(t *testing.T, fake *FakePhone) []string {
+	calls, err := fake.Calls()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, call := range calls {
+		states = append(states, call.State)
+	}
+	return states
+}
+
+func expectStates(t *testing.T, fake *FakePhone, expected ...string) {
+	states := callStates(t, fake)
+	if len(states) != len(expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, states)
+	}
+	for i := range states {
+		if states[i] != expected[i] {
+			t.Fatalf("Expected calls %v, got %v", expected, states)
+		}
+	}
+}
+
+func TestFakePhoneTransitions(t *testing.T) {
+	fake := NewFakePhone()
+
+	first := fake.Ring("5551234", "Alice")
+	expectStates(t, fake, "incoming")
+	if err := fake.Hangup("/fake/missing"); err == nil {
+		t.Fatal("Expected hanging up an unknown call to fail")
+	}
+
+	if err := fake.Answer(first); err != nil {
+		t.Fatal(err)
+	}
+	expectStates(t, fake, "active")
+	if err := fake.Answer(first); err == nil {
+		t.Fatal("Expected answering an active call to fail")
+	}
+
+	// A second call waits behind the active one, answering it holds the first
+	second := fake.Ring("5555678", "Bob")
+	expectStates(t, fake, "active", "waiting")
+	if err := fake.Answer(second); err != nil {
+		t.Fatal(err)
+	}
+	expectStates(t, fake, "held", "active")
+
+	calls, _ := fake.Calls()
+	if call, ok := currentCall(calls); !ok || call.ID != second {
+		t.Fatalf("Expected the active call to be current, got %+v", call)
+	}
+
+	if err := fake.Hangup(second); err != nil {
+		t.Fatal(err)
+	}
+	expectStates(t, fake, "held")
+	if err := fake.Hangup(first); err != nil {
+		t.Fatal(err)
+	}
+	expectStates(t, fake)
+
+	if _, ok := currentCall(nil); ok {
+		t.Fatal("Expected no current call without calls")
+	}
+}
+
+func TestCurrentCallPriority(t *testing.T) {
+	calls := []Call{
+		{ID: "held", State: "held"},
+		{ID: "active", State: "active"},
+		{ID: "incoming", State: "incoming"},
+		{ID: "dialing", State: "dialing"},
+	}
+	if call, ok := currentCall(calls); !ok || call.ID != "incoming" {
+		t.Fatalf("Expected the incoming call to be current, got %+v", call)
+	}
+	if call, ok := currentCall(calls[:2]); !ok || call.ID != "active" {
+		t.Fatalf("Expected the active call to be current, got %+v", call)
+	}
+	if _, ok := currentCall([]Call{{ID: "gone", State: "disconnected"}}); ok {
+		t.Fatal("Disconnected calls shouldn't be current")
+	}
+}
+
+func TestPhoneSession(t *testing.T) {
+	c, _, fake := newTestPhone(t)
+	waitForSession(t, c, "phone.state", "idle")
+	waitForSession(t, c, "phone.active", false)
+	waitForSession(t, c, "phone.calls", 0)
+
+	first := fake.Ring("5551234", "Alice")
+	waitForSession(t, c, "phone.state", "incoming")
+	waitForSession(t, c, "phone.active", true)
+	waitForSession(t, c, "phone.number", "5551234")
+	waitForSession(t, c, "phone.name", "Alice")
+	waitForSession(t, c, "phone.calls", 1)
+
+	fake.Answer(first)
+	waitForSession(t, c, "phone.state", "active")
+
+	// A waiting call matters more than the active one
+	second := fake.Ring("5555678", "Bob")
+	waitForSession(t, c, "phone.state", "waiting")
+	waitForSession(t, c, "phone.number", "5555678")
+	waitForSession(t, c, "phone.calls", 2)
+
+	fake.Hangup(second)
+	waitForSession(t, c, "phone.state", "active")
+	waitForSession(t, c, "phone.number", "5551234")
+	waitForSession(t, c, "phone.calls", 1)
+
+	fake.Hangup(first)
+	waitForSession(t, c, "phone.state", "idle")
+	waitForSession(t, c, "phone.active", false)
+	waitForSession(t, c, "phone.number", "")
+	waitForSession(t, c, "phone.calls", 0)
+}
+
+func TestPhoneRoutes(t *testing.T) {
+	c, router, fake := newTestPhone(t)
+
+	if response := request(t, router, "/bluetooth/phone/answer"); response.OK {
+		t.Fatal("Expected answering without a call to fail")
+	}
+	if response := request(t, router, "/bluetooth/phone/hangup"); response.OK {
+		t.Fatal("Expected hanging up without a call to fail")
+	}
+
+	response := request(t, router, "/bluetooth/phone/ring/5551234?name=Alice")
+	if !response.OK || response.Output == "" {
+		t.Fatalf("Failed to ring the fake phone: %+v", response)
+	}
+	waitForSession(t, c, "phone.state", "incoming")
+	waitForSession(t, c, "phone.name", "Alice")
+
+	if response := request(t, router, "/bluetooth/phone/answer"); !response.OK {
+		t.Fatalf("Failed to answer: %+v", response)
+	}
+	expectStates(t, fake, "active")
+	waitForSession(t, c, "phone.state", "active")
+
+	// Only incoming and waiting calls can be answered
+	if response := request(t, router, "/bluetooth/phone/answer"); response.OK {
+		t.Fatal("Expected answering an active call to fail")
+	}
+
+	if response := request(t, router, "/bluetooth/phone"); !response.OK {
+		t.Fatalf("Failed to list calls: %+v", response)
+	} else if calls, ok := response.Output.([]interface{}); !ok || len(calls) != 1 {
+		t.Fatalf("Expected one call, got %+v", response.Output)
+	}
+
+	if response := request(t, router, "/bluetooth/phone/hangup"); !response.OK {
+		t.Fatalf("Failed to hang up: %+v", response)
+	}
+	expectStates(t, fake)
+	waitForSession(t, c, "phone.state", "idle")
+}
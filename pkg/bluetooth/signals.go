@@ -0,0 +1,227 @@
+package bluetooth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	propertiesInterface    = "org.freedesktop.DBus.Properties"
+	objectManagerInterface = "org.freedesktop.DBus.ObjectManager"
+	bluezPathPrefix        = "/org/bluez"
+)
+
+// Event is a change to one interface of a BlueZ object
+type Event struct {
+	Path      dbus.ObjectPath
+	Interface string
+	// Properties holds changed values, or every value when an interface is added
+	Properties map[string]dbus.Variant
+	// Removed is set when the interface, and its properties, are gone
+	Removed bool
+}
+
+// Watch subscribes to BlueZ's PropertiesChanged, InterfacesAdded and InterfacesRemoved signals.
+// The channel is closed when the connection is, or when Watch is called again.
+// A closed connection is redialed if the client can, and the last subscription is always removed first.
+func (client *Client) Watch() (<-chan Event, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.unwatch()
+	if !client.conn.Connected() {
+		if client.dial == nil {
+			return nil, fmt.Errorf("connection to BlueZ is closed")
+		}
+		conn, err := client.dial()
+		if err != nil {
+			return nil, err
+		}
+		client.conn = conn
+	}
+
+	for i, match := range client.matches() {
+		if err := client.conn.AddMatchSignal(match...); err != nil {
+			for _, added := range client.matches()[:i] {
+				client.conn.RemoveMatchSignal(added...)
+			}
+			return nil, err
+		}
+	}
+
+	signals := make(chan *dbus.Signal, 64)
+	stop := make(chan struct{})
+	client.conn.Signal(signals)
+	client.signals, client.stop = signals, stop
+
+	events := make(chan Event, 64)
+	go func() {
+		defer close(events)
+		for {
+			var signal *dbus.Signal
+			select {
+			case <-stop:
+				return
+			case s, ok := <-signals:
+				if !ok {
+					return
+				}
+				signal = s
+			}
+
+			for _, event := range parseSignal(signal) {
+				// The connection may be shared with other services' signals
+				if !strings.HasPrefix(string(event.Path), bluezPathPrefix) {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// matches are the match rules of BlueZ's object change signals
+func (client *Client) matches() [][]dbus.MatchOption {
+	return [][]dbus.MatchOption{
+		{dbus.WithMatchSender(client.service), dbus.WithMatchInterface(propertiesInterface), dbus.WithMatchMember("PropertiesChanged")},
+		{dbus.WithMatchSender(client.service), dbus.WithMatchInterface(objectManagerInterface), dbus.WithMatchMember("InterfacesAdded")},
+		{dbus.WithMatchSender(client.service), dbus.WithMatchInterface(objectManagerInterface), dbus.WithMatchMember("InterfacesRemoved")},
+	}
+}
+
+// unwatch removes the last subscription's signal channel and match rules, closing its events. The caller holds the mutex.
+func (client *Client) unwatch() {
+	if client.signals == nil {
+		return
+	}
+	close(client.stop)
+	client.conn.RemoveSignal(client.signals)
+	if client.conn.Connected() {
+		for _, match := range client.matches() {
+			if err := client.conn.RemoveMatchSignal(match...); err != nil {
+				log.Warn().Msgf("Failed to remove BlueZ match rule: %s", err.Error())
+			}
+		}
+	}
+	client.signals, client.stop = nil, nil
+}
+
+// parseSignal converts a D-Bus signal into events, ignoring anything that isn't a BlueZ object change
+func parseSignal(signal *dbus.Signal) []Event {
+	switch signal.Name {
+	case propertiesInterface + ".PropertiesChanged":
+		if len(signal.Body) < 2 {
+			return nil
+		}
+		iface, _ := signal.Body[0].(string)
+		changed, _ := signal.Body[1].(map[string]dbus.Variant)
+		return []Event{{Path: signal.Path, Interface: iface, Properties: changed}}
+
+	case objectManagerInterface + ".InterfacesAdded":
+		if len(signal.Body) < 2 {
+			return nil
+		}
+		path, _ := signal.Body[0].(dbus.ObjectPath)
+		interfaces, _ := signal.Body[1].(map[string]map[string]dbus.Variant)
+		var events []Event
+		for iface, props := range interfaces {
+			events = append(events, Event{Path: path, Interface: iface, Properties: props})
+		}
+		return events
+
+	case objectManagerInterface + ".InterfacesRemoved":
+		if len(signal.Body) < 2 {
+			return nil
+		}
+		path, _ := signal.Body[0].(dbus.ObjectPath)
+		interfaces, _ := signal.Body[1].([]string)
+		var events []Event
+		for _, iface := range interfaces {
+			events = append(events, Event{Path: path, Interface: iface, Removed: true})
+		}
+		return events
+	}
+	return nil
+}
+
+// mirror is a local copy of BlueZ's objects, kept current by signals so requests don't query the bus
+type mirror struct {
+	mutex   sync.RWMutex
+	objects Objects
+}
+
+var objects = &mirror{objects: make(Objects)}
+
+// reset replaces the mirror with a full listing of BlueZ's objects
+func (m *mirror) reset(objects Objects) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.objects = objects
+}
+
+// apply merges an event into the mirror
+func (m *mirror) apply(event Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	interfaces, ok := m.objects[event.Path]
+	if event.Removed {
+		if ok {
+			delete(interfaces, event.Interface)
+			if len(interfaces) == 0 {
+				delete(m.objects, event.Path)
+			}
+		}
+		return
+	}
+
+	if !ok {
+		interfaces = make(map[string]map[string]dbus.Variant)
+		m.objects[event.Path] = interfaces
+	}
+	props, ok := interfaces[event.Interface]
+	if !ok {
+		props = make(map[string]dbus.Variant, len(event.Properties))
+		interfaces[event.Interface] = props
+	}
+	for name, value := range event.Properties {
+		props[name] = value
+	}
+}
+
+// only returns a copy of the objects implementing an interface with just that interface's properties,
+// so finding i.e. devices doesn't copy every player's metadata
+func (m *mirror) only(iface string) Objects {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	only := make(Objects)
+	for path, interfaces := range m.objects {
+		props, ok := interfaces[iface]
+		if !ok {
+			continue
+		}
+		copied := make(map[string]dbus.Variant, len(props))
+		for name, value := range props {
+			copied[name] = value
+		}
+		only[path] = map[string]map[string]dbus.Variant{iface: copied}
+	}
+	return only
+}
+
+// property returns a single property of an object, which is empty if it isn't known
+func (m *mirror) property(path dbus.ObjectPath, iface string, name string) dbus.Variant {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.objects[path][iface][name]
+}
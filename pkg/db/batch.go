@@ -0,0 +1,92 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultBatchSize flushes early once this many points are waiting
+	defaultBatchSize = 500
+	// defaultBatchInterval is the longest a point waits before it's written
+	defaultBatchInterval = time.Second
+)
+
+// batcher groups points so sinks see a few large writes instead of one per point
+type batcher struct {
+	size     int
+	interval time.Duration
+	write    func([]Point) error
+
+	mutex   sync.Mutex
+	pending []Point
+	full    chan struct{}
+
+	// flushing keeps batches in order when Flush races the timer
+	flushing sync.Mutex
+}
+
+func newBatcher(size int, interval time.Duration, write func([]Point) error) *batcher {
+	b := &batcher{
+		size:     size,
+		interval: interval,
+		write:    write,
+		full:     make(chan struct{}, 1),
+	}
+	go b.run()
+	return b
+}
+
+// add queues points, waking the batcher if there's a full batch
+func (b *batcher) add(points []Point) {
+	b.mutex.Lock()
+	b.pending = append(b.pending, points...)
+	full := len(b.pending) >= b.size
+	b.mutex.Unlock()
+
+	if full {
+		notify(b.full)
+	}
+}
+
+// run flushes every interval, or sooner when a batch fills up
+func (b *batcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		if err := b.flush(); err != nil {
+			log.Error().Msg(err.Error())
+		}
+	}
+}
+
+// flush writes everything waiting, in batches no larger than the batch size
+func (b *batcher) flush() error {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.mutex.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mutex.Unlock()
+
+	var err error
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > b.size {
+			n = b.size
+		}
+		if writeErr := b.write(pending[:n]); writeErr != nil {
+			err = writeErr
+		}
+		pending = pending[n:]
+	}
+	return err
+}
@@ -0,0 +1,369 @@
+package db
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultBufferDir keeps buffered points across reboots
+	defaultBufferDir = "/home/pi/MDroid/logs/core/buffer"
+	// defaultBufferSize caps each sink's buffer on disk
+	defaultBufferSize = 64 << 20
+	// flushMinDelay is the first wait after the sink can't be reached
+	flushMinDelay = time.Second
+	// flushMaxDelay caps the wait between flush attempts
+	flushMaxDelay = 5 * time.Minute
+	// flushAttempts is how many times a batch is retried while the sink is answering pings,
+	// before it's assumed the sink will never accept it
+	flushAttempts = 5
+)
+
+// DropPolicy decides which points are lost when a buffer is full
+type DropPolicy string
+
+const (
+	// DropOldest deletes the oldest batches to make room for new ones
+	DropOldest DropPolicy = "oldest"
+	// DropNewest discards new batches until there's room again
+	DropNewest DropPolicy = "newest"
+)
+
+// Buffer writes points through to a sink, spooling them to disk while it can't be reached.
+// Spooled batches are flushed in order once the sink answers pings again, and
+// new points queue behind them so they're never written out of order.
+type Buffer struct {
+	sink    Sink
+	core    *core.Core
+	dir     string
+	maxSize int64
+	drop    DropPolicy
+
+	mutex    sync.Mutex
+	segments []segment
+	next     uint64
+	size     int64
+	points   int
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// segment is one batch of points spooled to disk, named <sequence>-<points>.gob
+type segment struct {
+	seq    uint64
+	path   string
+	size   int64
+	points int
+}
+
+func newBuffer(c *core.Core, sink Sink, dir string, maxSize int64, drop DropPolicy) (*Buffer, error) {
+	if drop != DropOldest && drop != DropNewest {
+		return nil, fmt.Errorf("unknown drop policy %s", drop)
+	}
+
+	b := &Buffer{
+		sink:    sink,
+		core:    c,
+		dir:     filepath.Join(dir, sink.Name()),
+		maxSize: maxSize,
+		drop:    drop,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	if b.points > 0 {
+		log.Info().Msgf("Recovered %d buffered points for database sink %s", b.points, sink.Name())
+	}
+	b.report()
+
+	go b.run()
+	return b, nil
+}
+
+// load finds batches left on disk by a previous run
+func (b *Buffer) load() error {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(b.dir, file.Name())
+
+		// Half written batches from a crash
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+
+		var seq uint64
+		var points int
+		if _, err := fmt.Sscanf(file.Name(), "%d-%d.gob", &seq, &points); err != nil {
+			continue
+		}
+		b.segments = append(b.segments, segment{seq: seq, path: path, size: file.Size(), points: points})
+		b.size += file.Size()
+		b.points += points
+		if seq >= b.next {
+			b.next = seq + 1
+		}
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i].seq < b.segments[j].seq })
+	return nil
+}
+
+// Name of the buffered sink
+func (b *Buffer) Name() string {
+	return b.sink.Name()
+}
+
+// Ping the buffered sink
+func (b *Buffer) Ping() error {
+	return b.sink.Ping()
+}
+
+// Write points straight to the sink if nothing is queued, otherwise spool them to disk
+func (b *Buffer) Write(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	// The sink may take until its timeout to fail, Backlog and the flusher mustn't wait on it
+	b.mutex.Lock()
+	queued := len(b.segments) > 0
+	b.mutex.Unlock()
+	if !queued {
+		err := b.sink.Write(points)
+		if err == nil {
+			return nil
+		}
+		log.Debug().Msgf("Buffering %d points for database sink %s: %s", len(points), b.sink.Name(), err.Error())
+	}
+
+	// Other writes may have been spooled meanwhile, these points queue behind them
+	b.mutex.Lock()
+	err := b.spool(points)
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	b.report()
+	notify(b.wake)
+	return nil
+}
+
+// Close stops flushing, anything still queued stays on disk for next time
+func (b *Buffer) Close() error {
+	close(b.done)
+	return b.sink.Close()
+}
+
+// Backlog returns how many points are waiting to be flushed, and their size on disk
+func (b *Buffer) Backlog() (int, int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.points, b.size
+}
+
+// spool writes a batch to disk, making room for it according to the drop policy
+func (b *Buffer) spool(points []Point) error {
+	seq := b.next
+	path := filepath.Join(b.dir, fmt.Sprintf("%020d-%d.gob", seq, len(points)))
+	size, err := writeSegment(path, points)
+	if err != nil {
+		return err
+	}
+
+	if size > b.maxSize {
+		os.Remove(path)
+		return fmt.Errorf("batch of %d points is larger than the %d byte buffer", len(points), b.maxSize)
+	}
+
+	for b.size+size > b.maxSize {
+		if b.drop == DropNewest {
+			os.Remove(path)
+			log.Warn().Msgf("Buffer for database sink %s is full, dropping %d new points", b.sink.Name(), len(points))
+			return nil
+		}
+		oldest := b.segments[0]
+		b.remove(oldest)
+		log.Warn().Msgf("Buffer for database sink %s is full, dropping %d old points", b.sink.Name(), oldest.points)
+	}
+
+	b.next++
+	b.segments = append(b.segments, segment{seq: seq, path: path, size: size, points: len(points)})
+	b.size += size
+	b.points += len(points)
+	return nil
+}
+
+// remove deletes a batch from disk and the queue, the mutex must be held
+func (b *Buffer) remove(s segment) {
+	for i := range b.segments {
+		if b.segments[i].seq == s.seq {
+			b.segments = append(b.segments[:i], b.segments[i+1:]...)
+			b.size -= s.size
+			b.points -= s.points
+			break
+		}
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		log.Error().Msgf("Failed to remove buffered batch %s: %s", s.path, err.Error())
+	}
+}
+
+// oldest returns the next batch to flush
+func (b *Buffer) oldest() (segment, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.segments) == 0 {
+		return segment{}, false
+	}
+	return b.segments[0], true
+}
+
+// run flushes queued batches whenever the sink can be reached
+func (b *Buffer) run() {
+	delay := flushMinDelay
+	attempts := 0
+
+	for {
+		s, ok := b.oldest()
+		if !ok {
+			select {
+			case <-b.wake:
+				continue
+			case <-b.done:
+				return
+			}
+		}
+
+		err := b.sink.Ping()
+		if err == nil {
+			err = b.flush(s)
+			if err != nil {
+				attempts++
+			}
+		}
+
+		if err == nil {
+			delay = flushMinDelay
+			attempts = 0
+			continue
+		}
+
+		if attempts >= flushAttempts {
+			log.Error().Msgf("Database sink %s keeps refusing %d buffered points, dropping them: %s", b.sink.Name(), s.points, err.Error())
+			b.mutex.Lock()
+			b.remove(s)
+			b.mutex.Unlock()
+			b.report()
+			attempts = 0
+			continue
+		}
+
+		log.Debug().Msgf("Database sink %s is unavailable, retrying in %s: %s", b.sink.Name(), delay.String(), err.Error())
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return
+		}
+		if delay *= 2; delay > flushMaxDelay {
+			delay = flushMaxDelay
+		}
+	}
+}
+
+// flush writes one batch to the sink and removes it from the queue
+func (b *Buffer) flush(s segment) error {
+	points, err := readSegment(s.path)
+	if err != nil {
+		log.Error().Msgf("Dropping unreadable buffered batch %s: %s", s.path, err.Error())
+	} else if err := b.sink.Write(points); err != nil {
+		return err
+	} else {
+		log.Debug().Msgf("Flushed %d buffered points to database sink %s", len(points), b.sink.Name())
+	}
+
+	b.mutex.Lock()
+	b.remove(s)
+	b.mutex.Unlock()
+	b.report()
+	return nil
+}
+
+// report publishes the backlog to the session
+func (b *Buffer) report() {
+	points, size := b.Backlog()
+	if b.core == nil {
+		return
+	}
+	b.core.Publish(fmt.Sprintf("session.db.%s.backlog", b.sink.Name()), core.Message{Content: points})
+	b.core.Publish(fmt.Sprintf("session.db.%s.backlog_bytes", b.sink.Name()), core.Message{Content: size})
+}
+
+// writeSegment encodes points to a file, renaming it into place once it's safely on disk
+func writeSegment(path string, points []Point) (int64, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	err = gob.NewEncoder(file).Encode(points)
+	if err == nil {
+		err = file.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func readSegment(path string) ([]Point, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var points []Point
+	err = gob.NewDecoder(file).Decode(&points)
+	return points, err
+}
+
+// notify wakes a waiting goroutine without blocking if it's already been woken
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
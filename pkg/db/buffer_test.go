@@ -0,0 +1,202 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the points written to it, failing while it's down
+type fakeSink struct {
+	mutex   sync.Mutex
+	down    bool
+	written []string
+	// block holds writes until it's closed, if it's set, after they're announced on writing
+	block   chan struct{}
+	writing chan struct{}
+}
+
+func (sink *fakeSink) Name() string { return "fake" }
+
+func (sink *fakeSink) Write(points []Point) error {
+	if sink.block != nil {
+		sink.writing <- struct{}{}
+		<-sink.block
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.down {
+		return fmt.Errorf("fake sink is down")
+	}
+	for _, p := range points {
+		sink.written = append(sink.written, p.Fields["v"].(string))
+	}
+	return nil
+}
+
+func (sink *fakeSink) Ping() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.down {
+		return fmt.Errorf("fake sink is down")
+	}
+	return nil
+}
+
+func (sink *fakeSink) Close() error { return nil }
+
+func (sink *fakeSink) setDown(down bool) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.down = down
+}
+
+func (sink *fakeSink) values() []string {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return append([]string{}, sink.written...)
+}
+
+// testBatch is a single point batch, every batch spools to the same size
+func testBatch(value string) []Point {
+	return []Point{{Measurement: "m", Fields: map[string]interface{}{"v": value}, Time: time.Unix(1600000000, 0)}}
+}
+
+// spooled reads back the value of each batch waiting in the buffer, oldest first
+func spooled(t *testing.T, b *Buffer) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var values []string
+	for _, s := range b.segments {
+		points, err := readSegment(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, points[0].Fields["v"].(string))
+	}
+	return values
+}
+
+func expectValues(t *testing.T, what string, got []string, expected ...string) {
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %s %v, got %v", what, expected, got)
+	}
+}
+
+func TestBufferReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	sink := &fakeSink{down: true}
+	b, err := newBuffer(nil, sink, dir, defaultBufferSize, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"a", "b", "c"} {
+		if err := b.Write(testBatch(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if points, size := b.Backlog(); points != 3 || size == 0 {
+		t.Fatalf("Expected 3 points to be spooled, backlog is %d points in %d bytes", points, size)
+	}
+	b.Close()
+
+	// A half written batch from a crash is cleaned up rather than replayed
+	if _, err := writeSegment(filepath.Join(dir, "fake", "00000000000000000009-1.gob.tmp"), testBatch("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.setDown(false)
+	b, err = newBuffer(nil, sink, dir, defaultBufferSize, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// New points queue behind the recovered ones
+	if err := b.Write(testBatch("d")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for points, _ := b.Backlog(); points > 0; points, _ = b.Backlog() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out flushing the buffer, %d points left", points)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectValues(t, "writes", sink.values(), "a", "b", "c", "d")
+}
+
+func TestBufferDropPolicies(t *testing.T) {
+	size, err := writeSegment(filepath.Join(t.TempDir(), "size.gob"), testBatch("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := map[DropPolicy][]string{
+		DropOldest: {"b", "c"},
+		DropNewest: {"a", "b"},
+	}
+	for drop, expected := range kept {
+		sink := &fakeSink{down: true}
+		b, err := newBuffer(nil, sink, t.TempDir(), 2*size, drop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{"a", "b", "c"} {
+			if err := b.Write(testBatch(value)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectValues(t, fmt.Sprintf("%s policy to keep", drop), spooled(t, b), expected...)
+		if points, bytes := b.Backlog(); points != 2 || bytes != 2*size {
+			t.Fatalf("Unexpected backlog of %d points in %d bytes with the %s policy", points, bytes, drop)
+		}
+		b.Close()
+	}
+
+	if _, err := newBuffer(nil, &fakeSink{}, t.TempDir(), size, "random"); err == nil {
+		t.Fatal("Expected an unknown drop policy to be rejected")
+	}
+	tiny, err := newBuffer(nil, &fakeSink{down: true}, t.TempDir(), size-1, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tiny.Close()
+	if err := tiny.Write(testBatch("a")); err == nil {
+		t.Fatal("Expected a batch larger than the buffer to be rejected")
+	}
+}
+
+func TestBufferWriteDoesNotHoldLock(t *testing.T) {
+	sink := &fakeSink{block: make(chan struct{}), writing: make(chan struct{})}
+	b, err := newBuffer(nil, sink, t.TempDir(), defaultBufferSize, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	written := make(chan error, 1)
+	go func() { written <- b.Write(testBatch("a")) }()
+	<-sink.writing
+
+	// The sink hangs, but the backlog can still be read
+	backlog := make(chan struct{})
+	go func() {
+		b.Backlog()
+		close(backlog)
+	}()
+	select {
+	case <-backlog:
+	case <-time.After(time.Second):
+		t.Fatal("Backlog waited on a hanging sink write")
+	}
+
+	close(sink.block)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	expectValues(t, "writes", sink.values(), "a")
+}
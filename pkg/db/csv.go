@@ -0,0 +1,175 @@
+package db
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CSV appends points to a file, one row per field:
+//
+//	time,measurement,tags,field,value
+//	2020-05-01T18:04:05.123456789-04:00,requests,method=GET;path=/session,ok,1
+type CSV struct {
+	name     string
+	Filename string
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+var csvHeader = []string{"time", "measurement", "tags", "field", "value"}
+
+func newCSV(name string, filename string) (*CSV, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("CSV sinks need a path")
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sink := &CSV{name: name, Filename: filename, file: file, writer: csv.NewWriter(file)}
+
+	// New files start with a header
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		sink.writer.Write(csvHeader)
+		sink.writer.Flush()
+	}
+	return sink, nil
+}
+
+// Name of the sink
+func (sink *CSV) Name() string {
+	return sink.name
+}
+
+// Ping checks the file is open
+func (sink *CSV) Ping() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.file == nil {
+		return fmt.Errorf("CSV file %s is closed", sink.Filename)
+	}
+	return nil
+}
+
+// Write points to the file, fields in alphabetical order
+func (sink *CSV) Write(points []Point) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.file == nil {
+		return fmt.Errorf("CSV file %s is closed", sink.Filename)
+	}
+
+	for _, p := range points {
+		tags := make([]string, 0, len(p.Tags))
+		for key, value := range p.Tags {
+			tags = append(tags, key+"="+value)
+		}
+		sort.Strings(tags)
+
+		fields := make([]string, 0, len(p.Fields))
+		for key := range p.Fields {
+			fields = append(fields, key)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			row := []string{p.Time.Format(time.RFC3339Nano), p.Measurement, strings.Join(tags, ";"), field, fmt.Sprintf("%v", p.Fields[field])}
+			if err := sink.writer.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	sink.writer.Flush()
+	return sink.writer.Error()
+}
+
+// Query returns every point of a measurement from (inclusive) to (exclusive) by scanning the file.
+// Values are read back as the type their text looks like, i.e. a string of digits becomes an integer.
+func (sink *CSV) Query(measurement string, from time.Time, to time.Time) ([]Point, error) {
+	// Hold writes so the last row isn't read half written
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.writer != nil {
+		sink.writer.Flush()
+	}
+
+	file, err := os.Open(sink.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = len(csvHeader)
+	var points []Point
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row[1] != measurement {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, row[0])
+		if err != nil {
+			return nil, err
+		}
+		if timestamp.Before(from) || !timestamp.Before(to) {
+			continue
+		}
+
+		p := Point{Measurement: measurement, Tags: make(map[string]string), Fields: map[string]interface{}{row[3]: csvValue(row[4])}, Time: timestamp}
+		if row[2] != "" {
+			for _, tag := range strings.Split(row[2], ";") {
+				pair := strings.SplitN(tag, "=", 2)
+				if len(pair) != 2 {
+					return nil, fmt.Errorf("invalid tag %s in CSV file %s", tag, sink.Filename)
+				}
+				p.Tags[pair[0]] = pair[1]
+			}
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// csvValue reads a value written with %v back into an integer, float, bool or string
+func csvValue(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+// Close the file
+func (sink *CSV) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	sink.writer.Flush()
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
@@ -1,158 +1,209 @@
 package db
 
 import (
-	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/qcasey/MDroid-Core/internal/core/settings"
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
 	"github.com/rs/zerolog/log"
 )
 
-type databaseType int
-
-const (
-	// InfluxDB is a wrapper for InfluxDB functions
-	InfluxDB databaseType = 0
-	// SQLite is a wrapper for SQLite functions
-	SQLite databaseType = 1
-)
-
-// Database for writing/posting/querying db
+// Database fans points out to every configured sink
 type Database struct {
-	Host         string
-	DatabaseName string
-	Type         databaseType
-	Started      bool
-
-	mutex     sync.RWMutex
-	sqlconn   *sql.DB
-	sqlinsert *sql.Stmt
+	core  *core.Core
+	mutex sync.RWMutex
+	sinks []Sink
+	batch *batcher
 }
 
 // DB currently being used
 var DB *Database
 
-// Setup parses this module's implementation
-func Setup() {
-	if !settings.Data.IsSet("mdroid.DATABASE_HOST") || !settings.Data.IsSet("mdroid.DATABASE_NAME") {
-		DB = nil
-		log.Warn().Msg("Databases are disabled")
-		return
+// Setup parses this module's sinks from settings and adds its routes, i.e.
+//
+//	db:
+//	  sinks:
+//	    influx:
+//	      type: influx # or influx2, sqlite, csv
+//	      host: http://localhost:8086
+//	      database: mdroid
+//	      precision: ms # ns (default), us, ms or s
+//	      buffer: true # spool points to disk while offline, the default for influx sinks
+//	    cloud:
+//	      type: influx2
+//	      host: https://influx.example.com
+//	      org: mdroid
+//	      bucket: vehicle
+//	      token: secret
+//	    local:
+//	      type: sqlite
+//	      path: /home/pi/MDroid/logs/core/dbs/mdroid.db # or a directory, files are named after the sink
+//	      daily: true # start a new file every day, mdroid-2020-05-01.db
+//	      max_size: 256MB # start mdroid-2020-05-01.1.db once a file is this big
+//	    trip:
+//	      type: csv
+//	      path: /tmp/trip.csv
+//	  buffer:
+//	    dir: /home/pi/MDroid/logs/core/buffer
+//	    max_size: 64MB # per sink
+//	    drop: oldest # or newest, when the buffer is full
+//	  batch:
+//	    size: 500 # flush early once this many points are waiting
+//	    interval: 1s # 0 writes every point straight through
+//	  recorder: # see setupRecorder
+//	  retention: # see setupRetention
+//
+// The legacy mdroid.DATABASE_HOST and mdroid.DATABASE_NAME are used if no sinks are defined.
+func Setup(c *core.Core, router *mux.Router) {
+	addRoutes(router)
+	DB = &Database{core: c}
+
+	var names []string
+	for name := range c.Settings.GetStringMap("db.sinks") {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	databaseHost := settings.Data.GetString("mdroid.DATABASE_HOST")
-	databaseName := settings.Data.GetString("mdroid.DATABASE_NAME")
+	for _, name := range names {
+		sink, err := newSink(c, name)
+		if err != nil {
+			log.Error().Msgf("Database sink %s: %s, skipping it", name, err.Error())
+			continue
+		}
+		DB.Add(sink)
+	}
 
-	// Request to use SQLITE
-	if databaseHost == "SQLITE" {
-		DB = &Database{Host: databaseHost, DatabaseName: databaseName, Type: SQLite}
-		dbname, err := DB.SQLiteInit()
+	if len(names) == 0 && c.Settings.IsSet("mdroid.DATABASE_HOST") && c.Settings.IsSet("mdroid.DATABASE_NAME") {
+		databaseHost := c.Settings.GetString("mdroid.DATABASE_HOST")
+		databaseName := c.Settings.GetString("mdroid.DATABASE_NAME")
+
+		var (
+			sink Sink
+			err  error
+		)
+		if databaseHost == "SQLITE" {
+			sink, err = newSQLite("sqlite", "", true, 0)
+		} else {
+			sink, err = newInfluxV1("influx", databaseHost, databaseName, Nanosecond, true)
+			if err == nil {
+				sink, err = bufferSink(c, sink)
+			}
+		}
 		if err != nil {
-			panic(err)
+			log.Error().Msgf("Failed to set up database %s: %s", databaseHost, err.Error())
+		} else {
+			DB.Add(sink)
 		}
-		log.Info().Msgf("Using SQLite DB at %s", dbname)
+	}
+
+	if len(DB.Sinks()) == 0 {
+		DB = nil
+		log.Warn().Msg("Databases are disabled")
 		return
 	}
 
-	// Setup InfluxDB as normal
-	DB = &Database{Host: databaseHost, DatabaseName: databaseName, Type: InfluxDB}
-	log.Info().Msgf("Using InfluxDB at %s with DB name %s.", databaseHost, databaseName)
+	batchSize := defaultBatchSize
+	if c.Settings.IsSet("db.batch.size") {
+		batchSize = c.Settings.GetInt("db.batch.size")
+	}
+	batchInterval := defaultBatchInterval
+	if c.Settings.IsSet("db.batch.interval") {
+		batchInterval = c.Settings.GetDuration("db.batch.interval")
+	}
+	if batchSize > 1 && batchInterval > 0 {
+		DB.batch = newBatcher(batchSize, batchInterval, DB.write)
+		log.Info().Msgf("Batching up to %d points every %s", batchSize, batchInterval.String())
+	}
+
+	setupRecorder(c, DB)
+	setupRetention(c, DB)
 }
 
-// Helper function to parse interfaces as a DB string
-func parseWriterData(stmt *strings.Builder, data *map[string]interface{}) error {
-	counter := 0
-	for key, value := range *data {
-		if counter > 0 {
-			stmt.WriteString(",")
-		}
-		counter++
-
-		// Parse based on data type
-		switch vv := value.(type) {
-		case bool:
-			stmt.WriteString(fmt.Sprintf("%s=%v", key, vv))
-		case string:
-			stmt.WriteString(fmt.Sprintf("%s=\"%v\"", key, vv))
-		case int:
-			stmt.WriteString(fmt.Sprintf("%s=%d", key, int(vv)))
-		case int64:
-			stmt.WriteString(fmt.Sprintf("%s=%d", key, int(vv)))
-		case float32:
-			stmt.WriteString(fmt.Sprintf("%s=%f", key, float64(vv)))
-		case float64:
-			stmt.WriteString(fmt.Sprintf("%s=%f", key, float64(vv)))
-		default:
-			return fmt.Errorf("Cannot process type of %v", vv)
-		}
-	}
-	return nil
+// Add a sink to write points to
+func (database *Database) Add(sink Sink) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	database.sinks = append(database.sinks, sink)
+	log.Info().Msgf("Writing points to database sink %s", sink.Name())
+}
+
+// Sinks returns every sink points are written to
+func (database *Database) Sinks() []Sink {
+	database.mutex.RLock()
+	defer database.mutex.RUnlock()
+	return append([]Sink{}, database.sinks...)
 }
 
-// Insert will prepare a new write statement and pass it along
+// Insert will prepare a new point and write it to every sink
 func (database *Database) Insert(measurement string, tags map[string]interface{}, fields map[string]interface{}) error {
 	if database == nil {
 		return fmt.Errorf("Database is nil")
 	}
+	return database.Write(NewPoint(measurement, tags, fields))
+}
 
-	// Prepare new insert statement
-	var stmt strings.Builder
-	stmt.WriteString(measurement)
-
-	// Write tags first
-	var tagstring strings.Builder
-	if err := parseWriterData(&tagstring, &tags); err != nil {
-		return err
+// Write points to every sink, queueing them for the next batch if batching is enabled
+func (database *Database) Write(points ...Point) error {
+	if database == nil {
+		return fmt.Errorf("Database is nil")
 	}
-
-	// Check if any tags were added. If not, remove the trailing comma
-	if tagstring.String() != "" {
-		stmt.WriteRune(',')
+	if database.batch != nil {
+		database.batch.add(points)
+		return nil
 	}
+	return database.write(points)
+}
 
-	// Space between tags and fields
-	stmt.WriteString(tagstring.String())
-	stmt.WriteRune(' ')
-
-	// Write fields next
-	if err := parseWriterData(&stmt, &fields); err != nil {
-		return err
+// Flush writes any queued points now
+func (database *Database) Flush() error {
+	if database == nil {
+		return fmt.Errorf("Database is nil")
 	}
+	if database.batch == nil {
+		return nil
+	}
+	return database.batch.flush()
+}
 
-	writeString := stmt.String()
-
-	// Pass string we've built to write function
-	if err := database.Write(writeString); err != nil {
-		return fmt.Errorf("Error writing %s to database:\n%s", writeString, err.Error())
+// write points to every sink, a failing sink doesn't stop the others from being written to
+func (database *Database) write(points []Point) error {
+	var failed []string
+	for _, sink := range database.Sinks() {
+		start := time.Now()
+		err := sink.Write(points)
+		database.publishMetrics(sink, len(points), time.Since(start))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", sink.Name(), err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error writing %d points to database:\n%s", len(points), strings.Join(failed, "\n"))
 	}
 
 	// Debug log and return
-	log.Debug().Msgf("Logged %s to database", stmt.String())
+	log.Debug().Msgf("Logged %d points to database", len(points))
 	return nil
 }
 
-// Transition wrappers for old influx or SQLite DBs
-
-// Ping influx database server for connectivity
-func (database *Database) Ping() (bool, error) {
-	switch database.Type {
-	case InfluxDB:
-		return database.InfluxPing()
-	case SQLite:
-		return database.SQLitePing()
+// publishMetrics reports the size of the last batch written to a sink, and how many milliseconds it took
+func (database *Database) publishMetrics(sink Sink, points int, latency time.Duration) {
+	if database.core == nil {
+		return
 	}
-	return false, nil
+	database.core.Publish(fmt.Sprintf("session.db.%s.batch_size", sink.Name()), core.Message{Content: points})
+	database.core.Publish(fmt.Sprintf("session.db.%s.flush_latency", sink.Name()), core.Message{Content: float64(latency) / float64(time.Millisecond)})
 }
 
-// Write to influx database server with data pairs
-func (database *Database) Write(msg string) error {
-	switch database.Type {
-	case InfluxDB:
-		return database.InfluxWrite(msg)
-	case SQLite:
-		return database.SQLiteWrite(msg)
+// Ping every sink for connectivity, returning the first error
+func (database *Database) Ping() error {
+	for _, sink := range database.Sinks() {
+		if err := sink.Ping(); err != nil {
+			return fmt.Errorf("%s: %s", sink.Name(), err.Error())
+		}
 	}
 	return nil
 }
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+)
+
+// defaultHistory is how far back history goes if a request doesn't say
+const defaultHistory = time.Hour
+
+// History of a measurement, as returned by /history
+type History struct {
+	Measurement string
+	From        time.Time
+	To          time.Time
+	Resolution  string    `json:",omitempty"`
+	Aggregate   Aggregate `json:",omitempty"`
+	Every       string    `json:",omitempty"`
+	Series      []Series
+}
+
+// addRoutes adds routes for reading points back out of the database and looking after local files
+func addRoutes(router *mux.Router) {
+	router.HandleFunc("/history/{measurement}", GetHistory).Methods("GET")
+	router.HandleFunc("/retention", GetRetention).Methods("GET")
+	router.HandleFunc("/retention/run", RunRetention).Methods("GET")
+}
+
+// GetHistory responds with a measurement's series, i.e.
+//
+//	/history/rpm?from=-30m&to=now&agg=mean&every=1m&sink=local
+//
+// from and to are RFC 3339 times, Unix seconds, durations before now or now.
+// They default to the last hour. Without agg every value is returned.
+// A resolution of 1m or 1h reads a sink's rollups instead of its raw points.
+// Influx, SQLite and CSV sinks can be queried, only SQLite sinks keep rollups.
+func GetHistory(w http.ResponseWriter, r *http.Request) {
+	if DB == nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Databases are disabled", OK: false})
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	from, err := parseTime(query.Get("from"), now.Add(-defaultHistory), now)
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	to, err := parseTime(query.Get("to"), now, now)
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	if !from.Before(to) {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "from must be before to", OK: false})
+		return
+	}
+
+	agg, err := parseAggregate(query.Get("agg"))
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	var every time.Duration
+	if query.Get("every") != "" {
+		every, err = time.ParseDuration(query.Get("every"))
+		if err != nil || every <= 0 {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("Invalid window %s", query.Get("every")), OK: false})
+			return
+		}
+		if agg == AggregateNone {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "every needs an aggregate", OK: false})
+			return
+		}
+	}
+
+	var resolution time.Duration
+	switch query.Get("resolution") {
+	case "", "raw":
+	case "1m":
+		resolution = MinuteResolution
+	case "1h":
+		resolution = HourResolution
+	default:
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("Invalid resolution %s", query.Get("resolution")), OK: false})
+		return
+	}
+
+	measurement := mux.Vars(r)["measurement"]
+	series, err := DB.History(query.Get("sink"), measurement, from, to, resolution, agg, every)
+	if err != nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+		return
+	}
+	if series == nil {
+		series = []Series{}
+	}
+
+	history := History{Measurement: measurement, From: from, To: to, Aggregate: agg, Series: series}
+	if resolution > 0 {
+		history.Resolution = query.Get("resolution")
+	}
+	if every > 0 {
+		history.Every = every.String()
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: history, OK: true})
+}
+
+// parseTime reads a time from a request, falling back if it isn't given
+func parseTime(value string, fallback time.Time, now time.Time) (time.Time, error) {
+	switch {
+	case value == "":
+		return fallback, nil
+	case value == "now":
+		return now, nil
+	case strings.HasPrefix(value, "-"):
+		if d, err := time.ParseDuration(value); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %s", value)
+	}
+	return t, nil
+}
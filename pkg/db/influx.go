@@ -2,83 +2,431 @@
 package db
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-
-	"github.com/parnurzeal/gorequest"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// InfluxPing database server for connectivity
-func (database *Database) InfluxPing() (bool, error) {
-	// Ping database instance
-	request := gorequest.New()
-	resp, _, errs := request.Get(database.Host + "/ping").End()
-	if errs != nil {
-		return false, errs[0]
+// influxTimeout keeps a write over a slow link from holding up the batcher forever
+const influxTimeout = 10 * time.Second
+
+// influxClient is shared by every Influx sink so connections are reused between batches
+var influxClient = &http.Client{Timeout: influxTimeout}
+
+// InfluxV1 writes points to an InfluxDB 1.x database
+type InfluxV1 struct {
+	name      string
+	Host      string
+	Database  string
+	Precision Precision
+	Gzip      bool
+}
+
+// InfluxV2 writes points to an InfluxDB 2.x bucket
+type InfluxV2 struct {
+	name      string
+	Host      string
+	Org       string
+	Bucket    string
+	Token     string
+	Precision Precision
+	Gzip      bool
+}
+
+func newInfluxV1(name string, host string, database string, precision Precision, compress bool) (*InfluxV1, error) {
+	if host == "" || database == "" {
+		return nil, fmt.Errorf("InfluxDB sinks need a host and database")
 	}
-	return resp.StatusCode == 204, nil
+	return &InfluxV1{name: name, Host: host, Database: database, Precision: precision, Gzip: compress}, nil
+}
+
+func newInfluxV2(name string, host string, org string, bucket string, token string, precision Precision, compress bool) (*InfluxV2, error) {
+	if host == "" || org == "" || bucket == "" {
+		return nil, fmt.Errorf("InfluxDB 2 sinks need a host, org and bucket")
+	}
+	return &InfluxV2{name: name, Host: host, Org: org, Bucket: bucket, Token: token, Precision: precision, Gzip: compress}, nil
+}
+
+// Name of the sink
+func (influx *InfluxV1) Name() string {
+	return influx.name
+}
+
+// Ping database server for connectivity
+func (influx *InfluxV1) Ping() error {
+	return influxPing(influx.Host, "")
 }
 
-// InfluxWrite to influx database server with data pairs
-func (database *Database) InfluxWrite(msg string) error {
-	// Check for positive ping response first.
-	if !database.Started {
-		if isOnline, err := database.InfluxPing(); !isOnline {
-			if err != nil {
-				return err
+// Write points to the database as line protocol
+func (influx *InfluxV1) Write(points []Point) error {
+	msg, err := encodeLines(points, influx.Precision)
+	if err != nil {
+		return err
+	}
+
+	// 1.x spells microseconds as u
+	precision := string(influx.Precision)
+	if influx.Precision == Microsecond {
+		precision = "u"
+	}
+	endpoint := fmt.Sprintf("%s/write?db=%s&precision=%s", influx.Host, url.QueryEscape(influx.Database), precision)
+	return influxWrite(endpoint, "", msg, influx.Gzip)
+}
+
+// Close does nothing, requests aren't kept open
+func (influx *InfluxV1) Close() error {
+	return nil
+}
+
+// InfluxQL sends a raw query to the database server, returning its JSON response
+func (influx *InfluxV1) InfluxQL(msg string) (string, error) {
+	return influxQuery(http.MethodPost, fmt.Sprintf("%s/query?db=%s", influx.Host, url.QueryEscape(influx.Database)), url.Values{"q": {msg}})
+}
+
+// influxQLResponse is the JSON InfluxDB 1.x answers queries with
+type influxQLResponse struct {
+	Results []struct {
+		Series []struct {
+			Name    string            `json:"name"`
+			Tags    map[string]string `json:"tags"`
+			Columns []string          `json:"columns"`
+			Values  [][]interface{}   `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// Query returns every point of a measurement from (inclusive) to (exclusive)
+func (influx *InfluxV1) Query(measurement string, from time.Time, to time.Time) ([]Point, error) {
+	query := fmt.Sprintf(`SELECT * FROM "%s" WHERE time >= %d AND time < %d GROUP BY *`,
+		stringEscaper.Replace(measurement), from.UnixNano(), to.UnixNano())
+	endpoint := fmt.Sprintf("%s/query?db=%s&epoch=ns", influx.Host, url.QueryEscape(influx.Database))
+	body, err := influxQuery(http.MethodPost, endpoint, url.Values{"q": {query}})
+	if err != nil {
+		return nil, err
+	}
+
+	var response influxQLResponse
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s", response.Error)
+	}
+
+	var points []Point
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				p := Point{Measurement: measurement, Tags: series.Tags, Fields: make(map[string]interface{}, len(row))}
+				for i, column := range series.Columns {
+					if i >= len(row) || row[i] == nil {
+						continue
+					}
+					value := jsonValue(row[i])
+					if column == "time" {
+						if nanoseconds, ok := value.(int64); ok {
+							p.Time = time.Unix(0, nanoseconds)
+						}
+						continue
+					}
+					p.Fields[column] = value
+				}
+				points = append(points, p)
 			}
-			return nil
 		}
-		database.Started = true
 	}
+	return points, nil
+}
+
+// ShowDatabases handles the creation of a missing log Database
+func (influx *InfluxV1) ShowDatabases() (string, error) {
+	return influxQuery(http.MethodGet, influx.Host+"/query?"+url.Values{"q": {"SHOW DATABASES"}}.Encode(), nil)
+}
+
+// CreateDatabase handles the creation of a missing log Database
+func (influx *InfluxV1) CreateDatabase() error {
+	_, err := influxQuery(http.MethodPost, influx.Host+"/query", url.Values{"q": {"CREATE DATABASE " + influx.Database}})
+	return err
+}
+
+// Name of the sink
+func (influx *InfluxV2) Name() string {
+	return influx.name
+}
 
-	request := gorequest.New()
-	url := fmt.Sprintf("%s/write?db=%s", database.Host, database.DatabaseName)
-	resp, _, errs := request.Post(url).Type("text").Send(msg).End()
-	if errs != nil {
-		return errs[0]
+// Ping database server for connectivity
+func (influx *InfluxV2) Ping() error {
+	return influxPing(influx.Host, influx.Token)
+}
+
+// Write points to the bucket as line protocol
+func (influx *InfluxV2) Write(points []Point) error {
+	msg, err := encodeLines(points, influx.Precision)
+	if err != nil {
+		return err
 	}
 
-	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		body, err := ioutil.ReadAll(resp.Body)
+	endpoint := fmt.Sprintf("%s/api/v2/write?org=%s&bucket=%s&precision=%s", influx.Host, url.QueryEscape(influx.Org), url.QueryEscape(influx.Bucket), influx.Precision)
+	return influxWrite(endpoint, influx.Token, msg, influx.Gzip)
+}
+
+// Close does nothing, requests aren't kept open
+func (influx *InfluxV2) Close() error {
+	return nil
+}
+
+// Query returns every point of a measurement from (inclusive) to (exclusive)
+func (influx *InfluxV2) Query(measurement string, from time.Time, to time.Time) ([]Point, error) {
+	flux := fmt.Sprintf(`from(bucket: "%s")
+	|> range(start: %s, stop: %s)
+	|> filter(fn: (r) => r._measurement == "%s")`,
+		stringEscaper.Replace(influx.Bucket), from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano), stringEscaper.Replace(measurement))
+	query, err := json.Marshal(map[string]interface{}{
+		"query":   flux,
+		"type":    "flux",
+		"dialect": map[string]interface{}{"header": true, "annotations": []string{"datatype"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/v2/query?org=%s", influx.Host, url.QueryEscape(influx.Org))
+	request, err := influxRequest(http.MethodPost, endpoint, influx.Token, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/csv")
+
+	resp, err := influxClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Query failed with code %d: %s", resp.StatusCode, body)
+	}
+	return parseFluxCSV(resp.Body)
+}
+
+// fluxColumns aren't tags in a Flux result
+var fluxColumns = map[string]bool{"": true, "result": true, "table": true, "_start": true, "_stop": true, "_time": true, "_value": true, "_field": true, "_measurement": true}
+
+// parseFluxCSV reads points from an annotated Flux CSV response, one field per point
+func parseFluxCSV(body io.Reader) ([]Point, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+
+	var (
+		points  []Point
+		types   []string
+		columns []string
+	)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return points, nil
+		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// Each table starts with its column types, then its column names
+		if row[0] == "#datatype" {
+			types = row
+			columns = nil
+			continue
+		}
+		if columns == nil {
+			columns = row
+			continue
+		}
+
+		p := Point{Tags: make(map[string]string), Fields: make(map[string]interface{}, 1)}
+		var field string
+		var value interface{}
+		for i, column := range columns {
+			if i >= len(row) {
+				break
+			}
+			switch column {
+			case "_measurement":
+				p.Measurement = row[i]
+			case "_field":
+				field = row[i]
+			case "_time":
+				if p.Time, err = time.Parse(time.RFC3339Nano, row[i]); err != nil {
+					return nil, err
+				}
+			case "_value":
+				dataType := ""
+				if i < len(types) {
+					dataType = types[i]
+				}
+				if value, err = fluxValue(dataType, row[i]); err != nil {
+					return nil, err
+				}
+			case "error":
+				if row[i] != "" {
+					return nil, fmt.Errorf("%s", row[i])
+				}
+			default:
+				if !fluxColumns[column] {
+					p.Tags[column] = row[i]
+				}
+			}
+		}
+		if field != "" {
+			p.Fields[field] = value
+			points = append(points, p)
 		}
-		return fmt.Errorf("Write to database %s failed with code %d.\nRequest: %s\nRequest Body: %s\nResponse body: %s", database.DatabaseName, resp.StatusCode, url, msg, body)
 	}
+}
 
-	return nil
+// fluxValue parses a value by its Flux data type
+func fluxValue(dataType string, value string) (interface{}, error) {
+	switch dataType {
+	case "long":
+		return strconv.ParseInt(value, 10, 64)
+	case "unsignedLong":
+		return strconv.ParseUint(value, 10, 64)
+	case "double":
+		return strconv.ParseFloat(value, 64)
+	case "boolean":
+		return strconv.ParseBool(value)
+	}
+	return value, nil
 }
 
-// Query to influx database server with data pairs
-func (database *Database) Query(msg string) (string, error) {
-	request := gorequest.New()
-	_, body, errs := request.Post(database.Host + "/query?db=" + database.DatabaseName).Type("text").Send("q=" + msg).End()
-	if errs != nil {
-		return "", errs[0]
+// jsonValue converts numbers decoded from JSON to integers where they're whole
+func jsonValue(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if i, err := number.Int64(); err == nil {
+		return i
 	}
+	f, _ := number.Float64()
+	return f
+}
 
-	return body, nil
+// influxRequest builds a request, authorized with a token for InfluxDB 2
+func influxRequest(method string, endpoint string, token string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+	return request, nil
 }
 
-// ShowDatabases handles the creation of a missing log Database
-func (database *Database) ShowDatabases() (string, error) {
-	request := gorequest.New()
-	_, body, errs := request.Get(database.Host + "/query?q=SHOW DATABASES").End()
-	if errs != nil {
-		return "", errs[0]
+// influxPing checks for the 204 InfluxDB answers pings with
+func influxPing(host string, token string) error {
+	request, err := influxRequest(http.MethodGet, host+"/ping", token, nil)
+	if err != nil {
+		return err
 	}
+	resp, err := influxClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
 
-	return body, nil
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("ping failed with code %d", resp.StatusCode)
+	}
+	return nil
 }
 
-// CreateDatabase handles the creation of a missing log Database
-func (database *Database) CreateDatabase() error {
-	request := gorequest.New()
-	_, _, errs := request.Post(database.Host + "/query?q=CREATE DATABASE " + database.DatabaseName).End()
-	if errs != nil {
-		return errs[0]
+// influxWrite sends a write request, returning the server's complaint if it isn't accepted
+func influxWrite(endpoint string, token string, msg string, compress bool) error {
+	var body bytes.Buffer
+	if compress {
+		writer := gzip.NewWriter(&body)
+		if _, err := writer.Write([]byte(msg)); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	} else {
+		body.WriteString(msg)
+	}
+
+	request, err := influxRequest(http.MethodPost, endpoint, token, &body)
+	if err != nil {
+		return err
 	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if compress {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := influxClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Write failed with code %d.\nRequest: %s\nRequest Body: %s\nResponse body: %s", resp.StatusCode, endpoint, msg, body)
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
 	return nil
 }
+
+// influxQuery runs an InfluxQL query, form encoding the query for POSTs
+func influxQuery(method string, endpoint string, form url.Values) (string, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request, err := influxRequest(method, endpoint, "", body)
+	if err != nil {
+		return "", err
+	}
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := influxClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Query failed with code %d: %s", resp.StatusCode, response)
+	}
+	return string(response), nil
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Precision of line protocol timestamps
+type Precision string
+
+const (
+	// Nanosecond timestamps, the default
+	Nanosecond Precision = "ns"
+	// Microsecond timestamps
+	Microsecond Precision = "us"
+	// Millisecond timestamps
+	Millisecond Precision = "ms"
+	// Second timestamps
+	Second Precision = "s"
+)
+
+// parsePrecision reads a precision setting, defaulting to nanoseconds
+func parsePrecision(precision string) (Precision, error) {
+	switch strings.ToLower(precision) {
+	case "", "ns", "n":
+		return Nanosecond, nil
+	case "us", "u", "µs":
+		return Microsecond, nil
+	case "ms":
+		return Millisecond, nil
+	case "s":
+		return Second, nil
+	}
+	return "", fmt.Errorf("unknown precision %s", precision)
+}
+
+// timestamp formats t in this precision
+func (precision Precision) timestamp(t time.Time) string {
+	switch precision {
+	case Microsecond:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10)
+	case Millisecond:
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case Second:
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// checkName rejects names line protocol can't represent
+func checkName(kind string, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s is empty", kind)
+	}
+	if strings.ContainsAny(name, "\n\r") {
+		return fmt.Errorf("%s %q contains a newline", kind, name)
+	}
+	return nil
+}
+
+// encodeField formats a field value with its type's suffix or quotes
+func encodeField(value interface{}) (string, error) {
+	switch vv := value.(type) {
+	case bool:
+		return strconv.FormatBool(vv), nil
+	case string:
+		if strings.ContainsAny(vv, "\n\r") {
+			return "", fmt.Errorf("string %q contains a newline", vv)
+		}
+		return `"` + stringEscaper.Replace(vv) + `"`, nil
+	case int:
+		return strconv.FormatInt(int64(vv), 10) + "i", nil
+	case int8:
+		return strconv.FormatInt(int64(vv), 10) + "i", nil
+	case int16:
+		return strconv.FormatInt(int64(vv), 10) + "i", nil
+	case int32:
+		return strconv.FormatInt(int64(vv), 10) + "i", nil
+	case int64:
+		return strconv.FormatInt(vv, 10) + "i", nil
+	case uint:
+		return encodeUnsigned(uint64(vv))
+	case uint8:
+		return encodeUnsigned(uint64(vv))
+	case uint16:
+		return encodeUnsigned(uint64(vv))
+	case uint32:
+		return encodeUnsigned(uint64(vv))
+	case uint64:
+		return encodeUnsigned(vv)
+	case float32:
+		return encodeFloat(float64(vv), 32)
+	case float64:
+		return encodeFloat(vv, 64)
+	}
+	return "", fmt.Errorf("Cannot process type %T of %v", value, value)
+}
+
+// encodeUnsigned writes unsigned values as integers, InfluxDB 1.x has no unsigned type
+func encodeUnsigned(value uint64) (string, error) {
+	if value > math.MaxInt64 {
+		return "", fmt.Errorf("%d overflows a signed integer", value)
+	}
+	return strconv.FormatUint(value, 10) + "i", nil
+}
+
+func encodeFloat(value float64, bitSize int) (string, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", fmt.Errorf("%v is not a valid float", value)
+	}
+	return strconv.FormatFloat(value, 'g', -1, bitSize), nil
+}
+
+// encodeLine writes a point as an InfluxDB line protocol statement:
+//
+//	measurement,tag1=a,tag2=b field1=1i,field2="x" 1588370645000000000
+//
+// Tags and fields are sorted by key, empty tag values are left out and
+// the timestamp is omitted for points without a time.
+func encodeLine(p Point, precision Precision) (string, error) {
+	if err := checkName("measurement", p.Measurement); err != nil {
+		return "", err
+	}
+	if len(p.Fields) == 0 {
+		return "", fmt.Errorf("measurement %s has no fields", p.Measurement)
+	}
+
+	var stmt strings.Builder
+	stmt.WriteString(measurementEscaper.Replace(p.Measurement))
+
+	// Write tags first
+	tagKeys := make([]string, 0, len(p.Tags))
+	for key := range p.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		value := p.Tags[key]
+		if value == "" {
+			continue
+		}
+		if err := checkName("tag key", key); err != nil {
+			return "", err
+		}
+		if err := checkName("tag value", value); err != nil {
+			return "", err
+		}
+		stmt.WriteRune(',')
+		stmt.WriteString(keyEscaper.Replace(key))
+		stmt.WriteRune('=')
+		stmt.WriteString(keyEscaper.Replace(value))
+	}
+
+	// Space between tags and fields
+	stmt.WriteRune(' ')
+
+	// Write fields next
+	fieldKeys := make([]string, 0, len(p.Fields))
+	for key := range p.Fields {
+		fieldKeys = append(fieldKeys, key)
+	}
+	sort.Strings(fieldKeys)
+	for i, key := range fieldKeys {
+		if err := checkName("field key", key); err != nil {
+			return "", err
+		}
+		value, err := encodeField(p.Fields[key])
+		if err != nil {
+			return "", fmt.Errorf("field %s: %s", key, err.Error())
+		}
+		if i > 0 {
+			stmt.WriteRune(',')
+		}
+		stmt.WriteString(keyEscaper.Replace(key))
+		stmt.WriteRune('=')
+		stmt.WriteString(value)
+	}
+
+	// Timestamp last
+	if !p.Time.IsZero() {
+		stmt.WriteRune(' ')
+		stmt.WriteString(precision.timestamp(p.Time))
+	}
+	return stmt.String(), nil
+}
+
+// encodeLines writes points as line protocol, one statement per line
+func encodeLines(points []Point, precision Precision) (string, error) {
+	lines := make([]string, 0, len(points))
+	for _, p := range points {
+		line, err := encodeLine(p, precision)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,298 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// lineAlphabet favours the characters line protocol has to escape
+const lineAlphabet = `abcXYZ019 ,="\_.-`
+
+func randomName(r *rand.Rand) string {
+	name := make([]byte, 1+r.Intn(8))
+	for i := range name {
+		name[i] = lineAlphabet[r.Intn(len(lineAlphabet))]
+	}
+	return string(name)
+}
+
+func randomField(r *rand.Rand) interface{} {
+	switch r.Intn(4) {
+	case 0:
+		return r.Int63() - r.Int63()
+	case 1:
+		return r.NormFloat64() * math.Pow(10, float64(r.Intn(20)-10))
+	case 2:
+		return r.Intn(2) == 0
+	}
+	return randomName(r)
+}
+
+// randomPoint is a point with names and values that need escaping
+type randomPoint struct {
+	Point
+}
+
+// Generate implements quick.Generator
+func (randomPoint) Generate(r *rand.Rand, size int) reflect.Value {
+	p := Point{
+		Measurement: randomName(r),
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]interface{}),
+		Time:        time.Unix(0, r.Int63()),
+	}
+	for i := r.Intn(4); i > 0; i-- {
+		p.Tags[randomName(r)] = randomName(r)
+	}
+	for i := 1 + r.Intn(4); i > 0; i-- {
+		p.Fields[randomName(r)] = randomField(r)
+	}
+	return reflect.ValueOf(randomPoint{p})
+}
+
+// decodedLine is a line protocol statement split back into its parts, in the order they were written
+type decodedLine struct {
+	measurement string
+	tagKeys     []string
+	tags        map[string]string
+	fieldKeys   []string
+	fields      map[string]interface{}
+	timestamp   string
+}
+
+// scanToken reads up to an unescaped stop character, removing escapes
+func scanToken(line string, i int, stops string) (string, int) {
+	var token strings.Builder
+	for ; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			token.WriteByte(line[i])
+		case strings.IndexByte(stops, line[i]) >= 0:
+			return token.String(), i
+		default:
+			token.WriteByte(line[i])
+		}
+	}
+	return token.String(), i
+}
+
+// decodeLine parses the line protocol encodeLine writes
+func decodeLine(t *testing.T, line string) decodedLine {
+	decoded := decodedLine{tags: make(map[string]string), fields: make(map[string]interface{})}
+	var i int
+	decoded.measurement, i = scanToken(line, 0, ", ")
+
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scanToken(line, i+1, "=")
+		value, i = scanToken(line, i+1, ", ")
+		decoded.tagKeys = append(decoded.tagKeys, key)
+		decoded.tags[key] = value
+	}
+
+	for i < len(line) && (line[i] == ' ' && len(decoded.fieldKeys) == 0 || line[i] == ',') {
+		var key string
+		key, i = scanToken(line, i+1, "=")
+		i++
+
+		var value interface{}
+		if i < len(line) && line[i] == '"' {
+			var text string
+			text, i = scanToken(line, i+1, `"`)
+			value = text
+			i++
+		} else {
+			var raw string
+			raw, i = scanToken(line, i, ", ")
+			value = decodeValue(t, raw)
+		}
+		decoded.fieldKeys = append(decoded.fieldKeys, key)
+		decoded.fields[key] = value
+	}
+
+	if i < len(line) {
+		decoded.timestamp = line[i+1:]
+	}
+	return decoded
+}
+
+func decodeValue(t *testing.T, raw string) interface{} {
+	switch {
+	case raw == "true" || raw == "false":
+		return raw == "true"
+	case strings.HasSuffix(raw, "i"):
+		value, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		if err != nil {
+			t.Fatalf("Bad integer %s: %s", raw, err.Error())
+		}
+		return value
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		t.Fatalf("Bad float %s: %s", raw, err.Error())
+	}
+	return value
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	roundTrip := func(p randomPoint) bool {
+		line, err := encodeLine(p.Point, Nanosecond)
+		if err != nil {
+			t.Logf("Failed to encode %+v: %s", p.Point, err.Error())
+			return false
+		}
+		decoded := decodeLine(t, line)
+
+		ok := decoded.measurement == p.Measurement &&
+			reflect.DeepEqual(decoded.tags, p.Tags) &&
+			reflect.DeepEqual(decoded.fields, p.Fields) &&
+			decoded.timestamp == strconv.FormatInt(p.Time.UnixNano(), 10)
+		if !ok {
+			t.Logf("%+v encoded as %s decoded as %+v", p.Point, line, decoded)
+		}
+		return ok
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLineOrder(t *testing.T) {
+	sorted := func(p randomPoint) bool {
+		line, err := encodeLine(p.Point, Nanosecond)
+		if err != nil {
+			return false
+		}
+		// Maps iterate in a different order every time, the line mustn't change
+		for i := 0; i < 5; i++ {
+			if again, _ := encodeLine(p.Point, Nanosecond); again != line {
+				t.Logf("%s encoded again as %s", line, again)
+				return false
+			}
+		}
+		decoded := decodeLine(t, line)
+		return sort.StringsAreSorted(decoded.tagKeys) && sort.StringsAreSorted(decoded.fieldKeys)
+	}
+	if err := quick.Check(sorted, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLineEmptyTags(t *testing.T) {
+	line, err := encodeLine(Point{
+		Measurement: "gps",
+		Tags:        map[string]string{"empty": "", "source": "usb"},
+		Fields:      map[string]interface{}{"speed": 1.5},
+	}, Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a time the timestamp is left to the server
+	if line != "gps,source=usb speed=1.5" {
+		t.Fatalf("Unexpected line %s", line)
+	}
+}
+
+func TestLineIntegers(t *testing.T) {
+	suffixed := func(value int64) bool {
+		for _, field := range []interface{}{value, int(value), int32(value), int16(value), int8(value)} {
+			encoded, err := encodeField(field)
+			if err != nil || encoded != fmt.Sprintf("%di", field) {
+				t.Logf("%T %v encoded as %s: %v", field, field, encoded, err)
+				return false
+			}
+		}
+		unsigned := uint64(value) >> 1
+		encoded, err := encodeField(unsigned)
+		return err == nil && encoded == strconv.FormatUint(unsigned, 10)+"i"
+	}
+	if err := quick.Check(suffixed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := encodeField(uint64(math.MaxInt64) + 1); err == nil {
+		t.Fatal("Expected an unsigned value past int64 to be rejected")
+	}
+	if encoded, _ := encodeField(2.0); encoded != "2" {
+		t.Fatalf("Expected floats to have no suffix, got %s", encoded)
+	}
+}
+
+func TestLinePrecision(t *testing.T) {
+	units := map[Precision]int64{
+		Nanosecond:  1,
+		Microsecond: int64(time.Microsecond),
+		Millisecond: int64(time.Millisecond),
+		Second:      int64(time.Second),
+	}
+	truncated := func(nanoseconds int64) bool {
+		if nanoseconds < 0 {
+			nanoseconds = -nanoseconds
+		}
+		for precision, unit := range units {
+			line, err := encodeLine(Point{
+				Measurement: "m",
+				Fields:      map[string]interface{}{"f": 1},
+				Time:        time.Unix(0, nanoseconds),
+			}, precision)
+			if err != nil {
+				return false
+			}
+			if expected := strconv.FormatInt(nanoseconds/unit, 10); decodeLine(t, line).timestamp != expected {
+				t.Logf("%d in %s encoded as %s", nanoseconds, precision, line)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(truncated, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, setting := range []string{"", "n", "ns", "u", "us", "µs", "ms", "s", "MS"} {
+		if _, err := parsePrecision(setting); err != nil {
+			t.Errorf("Precision %q was rejected: %s", setting, err.Error())
+		}
+	}
+	if _, err := parsePrecision("minutes"); err == nil {
+		t.Error("Expected an unknown precision to be rejected")
+	}
+}
+
+func TestLineRejects(t *testing.T) {
+	invalid := map[string]Point{
+		"no fields":         {Measurement: "m"},
+		"empty fields":      {Measurement: "m", Fields: map[string]interface{}{}},
+		"NaN":               {Measurement: "m", Fields: map[string]interface{}{"f": math.NaN()}},
+		"Inf":               {Measurement: "m", Fields: map[string]interface{}{"f": math.Inf(1)}},
+		"-Inf":              {Measurement: "m", Fields: map[string]interface{}{"f": math.Inf(-1)}},
+		"float32 NaN":       {Measurement: "m", Fields: map[string]interface{}{"f": float32(math.NaN())}},
+		"float32 Inf":       {Measurement: "m", Fields: map[string]interface{}{"f": float32(math.Inf(1))}},
+		"empty measurement": {Fields: map[string]interface{}{"f": 1}},
+		"newline":           {Measurement: "m\n", Fields: map[string]interface{}{"f": 1}},
+		"newline string":    {Measurement: "m", Fields: map[string]interface{}{"f": "a\nb"}},
+		"empty field key":   {Measurement: "m", Fields: map[string]interface{}{"": 1}},
+		"empty tag key":     {Measurement: "m", Tags: map[string]string{"": "v"}, Fields: map[string]interface{}{"f": 1}},
+		"unknown type":      {Measurement: "m", Fields: map[string]interface{}{"f": []int{1}}},
+	}
+	for name, p := range invalid {
+		if line, err := encodeLine(p, Nanosecond); err == nil {
+			t.Errorf("Expected %s to be rejected, encoded as %s", name, line)
+		}
+	}
+
+	// One bad point fails the whole batch
+	valid := Point{Measurement: "m", Fields: map[string]interface{}{"f": 1}}
+	if _, err := encodeLines([]Point{valid, invalid["NaN"]}, Nanosecond); err == nil {
+		t.Error("Expected a batch with a NaN to be rejected")
+	}
+}
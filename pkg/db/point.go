@@ -0,0 +1,29 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Point is a single measurement at a point in time.
+// Tags are indexed metadata, fields are the values being measured.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// NewPoint creates a point timestamped now, converting tags to strings
+func NewPoint(measurement string, tags map[string]interface{}, fields map[string]interface{}) Point {
+	p := Point{
+		Measurement: measurement,
+		Tags:        make(map[string]string, len(tags)),
+		Fields:      fields,
+		Time:        time.Now(),
+	}
+	for key, value := range tags {
+		p.Tags[key] = fmt.Sprintf("%v", value)
+	}
+	return p
+}
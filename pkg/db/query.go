@@ -0,0 +1,248 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Querier is a sink whose points can be read back
+type Querier interface {
+	// Query returns every point of a measurement from (inclusive) to (exclusive)
+	Query(measurement string, from time.Time, to time.Time) ([]Point, error)
+}
+
+// Aggregate reduces the values in each window of a series to one
+type Aggregate string
+
+const (
+	// AggregateNone returns every value
+	AggregateNone Aggregate = ""
+	// AggregateMean averages numeric values
+	AggregateMean Aggregate = "mean"
+	// AggregateMin is the smallest numeric value
+	AggregateMin Aggregate = "min"
+	// AggregateMax is the largest numeric value
+	AggregateMax Aggregate = "max"
+	// AggregateSum adds numeric values
+	AggregateSum Aggregate = "sum"
+	// AggregateCount is how many values there are
+	AggregateCount Aggregate = "count"
+	// AggregateFirst is the earliest value
+	AggregateFirst Aggregate = "first"
+	// AggregateLast is the latest value
+	AggregateLast Aggregate = "last"
+)
+
+// parseAggregate checks an aggregate's name
+func parseAggregate(agg string) (Aggregate, error) {
+	switch a := Aggregate(strings.ToLower(agg)); a {
+	case AggregateNone, AggregateMean, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateFirst, AggregateLast:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown aggregate %s", agg)
+}
+
+// Series is one field of a measurement with one set of tags, oldest value first
+type Series struct {
+	Measurement string
+	Tags        map[string]string
+	Field       string
+	Values      []Value
+}
+
+// Value of a series at a point in time, the start of its window if aggregated
+type Value struct {
+	Time  time.Time
+	Value interface{}
+}
+
+// querier returns the sink's reader, looking through any buffer in front of it
+func querier(sink Sink) (Querier, bool) {
+	if b, ok := sink.(*Buffer); ok {
+		sink = b.sink
+	}
+	q, ok := sink.(Querier)
+	return q, ok
+}
+
+// History reads a measurement back from the named sink, or the first that can be queried,
+// aggregating values into windows of every if an aggregate is given. An every of 0 aggregates
+// the whole range into one value. A resolution other than 0 reads the sink's rollups instead.
+func (database *Database) History(sinkName string, measurement string, from time.Time, to time.Time, resolution time.Duration, agg Aggregate, every time.Duration) ([]Series, error) {
+	if database == nil {
+		return nil, fmt.Errorf("Database is nil")
+	}
+
+	var read func() ([]Point, error)
+	for _, sink := range database.Sinks() {
+		if sinkName != "" && sink.Name() != sinkName {
+			continue
+		}
+		if q, ok := querier(sink); ok {
+			if resolution == 0 {
+				read = func() ([]Point, error) { return q.Query(measurement, from, to) }
+				break
+			}
+			if rq, ok := q.(RollupQuerier); ok {
+				read = func() ([]Point, error) { return rq.QueryRollups(measurement, from, to, resolution) }
+				break
+			}
+		}
+		if sinkName != "" {
+			return nil, fmt.Errorf("Database sink %s can't be queried at this resolution", sinkName)
+		}
+	}
+	if read == nil {
+		if sinkName != "" {
+			return nil, fmt.Errorf("No database sink named %s", sinkName)
+		}
+		return nil, fmt.Errorf("No database sink can be queried at this resolution")
+	}
+
+	points, err := read()
+	if err != nil {
+		return nil, err
+	}
+	series := toSeries(points)
+	if agg != AggregateNone {
+		for i := range series {
+			series[i].Values = aggregate(series[i].Values, agg, from, every)
+		}
+	}
+	return series, nil
+}
+
+// toSeries splits points into a series per field and set of tags
+func toSeries(points []Point) []Series {
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+
+	index := make(map[string]int)
+	var series []Series
+	for _, p := range points {
+		tags, _ := json.Marshal(p.Tags)
+		for field, value := range p.Fields {
+			key := string(tags) + "\x00" + field
+			i, ok := index[key]
+			if !ok {
+				i = len(series)
+				index[key] = i
+				series = append(series, Series{Measurement: p.Measurement, Tags: p.Tags, Field: field})
+			}
+			series[i].Values = append(series[i].Values, Value{Time: p.Time, Value: value})
+		}
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Field != series[j].Field {
+			return series[i].Field < series[j].Field
+		}
+		tagsI, _ := json.Marshal(series[i].Tags)
+		tagsJ, _ := json.Marshal(series[j].Tags)
+		return string(tagsI) < string(tagsJ)
+	})
+	return series
+}
+
+// aggregate reduces values into windows starting from, skipping empty windows.
+// Numeric aggregates ignore values that aren't numbers.
+func aggregate(values []Value, agg Aggregate, from time.Time, every time.Duration) []Value {
+	var (
+		result []Value
+		window []Value
+		start  time.Time
+	)
+	flush := func() {
+		if len(window) == 0 {
+			return
+		}
+		if value, ok := reduce(window, agg); ok {
+			result = append(result, Value{Time: start, Value: value})
+		}
+		window = window[:0]
+	}
+
+	for _, v := range values {
+		windowStart := from
+		if every > 0 {
+			windowStart = from.Add(v.Time.Sub(from) / every * every)
+		}
+		if !windowStart.Equal(start) {
+			flush()
+			start = windowStart
+		}
+		window = append(window, v)
+	}
+	flush()
+	return result
+}
+
+// reduce aggregates one window of values
+func reduce(values []Value, agg Aggregate) (interface{}, bool) {
+	switch agg {
+	case AggregateCount:
+		return len(values), true
+	case AggregateFirst:
+		return values[0].Value, true
+	case AggregateLast:
+		return values[len(values)-1].Value, true
+	}
+
+	var numbers []float64
+	for _, v := range values {
+		if f, ok := toFloat(v.Value); ok {
+			numbers = append(numbers, f)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil, false
+	}
+
+	result := numbers[0]
+	for _, f := range numbers[1:] {
+		switch agg {
+		case AggregateMin:
+			if f < result {
+				result = f
+			}
+		case AggregateMax:
+			if f > result {
+				result = f
+			}
+		case AggregateMean, AggregateSum:
+			result += f
+		}
+	}
+	if agg == AggregateMean {
+		result /= float64(len(numbers))
+	}
+	return result, true
+}
+
+// toFloat converts numeric values, including booleans as 0 or 1
+func toFloat(value interface{}) (float64, bool) {
+	switch vv := value.(type) {
+	case float64:
+		return vv, true
+	case float32:
+		return float64(vv), true
+	case int:
+		return float64(vv), true
+	case int64:
+		return float64(vv), true
+	case int32:
+		return float64(vv), true
+	case uint64:
+		return float64(vv), true
+	case uint32:
+		return float64(vv), true
+	case bool:
+		if vv {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// seconds makes a value at a number of seconds after start
+func seconds(start time.Time, s int, value interface{}) Value {
+	return Value{Time: start.Add(time.Duration(s) * time.Second), Value: value}
+}
+
+func TestAggregateWindows(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	values := []Value{
+		seconds(start, 0, 1.0),
+		seconds(start, 30, 3.0),
+		seconds(start, 59, "text"),
+		seconds(start, 60, 10.0),
+		// Nothing from 120s to 180s, the window is skipped rather than empty
+		seconds(start, 185, true),
+		seconds(start, 190, int64(4)),
+	}
+
+	windows := map[Aggregate][]Value{
+		AggregateMean:  {seconds(start, 0, 2.0), seconds(start, 60, 10.0), seconds(start, 180, 2.5)},
+		AggregateMin:   {seconds(start, 0, 1.0), seconds(start, 60, 10.0), seconds(start, 180, 1.0)},
+		AggregateMax:   {seconds(start, 0, 3.0), seconds(start, 60, 10.0), seconds(start, 180, 4.0)},
+		AggregateSum:   {seconds(start, 0, 4.0), seconds(start, 60, 10.0), seconds(start, 180, 5.0)},
+		AggregateCount: {seconds(start, 0, 3), seconds(start, 60, 1), seconds(start, 180, 2)},
+		AggregateFirst: {seconds(start, 0, 1.0), seconds(start, 60, 10.0), seconds(start, 180, true)},
+		AggregateLast:  {seconds(start, 0, "text"), seconds(start, 60, 10.0), seconds(start, 180, int64(4))},
+	}
+	for agg, expected := range windows {
+		if got := aggregate(values, agg, start, time.Minute); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %s windows %v, got %v", agg, expected, got)
+		}
+	}
+
+	// Windows line up with from, not the first value
+	offset := aggregate(values, AggregateCount, start.Add(-30*time.Second), time.Minute)
+	if expected := []Value{seconds(start, -30, 1), seconds(start, 30, 3), seconds(start, 150, 2)}; !reflect.DeepEqual(offset, expected) {
+		t.Errorf("Expected offset windows %v, got %v", expected, offset)
+	}
+
+	// Without a window the whole range is one value
+	if whole := aggregate(values, AggregateMax, start, 0); !reflect.DeepEqual(whole, []Value{seconds(start, 0, 10.0)}) {
+		t.Errorf("Expected one window over the whole range, got %v", whole)
+	}
+
+	// Windows of only text have no numeric aggregate
+	if text := aggregate([]Value{seconds(start, 0, "a")}, AggregateMean, start, time.Minute); len(text) != 0 {
+		t.Errorf("Expected no mean of text, got %v", text)
+	}
+}
+
+func TestParseAggregate(t *testing.T) {
+	if agg, err := parseAggregate("MEAN"); err != nil || agg != AggregateMean {
+		t.Errorf("Expected MEAN to parse as mean, got %s: %v", agg, err)
+	}
+	if agg, err := parseAggregate(""); err != nil || agg != AggregateNone {
+		t.Errorf("Expected no aggregate, got %s: %v", agg, err)
+	}
+	if _, err := parseAggregate("median"); err == nil {
+		t.Error("Expected an unknown aggregate to be rejected")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 5, 1, 18, 4, 5, 0, time.UTC)
+	fallback := now.Add(-time.Hour)
+
+	times := map[string]time.Time{
+		"":                          fallback,
+		"now":                       now,
+		"-30m":                      now.Add(-30 * time.Minute),
+		"-1h30m":                    now.Add(-90 * time.Minute),
+		"1588356245":                time.Unix(1588356245, 0),
+		"2020-05-01T14:04:05-04:00": now,
+		"2020-05-01T18:04:05.5Z":    now.Add(500 * time.Millisecond),
+	}
+	for value, expected := range times {
+		got, err := parseTime(value, fallback, now)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", value, err.Error())
+			continue
+		}
+		if !got.Equal(expected) {
+			t.Errorf("Expected %q to be %s, got %s", value, expected, got)
+		}
+	}
+
+	for _, value := range []string{"yesterday", "-soon", "2020-05-01"} {
+		if _, err := parseTime(value, fallback, now); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestCSVHistory(t *testing.T) {
+	sink, err := newCSV("trip", filepath.Join(t.TempDir(), "trip.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	start := time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 4; i++ {
+		points = append(points, Point{
+			Measurement: "rpm",
+			Tags:        map[string]string{"engine": "main"},
+			Fields:      map[string]interface{}{"value": 800 + i*100, "idle": i == 0},
+			Time:        start.Add(time.Duration(i) * 30 * time.Second),
+		})
+	}
+	points = append(points,
+		Point{Measurement: "speed", Fields: map[string]interface{}{"value": 12.5}, Time: start},
+		Point{Measurement: "rpm", Fields: map[string]interface{}{"value": 600.5}, Time: start.Add(time.Second)},
+	)
+	if err := sink.Write(points); err != nil {
+		t.Fatal(err)
+	}
+
+	database := &Database{sinks: []Sink{sink}}
+	series, err := database.History("trip", "rpm", start, start.Add(90*time.Second), 0, AggregateMean, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Series are sorted by field, then tags, and to is exclusive
+	expected := []Series{
+		{Measurement: "rpm", Tags: map[string]string{"engine": "main"}, Field: "idle", Values: []Value{
+			seconds(start, 0, 0.5), seconds(start, 60, 0.0),
+		}},
+		{Measurement: "rpm", Tags: map[string]string{"engine": "main"}, Field: "value", Values: []Value{
+			seconds(start, 0, 850.0), seconds(start, 60, 1000.0),
+		}},
+		{Measurement: "rpm", Tags: map[string]string{}, Field: "value", Values: []Value{
+			seconds(start, 0, 600.5),
+		}},
+	}
+	if fmt.Sprint(series) != fmt.Sprint(expected) {
+		t.Fatalf("Expected series %v, got %v", expected, series)
+	}
+
+	raw, err := sink.Query("speed", start, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 || raw[0].Fields["value"] != 12.5 || !raw[0].Time.Equal(start) {
+		t.Fatalf("Unexpected speed points %+v", raw)
+	}
+
+	if _, err := database.History("trip", "rpm", start, start.Add(time.Minute), MinuteResolution, AggregateNone, 0); err == nil {
+		t.Fatal("Expected CSV sinks to have no rollups")
+	}
+	if _, err := database.History("missing", "rpm", start, start.Add(time.Minute), 0, AggregateNone, 0); err == nil {
+		t.Fatal("Expected an unknown sink to be rejected")
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// recorderQueue is how many session changes can wait for the recorder, later ones are dropped
+	recorderQueue = 1024
+	// recorderTick is how often decimated samples are checked for a due value
+	recorderTick = 100 * time.Millisecond
+	// recordedField holds the session value in each recorded point
+	recordedField = "value"
+)
+
+// Rule records changes to session keys matching any of its patterns
+type Rule struct {
+	Name string
+	// Keys are session key patterns, i.e. gps.* or #
+	Keys []string
+	// Rate is the shortest time between two samples of a key, 0 records every change
+	Rate time.Duration
+	// Deadband ignores numeric changes smaller than this
+	Deadband float64
+}
+
+// sample tracks the last value recorded for a session key
+type sample struct {
+	rule     *Rule
+	value    interface{}
+	recorded time.Time
+	pending  *Point
+}
+
+// recorder writes session changes to the database, one measurement per key
+type recorder struct {
+	rules   []*Rule
+	write   func(points []Point)
+	samples map[string]*sample
+	// dropped is the number of session changes the recorder fell too far behind to receive
+	dropped uint64
+}
+
+// setupRecorder subscribes to the session keys configured under db.recorder.rules, i.e.
+//
+//	db:
+//	  recorder:
+//	    rules:
+//	      gps:
+//	        keys: [gps.*]
+//	        rate: 1s
+//	        deadband: 0.00001
+//	      engine:
+//	        keys: [rpm, coolant_temp]
+//	        deadband: 50
+//
+// A key matching several rules uses the first by name.
+func setupRecorder(c *core.Core, database *Database) {
+	var names []string
+	for name := range c.Settings.GetStringMap("db.recorder.rules") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return
+	}
+
+	rec := &recorder{samples: make(map[string]*sample)}
+	for _, name := range names {
+		key := fmt.Sprintf("db.recorder.rules.%s", name)
+		rule := &Rule{
+			Name:     name,
+			Keys:     c.Settings.GetStringSlice(key + ".keys"),
+			Rate:     c.Settings.GetDuration(key + ".rate"),
+			Deadband: c.Settings.GetFloat64(key + ".deadband"),
+		}
+		if len(rule.Keys) == 0 {
+			log.Warn().Msgf("Recorder rule %s has no keys, skipping it", name)
+			continue
+		}
+		rec.rules = append(rec.rules, rule)
+	}
+
+	// Points are queued rather than written here, a sink publishing its metrics
+	// while the recorder waits on it would otherwise deadlock the session
+	if database.batch != nil {
+		rec.write = database.batch.add
+	} else {
+		batch := newBatcher(defaultBatchSize, defaultBatchInterval, database.write)
+		rec.write = batch.add
+	}
+
+	// Rules may share patterns, each is only subscribed once
+	ch := make(chan core.Message, recorderQueue)
+	subscribed := make(map[string]bool)
+	for _, rule := range rec.rules {
+		for _, pattern := range rule.Keys {
+			if !subscribed[pattern] {
+				subscribed[pattern] = true
+				c.Subscribe("session."+pattern, ch)
+			}
+		}
+		log.Info().Msgf("Recording session keys %s to the database", strings.Join(rule.Keys, ", "))
+	}
+	go rec.run(c, ch)
+}
+
+// run records session changes as they're published
+func (rec *recorder) run(c *core.Core, ch chan core.Message) {
+	ticker := time.NewTicker(recorderTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-ch:
+			rec.record(strings.TrimPrefix(m.Topic, "session."), m.Content, m.WriteDate)
+		case now := <-ticker.C:
+			rec.flushDue(now)
+			rec.countDropped(c, ch)
+		}
+	}
+}
+
+// countDropped publishes how many session changes were dropped while the recorder was behind
+func (rec *recorder) countDropped(c *core.Core, ch chan core.Message) {
+	dropped := c.Dropped(ch)
+	if dropped == rec.dropped {
+		return
+	}
+	log.Warn().Msgf("Recorder fell behind and dropped %d session changes", dropped-rec.dropped)
+	rec.dropped = dropped
+	c.Publish("session.db.recorder.dropped", core.Message{Content: dropped})
+}
+
+// ruleFor returns the first rule matching a session key
+func (rec *recorder) ruleFor(key string) *Rule {
+	for _, rule := range rec.rules {
+		for _, pattern := range rule.Keys {
+			if core.MatchTopic(pattern, key) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// record a session change, unless it's inside the deadband or too soon after the last sample
+func (rec *recorder) record(key string, value interface{}, date time.Time) {
+	// Don't record the database's own metrics, each write would cause another
+	if strings.HasPrefix(key, "db.") {
+		return
+	}
+
+	s, ok := rec.samples[key]
+	if !ok {
+		rule := rec.ruleFor(key)
+		if rule == nil {
+			return
+		}
+		s = &sample{rule: rule}
+		rec.samples[key] = s
+	}
+
+	value = recordedValue(value)
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return
+	}
+	if !s.recorded.IsZero() && !s.changed(value) {
+		s.pending = nil
+		return
+	}
+
+	p := Point{Measurement: key, Fields: map[string]interface{}{recordedField: value}, Time: date}
+	if date.Sub(s.recorded) < s.rule.Rate {
+		// Keep the latest value to write once the rate allows it
+		s.pending = &p
+		return
+	}
+	rec.emit(s, p)
+}
+
+// flushDue writes decimated samples whose rate now allows them
+func (rec *recorder) flushDue(now time.Time) {
+	var points []Point
+	for _, s := range rec.samples {
+		if s.pending == nil || now.Sub(s.recorded) < s.rule.Rate {
+			continue
+		}
+		p := *s.pending
+		s.pending = nil
+		s.value = p.Fields[recordedField]
+		s.recorded = now
+		points = append(points, p)
+	}
+	if len(points) > 0 {
+		rec.write(points)
+	}
+}
+
+func (rec *recorder) emit(s *sample, p Point) {
+	s.pending = nil
+	s.value = p.Fields[recordedField]
+	s.recorded = p.Time
+	rec.write([]Point{p})
+}
+
+// changed checks a new value against the last one recorded
+func (s *sample) changed(value interface{}) bool {
+	last, lastIsNumber := s.value.(float64)
+	current, isNumber := value.(float64)
+	if lastIsNumber && isNumber {
+		return math.Abs(current-last) > s.rule.Deadband
+	}
+	return value != s.value
+}
+
+// recordedValue stores every number as a float, so a key doesn't change type in the database
+// when its value happens to be whole
+func recordedValue(value interface{}) interface{} {
+	switch vv := value.(type) {
+	case int:
+		return float64(vv)
+	case int8:
+		return float64(vv)
+	case int16:
+		return float64(vv)
+	case int32:
+		return float64(vv)
+	case int64:
+		return float64(vv)
+	case uint:
+		return float64(vv)
+	case uint8:
+		return float64(vv)
+	case uint16:
+		return float64(vv)
+	case uint32:
+		return float64(vv)
+	case uint64:
+		return float64(vv)
+	case float32:
+		return float64(vv)
+	case float64, bool:
+		return vv
+	case string:
+		// Serial devices write numbers as text
+		if f, err := strconv.ParseFloat(vv, 64); err == nil {
+			return f
+		}
+		return vv
+	}
+	return fmt.Sprintf("%v", value)
+}
@@ -0,0 +1,563 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// defaultRetentionInterval is how often old points are rolled up and deleted
+	defaultRetentionInterval = time.Hour
+	// retentionDelay gives startup a chance to settle before the first run
+	retentionDelay = time.Minute
+	// defaultRollupAfter leaves time for late points before a window is rolled up
+	defaultRollupAfter = 10 * time.Minute
+	// defaultRawRetention keeps a week of raw points
+	defaultRawRetention = 7 * 24 * time.Hour
+	// defaultMinuteRetention keeps 90 days of 1 minute rollups, hourly rollups are kept forever
+	defaultMinuteRetention = 90 * 24 * time.Hour
+	// vacuumThreshold is how many bytes of free pages a file needs before it's vacuumed, which rewrites all of it
+	vacuumThreshold = 8 << 20
+)
+
+// Rollup resolutions, points are rolled into minutes and minutes into hours
+const (
+	MinuteResolution = time.Minute
+	HourResolution   = time.Hour
+)
+
+// RollupQuerier is a sink keeping rollups of its points
+type RollupQuerier interface {
+	// QueryRollups returns the windows of a measurement starting from (inclusive) to (exclusive),
+	// with each field's min, max, mean and last value as <field>_min and so on
+	QueryRollups(measurement string, from time.Time, to time.Time, resolution time.Duration) ([]Point, error)
+}
+
+// RetentionPolicy decides how long points and their rollups are kept, 0 keeps them forever
+type RetentionPolicy struct {
+	RollupAfter time.Duration
+	Raw         time.Duration
+	Minute      time.Duration
+	Hour        time.Duration
+}
+
+// RetentionStatus of the retention job, as returned by /retention
+type RetentionStatus struct {
+	Sinks        []string
+	Interval     string
+	RollupAfter  string
+	Raw          string
+	Minute       string
+	Hour         string
+	Running      bool
+	LastRun      time.Time
+	LastDuration string `json:",omitempty"`
+	LastError    string `json:",omitempty"`
+	NextRun      time.Time
+	// Rolled is how many rollups the last run wrote, Deleted how many points and rollups it removed
+	Rolled       int64
+	Deleted      int64
+	FilesRemoved int
+}
+
+// retentionResult of applying a policy to one or more files
+type retentionResult struct {
+	rolled       int64
+	deleted      int64
+	filesRemoved int
+}
+
+// retention periodically applies a policy to local sinks
+type retention struct {
+	policy   RetentionPolicy
+	interval time.Duration
+	sinks    []*SQLite
+	trigger  chan struct{}
+
+	mutex  sync.Mutex
+	status RetentionStatus
+}
+
+// retainer is the running retention job, nil if there's nothing to retain
+var retainer *retention
+
+// setupRetention starts rolling up and deleting old points in every SQLite sink, i.e.
+//
+//	db:
+//	  retention:
+//	    enabled: true
+//	    interval: 1h # how often the job runs
+//	    rollup_after: 10m # roll windows up once they're this old
+//	    raw: 168h # delete raw points after a week
+//	    minute: 2160h # delete 1 minute rollups after 90 days
+//	    hour: 0s # keep hourly rollups forever
+//
+// Raw numeric points are rolled into 1 minute windows, which are rolled into 1 hour windows,
+// each keeping the min, max, mean and last value. Nothing is deleted before it's rolled up.
+func setupRetention(c *core.Core, database *Database) {
+	if c.Settings.IsSet("db.retention.enabled") && !c.Settings.GetBool("db.retention.enabled") {
+		log.Info().Msg("Database retention is disabled")
+		return
+	}
+
+	r := &retention{
+		policy: RetentionPolicy{
+			RollupAfter: defaultRollupAfter,
+			Raw:         defaultRawRetention,
+			Minute:      defaultMinuteRetention,
+		},
+		interval: defaultRetentionInterval,
+		trigger:  make(chan struct{}, 1),
+	}
+	for _, sink := range database.Sinks() {
+		if b, ok := sink.(*Buffer); ok {
+			sink = b.sink
+		}
+		if s, ok := sink.(*SQLite); ok {
+			r.sinks = append(r.sinks, s)
+			r.status.Sinks = append(r.status.Sinks, s.Name())
+		}
+	}
+	if len(r.sinks) == 0 {
+		return
+	}
+
+	if c.Settings.IsSet("db.retention.interval") {
+		r.interval = c.Settings.GetDuration("db.retention.interval")
+	}
+	if c.Settings.IsSet("db.retention.rollup_after") {
+		r.policy.RollupAfter = c.Settings.GetDuration("db.retention.rollup_after")
+	}
+	if c.Settings.IsSet("db.retention.raw") {
+		r.policy.Raw = c.Settings.GetDuration("db.retention.raw")
+	}
+	if c.Settings.IsSet("db.retention.minute") {
+		r.policy.Minute = c.Settings.GetDuration("db.retention.minute")
+	}
+	if c.Settings.IsSet("db.retention.hour") {
+		r.policy.Hour = c.Settings.GetDuration("db.retention.hour")
+	}
+	if r.interval <= 0 {
+		r.interval = defaultRetentionInterval
+	}
+
+	r.status.Interval = r.interval.String()
+	r.status.RollupAfter = r.policy.RollupAfter.String()
+	r.status.Raw = retentionString(r.policy.Raw)
+	r.status.Minute = retentionString(r.policy.Minute)
+	r.status.Hour = retentionString(r.policy.Hour)
+	r.status.NextRun = time.Now().Add(retentionDelay)
+
+	retainer = r
+	log.Info().Msgf("Rolling up database sinks %s every %s", strings.Join(r.status.Sinks, ", "), r.interval.String())
+	go r.run()
+}
+
+// retentionString describes how long something is kept
+func retentionString(d time.Duration) string {
+	if d <= 0 {
+		return "forever"
+	}
+	return d.String()
+}
+
+// run applies the policy on every interval, or when triggered
+func (r *retention) run() {
+	timer := time.NewTimer(retentionDelay)
+	for {
+		select {
+		case <-timer.C:
+		case <-r.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		r.apply(time.Now())
+		timer.Reset(r.interval)
+	}
+}
+
+// Run the job as soon as possible, unless it's already waiting to
+func (r *retention) Run() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status of the job
+func (r *retention) Status() RetentionStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.status
+	status.Sinks = append([]string{}, r.status.Sinks...)
+	return status
+}
+
+// apply the policy to every sink
+func (r *retention) apply(now time.Time) {
+	r.mutex.Lock()
+	r.status.Running = true
+	r.mutex.Unlock()
+
+	var (
+		total  retentionResult
+		errors []string
+	)
+	for _, sink := range r.sinks {
+		result, err := sink.applyRetention(r.policy, now)
+		total.rolled += result.rolled
+		total.deleted += result.deleted
+		total.filesRemoved += result.filesRemoved
+		if err != nil {
+			log.Error().Msgf("Failed to apply retention to database sink %s: %s", sink.Name(), err.Error())
+			errors = append(errors, fmt.Sprintf("%s: %s", sink.Name(), err.Error()))
+		}
+	}
+	log.Info().Msgf("Database retention rolled up %d windows, deleted %d rows and %d files", total.rolled, total.deleted, total.filesRemoved)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.status.Running = false
+	r.status.LastRun = now
+	r.status.LastDuration = time.Since(now).String()
+	r.status.LastError = strings.Join(errors, "; ")
+	r.status.NextRun = time.Now().Add(r.interval)
+	r.status.Rolled = total.rolled
+	r.status.Deleted = total.deleted
+	r.status.FilesRemoved = total.filesRemoved
+}
+
+// GetRetention responds with the retention job's status
+func GetRetention(w http.ResponseWriter, r *http.Request) {
+	if retainer == nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Retention is disabled", OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: retainer.Status(), OK: true})
+}
+
+// RunRetention starts the retention job now rather than waiting for its interval
+func RunRetention(w http.ResponseWriter, r *http.Request) {
+	if retainer == nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Retention is disabled", OK: false})
+		return
+	}
+	retainer.Run()
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+}
+
+// applyRetention rolls up and deletes old points in every file, removing files left empty
+func (database *SQLite) applyRetention(policy RetentionPolicy, now time.Time) (retentionResult, error) {
+	var total retentionResult
+
+	database.mutex.Lock()
+	files, err := database.files()
+	database.mutex.Unlock()
+	if err != nil {
+		return total, err
+	}
+
+	// Each file is locked on its own so writes aren't held up for the whole run
+	for _, file := range files {
+		result, err := database.retainFile(file.path, policy, now)
+		total.rolled += result.rolled
+		total.deleted += result.deleted
+		total.filesRemoved += result.filesRemoved
+		if err != nil {
+			return total, fmt.Errorf("%s: %s", file.path, err.Error())
+		}
+	}
+	return total, nil
+}
+
+// retainFile applies a policy to one file
+func (database *SQLite) retainFile(file string, policy RetentionPolicy, now time.Time) (retentionResult, error) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	var result retentionResult
+	conn := database.conn
+	current := file == database.file && conn != nil
+	// Rolling up and deleting changes the times the file holds
+	delete(database.ranges, file)
+	if !current {
+		var err error
+		conn, err = sql.Open("sqlite3", file)
+		if err != nil {
+			return result, err
+		}
+		defer conn.Close()
+		if err := migrate(conn); err != nil {
+			return result, err
+		}
+	}
+
+	result, empty, err := retain(conn, policy, now)
+	if err != nil {
+		return result, err
+	}
+
+	if empty && !current {
+		conn.Close()
+		if err := os.Remove(file); err != nil {
+			return result, err
+		}
+		os.Remove(file + "-journal")
+		result.filesRemoved++
+		log.Info().Msgf("Removed empty SQLite DB %s", file)
+		return result, nil
+	}
+	if result.deleted > 0 {
+		free, err := freeBytes(conn)
+		if err != nil {
+			return result, err
+		}
+		// Give deleted pages back to the filesystem once there's enough to be worth rewriting the file
+		if free >= vacuumThreshold {
+			if _, err := conn.Exec("VACUUM"); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// freeBytes returns the space taken by a file's free pages, which VACUUM gives back
+func freeBytes(conn *sql.DB) (int64, error) {
+	var pages, pageSize int64
+	if err := conn.QueryRow("PRAGMA freelist_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := conn.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// retain rolls up a file's windows older than the policy allows, then deletes what's past its
+// retention. It reports whether the file has nothing left.
+func retain(conn *sql.DB, policy RetentionPolicy, now time.Time) (retentionResult, bool, error) {
+	var result retentionResult
+	tx, err := conn.Begin()
+	if err != nil {
+		return result, false, err
+	}
+
+	rollupAt := now.Add(-policy.RollupAfter).UnixNano()
+	minutes, minutesUntil, err := rollUp(tx, rollupPointsQuery, MinuteResolution, windowStart(rollupAt, MinuteResolution))
+	if err != nil {
+		tx.Rollback()
+		return result, false, err
+	}
+	hours, hoursUntil, err := rollUp(tx, rollupMinutesQuery, HourResolution, windowStart(minutesUntil, HourResolution))
+	if err != nil {
+		tx.Rollback()
+		return result, false, err
+	}
+	result.rolled = minutes + hours
+
+	deletes := []struct {
+		query     string
+		retention time.Duration
+		rolled    int64
+	}{
+		{"DELETE FROM points WHERE time < ?", policy.Raw, minutesUntil},
+		{fmt.Sprintf("DELETE FROM rollups WHERE resolution = %d AND time < ?", int64(MinuteResolution/time.Second)), policy.Minute, hoursUntil},
+		{fmt.Sprintf("DELETE FROM rollups WHERE resolution = %d AND time < ?", int64(HourResolution/time.Second)), policy.Hour, -1},
+	}
+	for _, d := range deletes {
+		if d.retention <= 0 {
+			continue
+		}
+		// Only delete what's already been rolled up
+		before := now.Add(-d.retention).UnixNano()
+		if d.rolled >= 0 && d.rolled < before {
+			before = d.rolled
+		}
+		deleted, err := tx.Exec(d.query, before)
+		if err != nil {
+			tx.Rollback()
+			return result, false, err
+		}
+		n, _ := deleted.RowsAffected()
+		result.deleted += n
+	}
+
+	var empty bool
+	if err := tx.QueryRow("SELECT NOT EXISTS (SELECT 1 FROM points) AND NOT EXISTS (SELECT 1 FROM rollups)").Scan(&empty); err != nil {
+		tx.Rollback()
+		return result, false, err
+	}
+	return result, empty, tx.Commit()
+}
+
+// rollupPointsQuery rolls numeric points into windows, booleans count as 0 or 1.
+// Its parameters are the resolution in seconds, in nanoseconds, then the range of windows.
+const rollupPointsQuery = `INSERT OR REPLACE INTO rollups (series_id, resolution, time, min, max, mean, last, count)
+	SELECT series_id, ?1, window, MIN(value), MAX(value), AVG(value),
+		(SELECT COALESCE(p.float_value, p.int_value, p.bool_value) FROM points p
+			WHERE p.series_id = v.series_id AND p.time >= v.window AND p.time < v.window + ?2
+				AND COALESCE(p.float_value, p.int_value, p.bool_value) IS NOT NULL
+			ORDER BY p.time DESC LIMIT 1),
+		COUNT(*)
+	FROM (SELECT series_id, time / ?2 * ?2 AS window, COALESCE(float_value, int_value, bool_value) AS value
+		FROM points WHERE time >= ?3 AND time < ?4) v
+	WHERE value IS NOT NULL
+	GROUP BY series_id, window`
+
+// rollupMinutesQuery rolls minute windows into longer ones, with the same parameters
+const rollupMinutesQuery = `INSERT OR REPLACE INTO rollups (series_id, resolution, time, min, max, mean, last, count)
+	SELECT series_id, ?1, window, MIN(min), MAX(max), SUM(mean * count) / SUM(count),
+		(SELECT r.last FROM rollups r
+			WHERE r.series_id = m.series_id AND r.resolution = 60 AND r.time >= m.window AND r.time < m.window + ?2
+			ORDER BY r.time DESC LIMIT 1),
+		SUM(count)
+	FROM (SELECT series_id, time / ?2 * ?2 AS window, min, max, mean, count
+		FROM rollups WHERE resolution = 60 AND time >= ?3 AND time < ?4) m
+	GROUP BY series_id, window`
+
+// rollUp writes every window from where the last run stopped until a time, returning how many
+// windows were written and where this run stopped
+func rollUp(tx *sql.Tx, query string, resolution time.Duration, until int64) (int64, int64, error) {
+	seconds := int64(resolution / time.Second)
+	var rolledUntil int64
+	err := tx.QueryRow("SELECT rolled_until FROM rollup_state WHERE resolution = ?", seconds).Scan(&rolledUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, 0, err
+	}
+	if until <= rolledUntil {
+		return 0, rolledUntil, nil
+	}
+
+	result, err := tx.Exec(query, seconds, int64(resolution), rolledUntil, until)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO rollup_state (resolution, rolled_until) VALUES (?, ?)", seconds, until); err != nil {
+		return 0, 0, err
+	}
+	rolled, _ := result.RowsAffected()
+	return rolled, until, nil
+}
+
+// windowStart of the window a Unix nanosecond timestamp falls in
+func windowStart(timestamp int64, resolution time.Duration) int64 {
+	return timestamp / int64(resolution) * int64(resolution)
+}
+
+// rollupWindow is one window of a series as stored in a file
+type rollupWindow struct {
+	tags                 string
+	field                string
+	time                 int64
+	min, max, mean, last sql.NullFloat64
+	count                int64
+}
+
+// merge a window from a later file into this one. A window is split across files when the
+// sink starts a new file partway through it.
+func (w *rollupWindow) merge(later rollupWindow) {
+	if later.min.Valid && (!w.min.Valid || later.min.Float64 < w.min.Float64) {
+		w.min = later.min
+	}
+	if later.max.Valid && (!w.max.Valid || later.max.Float64 > w.max.Float64) {
+		w.max = later.max
+	}
+	if later.mean.Valid && w.mean.Valid && w.count+later.count > 0 {
+		w.mean.Float64 = (w.mean.Float64*float64(w.count) + later.mean.Float64*float64(later.count)) / float64(w.count+later.count)
+	} else if later.mean.Valid {
+		w.mean = later.mean
+	}
+	// The later file was written after, so holds the newest value
+	if later.last.Valid {
+		w.last = later.last
+	}
+	w.count += later.count
+}
+
+// QueryRollups returns the windows of a measurement starting from (inclusive) to (exclusive), oldest first.
+// Windows split across files are merged.
+func (database *SQLite) QueryRollups(measurement string, from time.Time, to time.Time, resolution time.Duration) ([]Point, error) {
+	var (
+		windows []*rollupWindow
+		byKey   = make(map[string]*rollupWindow)
+	)
+	err := database.read(from, to, func(conn *sql.DB) error {
+		var version int
+		if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			return err
+		}
+		if version < 2 {
+			// Written before rollups, and retention hasn't reached it yet
+			return nil
+		}
+		fileWindows, err := sqliteRollups(conn, measurement, from, to, resolution)
+		if err != nil {
+			return err
+		}
+		for i := range fileWindows {
+			w := &fileWindows[i]
+			key := fmt.Sprintf("%s\x00%s\x00%d", w.tags, w.field, w.time)
+			if existing, ok := byKey[key]; ok {
+				existing.merge(*w)
+				continue
+			}
+			byKey[key] = w
+			windows = append(windows, w)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]Point, 0, len(windows))
+	for _, w := range windows {
+		p := Point{Measurement: measurement, Fields: make(map[string]interface{}, 4), Time: time.Unix(0, w.time)}
+		if err := json.Unmarshal([]byte(w.tags), &p.Tags); err != nil {
+			return nil, err
+		}
+		for suffix, value := range map[string]sql.NullFloat64{"min": w.min, "max": w.max, "mean": w.mean, "last": w.last} {
+			if value.Valid {
+				p.Fields[w.field+"_"+suffix] = value.Float64
+			}
+		}
+		points = append(points, p)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// sqliteRollups reads one file's windows of a measurement
+func sqliteRollups(conn *sql.DB, measurement string, from time.Time, to time.Time, resolution time.Duration) ([]rollupWindow, error) {
+	rows, err := conn.Query(`SELECT series.tags, series.field, rollups.time,
+			rollups.min, rollups.max, rollups.mean, rollups.last, rollups.count
+		FROM rollups JOIN series ON series.id = rollups.series_id
+		WHERE series.measurement = ? AND rollups.resolution = ? AND rollups.time >= ? AND rollups.time < ?
+		ORDER BY rollups.time`, measurement, int64(resolution/time.Second), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []rollupWindow
+	for rows.Next() {
+		var w rollupWindow
+		if err := rows.Scan(&w.tags, &w.field, &w.time, &w.min, &w.max, &w.mean, &w.last, &w.count); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// expectWindows checks a sink's rollups of the value field, one map of min, max, mean and last per window
+func expectWindows(t *testing.T, database *SQLite, resolution time.Duration, expected map[time.Duration]map[string]float64) {
+	points, err := database.QueryRollups("value", testStart, testStart.Add(24*time.Hour), resolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("Expected %d windows at %s, got %+v", len(expected), resolution, points)
+	}
+	for _, p := range points {
+		fields, ok := expected[p.Time.Sub(testStart)]
+		if !ok {
+			t.Fatalf("Unexpected window at %s", p.Time)
+		}
+		if p.Tags["source"] != "test" {
+			t.Fatalf("Expected the window's tags, got %+v", p.Tags)
+		}
+		for field, value := range fields {
+			if p.Fields["value_"+field] != value {
+				t.Fatalf("Expected the %s window at %s to have a %s of %v, got %+v", resolution, p.Time, field, value, p.Fields)
+			}
+		}
+	}
+}
+
+func expectResult(t *testing.T, result retentionResult, rolled int64, deleted int64, filesRemoved int) {
+	if result.rolled != rolled || result.deleted != deleted || result.filesRemoved != filesRemoved {
+		t.Fatalf("Expected %d rolled, %d deleted and %d files removed, got %+v", rolled, deleted, filesRemoved, result)
+	}
+}
+
+func TestRetentionRollsUpAndDeletes(t *testing.T) {
+	database := newTestSQLite(t, t.TempDir(), 0)
+	err := database.Write([]Point{
+		valuePoint(0, 1.0),
+		valuePoint(20*time.Second, int64(5)),
+		valuePoint(40*time.Second, 3.0),
+		valuePoint(50*time.Second, "text"),
+		valuePoint(70*time.Second, 10.0),
+		valuePoint(90*time.Second, true),
+		valuePoint(90*time.Minute, 4.0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows before an hour in are rolled up, the point at 90m is past raw retention but isn't rolled up yet
+	policy := RetentionPolicy{RollupAfter: 2 * time.Hour, Raw: time.Hour}
+	now := testStart.Add(3 * time.Hour)
+	result, err := database.applyRetention(policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, result, 3, 6, 0)
+
+	// Text isn't rolled up, booleans count as 0 or 1
+	expectWindows(t, database, MinuteResolution, map[time.Duration]map[string]float64{
+		0:           {"min": 1, "max": 5, "mean": 3, "last": 3},
+		time.Minute: {"min": 1, "max": 10, "mean": 5.5, "last": 1},
+	})
+	expectWindows(t, database, HourResolution, map[time.Duration]map[string]float64{
+		0: {"min": 1, "max": 10, "mean": 4, "last": 1},
+	})
+	points, err := database.Query("value", testStart, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || !points[0].Time.Equal(testStart.Add(90*time.Minute)) {
+		t.Fatalf("Expected only the point that wasn't rolled up to be kept, got %+v", points)
+	}
+
+	// Running again at the same time changes nothing
+	result, err = database.applyRetention(policy, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, result, 0, 0, 0)
+
+	// An hour later the last point is rolled up and deleted, and minutes are deleted once they're in an hour
+	policy.Minute = time.Hour
+	result, err = database.applyRetention(policy, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, result, 2, 4, 0)
+	expectWindows(t, database, MinuteResolution, nil)
+	expectWindows(t, database, HourResolution, map[time.Duration]map[string]float64{
+		0:         {"min": 1, "max": 10, "mean": 4, "last": 1},
+		time.Hour: {"min": 4, "max": 4, "mean": 4, "last": 4},
+	})
+	if points, err := database.Query("value", testStart, now); err != nil || len(points) != 0 {
+		t.Fatalf("Expected every point to be deleted, got %+v: %v", points, err)
+	}
+}
+
+func TestRetentionMergesWindowsAcrossFiles(t *testing.T) {
+	database := newTestSQLite(t, t.TempDir(), 1)
+
+	// The sink starts a new file partway through the first minute
+	if err := database.Write([]Point{valuePoint(0, 1.0)}); err != nil {
+		t.Fatal(err)
+	}
+	err := database.Write([]Point{
+		valuePoint(20*time.Second, 5.0),
+		valuePoint(40*time.Second, 3.0),
+		valuePoint(50*time.Second, 7.0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := database.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected the empty first file and one for each write, got %+v", files)
+	}
+
+	// Both files roll up their part of the minute and hour, and the empty first file is removed
+	result, err := database.applyRetention(RetentionPolicy{Raw: time.Hour}, testStart.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectResult(t, result, 4, 4, 1)
+	if files, err := database.files(); err != nil || len(files) != 2 {
+		t.Fatalf("Expected two files to be left, got %+v: %v", files, err)
+	}
+	if points, err := database.Query("value", testStart, testStart.Add(time.Hour)); err != nil || len(points) != 0 {
+		t.Fatalf("Expected every point to be deleted, got %+v: %v", points, err)
+	}
+
+	// The mean is weighted by each file's count, not the mean of the files' means, and last comes from the later file
+	merged := map[time.Duration]map[string]float64{
+		0: {"min": 1, "max": 7, "mean": 4, "last": 7},
+	}
+	expectWindows(t, database, MinuteResolution, merged)
+	expectWindows(t, database, HourResolution, merged)
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+)
+
+// Sink stores points somewhere, i.e. a time series database or a file
+type Sink interface {
+	// Name identifies the sink in logs and the session
+	Name() string
+	// Write stores points in order
+	Write(points []Point) error
+	// Ping returns an error if the sink can't currently be written to
+	Ping() error
+	Close() error
+}
+
+// newSink creates the sink configured under db.sinks.<name>
+func newSink(c *core.Core, name string) (Sink, error) {
+	key := fmt.Sprintf("db.sinks.%s", name)
+	sinkType := strings.ToLower(c.Settings.GetString(key + ".type"))
+
+	precision, err := parsePrecision(c.Settings.GetString(key + ".precision"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Influx payloads are gzipped unless turned off
+	compress := true
+	if c.Settings.IsSet(key + ".gzip") {
+		compress = c.Settings.GetBool(key + ".gzip")
+	}
+
+	var sink Sink
+	switch sinkType {
+	case "influx", "influxdb", "influx1":
+		sink, err = newInfluxV1(name, c.Settings.GetString(key+".host"), c.Settings.GetString(key+".database"), precision, compress)
+	case "influx2", "influxdb2":
+		sink, err = newInfluxV2(name,
+			c.Settings.GetString(key+".host"),
+			c.Settings.GetString(key+".org"),
+			c.Settings.GetString(key+".bucket"),
+			c.Settings.GetString(key+".token"),
+			precision,
+			compress)
+	case "sqlite":
+		daily := true
+		if c.Settings.IsSet(key + ".daily") {
+			daily = c.Settings.GetBool(key + ".daily")
+		}
+		maxSize, sizeErr := parseSize(c.Settings.GetString(key+".max_size"), 0)
+		if sizeErr != nil {
+			return nil, sizeErr
+		}
+		sink, err = newSQLite(name, c.Settings.GetString(key+".path"), daily, maxSize)
+	case "csv":
+		sink, err = newCSV(name, c.Settings.GetString(key+".path"))
+	default:
+		return nil, fmt.Errorf("unknown sink type %s", sinkType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Network sinks are buffered on disk by default, local ones write straight through
+	buffered := sinkType != "sqlite" && sinkType != "csv"
+	if c.Settings.IsSet(key + ".buffer") {
+		buffered = c.Settings.GetBool(key + ".buffer")
+	}
+	if !buffered {
+		return sink, nil
+	}
+	return bufferSink(c, sink)
+}
+
+// bufferSink wraps a sink in a write-ahead buffer configured under db.buffer
+func bufferSink(c *core.Core, sink Sink) (Sink, error) {
+	dir := c.Settings.GetString("db.buffer.dir")
+	if dir == "" {
+		dir = defaultBufferDir
+	}
+	maxSize, err := parseSize(c.Settings.GetString("db.buffer.max_size"), defaultBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	drop := DropPolicy(strings.ToLower(c.Settings.GetString("db.buffer.drop")))
+	if drop == "" {
+		drop = DropOldest
+	}
+	return newBuffer(c, sink, dir, maxSize, drop)
+}
+
+// parseSize reads sizes like 64MB, 512KB or a number of bytes, returning fallback if it isn't set
+func parseSize(size string, fallback int64) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return fallback, nil
+	}
+
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(size, suffix) {
+			multiplier = m
+			size = strings.TrimSpace(strings.TrimSuffix(size, suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(size, "B"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return n * multiplier, nil
+}
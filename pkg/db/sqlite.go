@@ -2,7 +2,17 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	// For SQLite functionality
@@ -10,48 +20,522 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// SQLiteInit creates a new SQLite connection
-func (database *Database) SQLiteInit() (string, error) {
-	var err error
+// defaultSQLiteDir is where SQLite files are kept if a sink doesn't set a path
+const defaultSQLiteDir = "/home/pi/MDroid/logs/core/dbs"
+
+// sqliteMigrations bring a file's schema up to date, the file's user_version is how many have been applied.
+// Only ever append to this list.
+var sqliteMigrations = []string{
+	// Each series is a measurement, its tags as a JSON object and one of its fields
+	`CREATE TABLE series (
+		id          INTEGER PRIMARY KEY,
+		measurement TEXT NOT NULL,
+		tags        TEXT NOT NULL,
+		field       TEXT NOT NULL,
+		UNIQUE (measurement, tags, field)
+	);
+	CREATE INDEX series_measurement ON series (measurement);
+
+	-- Values are stored in the column matching their type, timestamps are Unix nanoseconds
+	CREATE TABLE points (
+		series_id    INTEGER NOT NULL REFERENCES series (id),
+		time         INTEGER NOT NULL,
+		int_value    INTEGER,
+		float_value  REAL,
+		string_value TEXT,
+		bool_value   INTEGER
+	);
+	CREATE INDEX points_series_time ON points (series_id, time);
+	CREATE INDEX points_time ON points (time);`,
+
+	// Numeric points rolled into windows of resolution seconds, see retention.go
+	`CREATE TABLE rollups (
+		series_id  INTEGER NOT NULL REFERENCES series (id),
+		resolution INTEGER NOT NULL,
+		time       INTEGER NOT NULL,
+		min        REAL,
+		max        REAL,
+		mean       REAL,
+		last       REAL,
+		count      INTEGER NOT NULL,
+		PRIMARY KEY (series_id, resolution, time)
+	);
+	CREATE INDEX rollups_resolution_time ON rollups (resolution, time);
+
+	-- Windows before rolled_until have been rolled up at each resolution
+	CREATE TABLE rollup_state (
+		resolution   INTEGER PRIMARY KEY,
+		rolled_until INTEGER NOT NULL
+	);`,
+}
+
+// sqliteFileName matches the rest of a file's name after its sink's base, i.e. -2020-05-01.2.db
+var sqliteFileName = regexp.MustCompile(`^(?:-(\d{4}-\d{2}-\d{2}))?(?:\.(\d+))?\.db$`)
+
+// sqliteFile is one of a sink's files, identified by the day it was started and its number that day
+type sqliteFile struct {
+	path string
+	day  string
+	n    int
+}
+
+// timeRange is the span of times a file holds, from its oldest point or window to its newest
+type timeRange struct {
+	from  int64
+	to    int64
+	empty bool
+}
+
+// SQLite stores points in local database files, starting a new file every day or
+// once the current file grows past its maximum size
+type SQLite struct {
+	name string
+	// Dir holds every file, named <Base>-<day>.db, then <Base>-<day>.1.db and so on once they fill up
+	Dir     string
+	Base    string
+	Daily   bool
+	MaxSize int64
+
+	mutex  sync.Mutex
+	conn   *sql.DB
+	file   string
+	day    string
+	series map[string]int64
+	// ranges of files other than the current one, which only change when retention runs
+	ranges map[string]timeRange
+}
+
+// newSQLite creates a sink writing to files in a directory, or named after a .db path
+func newSQLite(name string, path string, daily bool, maxSize int64) (*SQLite, error) {
+	database := &SQLite{name: name, Dir: path, Base: name, Daily: daily, MaxSize: maxSize, ranges: make(map[string]timeRange)}
+	if path == "" {
+		database.Dir = defaultSQLiteDir
+	} else if filepath.Ext(path) == ".db" {
+		database.Dir = filepath.Dir(path)
+		database.Base = strings.TrimSuffix(filepath.Base(path), ".db")
+	}
+	if err := os.MkdirAll(database.Dir, 0755); err != nil {
+		return nil, err
+	}
+
 	database.mutex.Lock()
 	defer database.mutex.Unlock()
+	if err := database.roll(); err != nil {
+		return nil, err
+	}
+	return database, nil
+}
 
-	// TODO: make this a setting
-	filename := fmt.Sprintf("/home/pi/MDroid/logs/core/dbs/%s.db", time.Now().Local().String())
+// Name of the sink
+func (database *SQLite) Name() string {
+	return database.name
+}
+
+// Ping checks the current file is open
+func (database *SQLite) Ping() error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	if database.conn == nil {
+		return fmt.Errorf("SQLite database %s is closed", database.file)
+	}
+	return database.conn.Ping()
+}
+
+// Write points to the current file, one row per field
+func (database *SQLite) Write(points []Point) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	if err := database.roll(); err != nil {
+		return err
+	}
 
-	database.sqlconn, err = sql.Open("sqlite3", filename)
+	tx, err := database.conn.Begin()
 	if err != nil {
-		return filename, err
+		return err
 	}
-	statement, err := database.sqlconn.Prepare("CREATE TABLE IF NOT EXISTS vehicle (id INTEGER PRIMARY KEY, timestamp INTEGER, msg TEXT)")
+	insert, err := tx.Prepare("INSERT INTO points (series_id, time, int_value, float_value, string_value, bool_value) VALUES (?, ?, ?, ?, ?, ?)")
 	if err != nil {
-		return filename, err
+		tx.Rollback()
+		return err
+	}
+	defer insert.Close()
+
+	// Series created by a rolled back transaction don't exist
+	created := make(map[string]int64)
+	for _, p := range points {
+		tags, err := json.Marshal(p.Tags)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if p.Tags == nil {
+			tags = []byte("{}")
+		}
+
+		for field, value := range p.Fields {
+			values, err := sqliteValues(value)
+			if err != nil {
+				tx.Rollback()
+				return fmt.Errorf("%s field %s: %s", p.Measurement, field, err.Error())
+			}
+			id, err := database.seriesID(tx, created, p.Measurement, string(tags), field)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if _, err := insert.Exec(append([]interface{}{id, p.Time.UnixNano()}, values...)...); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
 	}
-	statement.Exec()
-	statement.Close()
-	database.Started = true
 
-	database.sqlinsert, err = database.sqlconn.Prepare("INSERT INTO vehicle (timestamp, msg) VALUES (?, ?)")
-	return filename, nil
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for key, id := range created {
+		database.series[key] = id
+	}
+	return nil
+}
+
+// Query returns every point of a measurement from (inclusive) to (exclusive), oldest first,
+// looking through every file this sink has written. Each point holds a single field.
+func (database *SQLite) Query(measurement string, from time.Time, to time.Time) ([]Point, error) {
+	var points []Point
+	err := database.read(from, to, func(conn *sql.DB) error {
+		filePoints, err := sqliteQuery(conn, measurement, from, to)
+		points = append(points, filePoints...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
 }
 
-// SQLitePing database server for connectivity
-func (database *Database) SQLitePing() (bool, error) {
-	// Ping database instance
-	return database.sqlconn != nil, nil
+// read runs a query against every file holding times from (inclusive) to (exclusive), in the order
+// they were written. Files other than the current one are opened read only.
+func (database *SQLite) read(from time.Time, to time.Time, query func(conn *sql.DB) error) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	files, err := database.files()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		conn := database.conn
+		if file.path != database.file {
+			r, err := database.fileRange(file.path)
+			if err != nil {
+				return fmt.Errorf("%s: %s", file.path, err.Error())
+			}
+			if r.empty || r.to < from.UnixNano() || r.from >= to.UnixNano() {
+				continue
+			}
+
+			conn, err = sql.Open("sqlite3", "file:"+file.path+"?mode=ro")
+			if err != nil {
+				return err
+			}
+		}
+		err := query(conn)
+		if conn != database.conn {
+			conn.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file.path, err.Error())
+		}
+	}
+	return nil
 }
 
-// SQLiteWrite to SQLite database server with data pairs
-func (database *Database) SQLiteWrite(msg string) error {
-	// Check for positive ping response first.
-	if !database.Started {
-		log.Info().Msg("DB is closed, reopening...")
-		database.SQLiteInit()
+// fileRange returns the times a file other than the current one holds, only opening it
+// the first time or once retention has changed it. The mutex must be held.
+func (database *SQLite) fileRange(file string) (timeRange, error) {
+	if r, ok := database.ranges[file]; ok {
+		return r, nil
 	}
 
-	_, err := database.sqlinsert.Exec(time.Now().Local().Nanosecond(), msg)
+	conn, err := sql.Open("sqlite3", "file:"+file+"?mode=ro")
+	if err != nil {
+		return timeRange{}, err
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return timeRange{}, err
+	}
+	query := "SELECT MIN(time), MAX(time) FROM points"
+	if version >= 2 {
+		query = "SELECT MIN(time), MAX(time) FROM (SELECT time FROM points UNION ALL SELECT time FROM rollups)"
+	}
+
+	var from, to sql.NullInt64
+	if err := conn.QueryRow(query).Scan(&from, &to); err != nil {
+		return timeRange{}, err
+	}
+	r := timeRange{from: from.Int64, to: to.Int64, empty: !from.Valid}
+	database.ranges[file] = r
+	return r, nil
+}
+
+// Close the current file
+func (database *SQLite) Close() error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+	if database.conn == nil {
+		return nil
+	}
+	err := database.conn.Close()
+	database.conn = nil
+	return err
+}
+
+// roll opens the file points should currently be written to, the mutex must be held
+func (database *SQLite) roll() error {
+	day := ""
+	if database.Daily {
+		day = time.Now().Format("2006-01-02")
+	}
+
+	file := database.file
+	if database.conn == nil || day != database.day {
+		file = database.latestFile(day)
+	} else if database.MaxSize > 0 {
+		info, err := os.Stat(database.file)
+		if err != nil {
+			return err
+		}
+		if info.Size() >= database.MaxSize {
+			file = database.nextFile(day)
+		}
+	}
+	if file == database.file && database.conn != nil {
+		return nil
+	}
+
+	if database.conn != nil {
+		database.conn.Close()
+		database.conn = nil
+	}
+	conn, err := sql.Open("sqlite3", file)
 	if err != nil {
 		return err
 	}
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to migrate %s: %s", file, err.Error())
+	}
+
+	database.conn = conn
+	database.file = file
+	database.day = day
+	database.series = make(map[string]int64)
+	delete(database.ranges, file)
+	log.Info().Msgf("Using SQLite DB at %s", file)
 	return nil
 }
+
+// fileName for the nth file of a day
+func (database *SQLite) fileName(day string, n int) string {
+	name := database.Base
+	if day != "" {
+		name += "-" + day
+	}
+	if n > 0 {
+		name += fmt.Sprintf(".%d", n)
+	}
+	return filepath.Join(database.Dir, name+".db")
+}
+
+// latestFile returns the last file started on a day, so a restart keeps appending to it
+func (database *SQLite) latestFile(day string) string {
+	n := 0
+	for {
+		if _, err := os.Stat(database.fileName(day, n+1)); err != nil {
+			return database.fileName(day, n)
+		}
+		n++
+	}
+}
+
+// nextFile returns the file after the latest of a day
+func (database *SQLite) nextFile(day string) string {
+	n := 0
+	for {
+		if _, err := os.Stat(database.fileName(day, n)); err != nil {
+			return database.fileName(day, n)
+		}
+		n++
+	}
+}
+
+// files returns every file this sink has written, oldest first
+func (database *SQLite) files() ([]sqliteFile, error) {
+	infos, err := ioutil.ReadDir(database.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []sqliteFile
+	for _, info := range infos {
+		// Other sinks' files may start with this one's base, i.e. points-gps.db next to points-2020-05-01.db
+		if info.IsDir() || !strings.HasPrefix(info.Name(), database.Base) {
+			continue
+		}
+		parts := sqliteFileName.FindStringSubmatch(strings.TrimPrefix(info.Name(), database.Base))
+		if parts == nil {
+			continue
+		}
+		file := sqliteFile{path: filepath.Join(database.Dir, info.Name()), day: parts[1]}
+		if parts[2] != "" {
+			file.n, _ = strconv.Atoi(parts[2])
+		}
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].day != files[j].day {
+			return files[i].day < files[j].day
+		}
+		return files[i].n < files[j].n
+	})
+	return files, nil
+}
+
+// seriesID finds or creates a series, the mutex must be held
+func (database *SQLite) seriesID(tx *sql.Tx, created map[string]int64, measurement string, tags string, field string) (int64, error) {
+	key := measurement + "\x00" + tags + "\x00" + field
+	if id, ok := database.series[key]; ok {
+		return id, nil
+	}
+	if id, ok := created[key]; ok {
+		return id, nil
+	}
+
+	var id int64
+	err := tx.QueryRow("SELECT id FROM series WHERE measurement = ? AND tags = ? AND field = ?", measurement, tags, field).Scan(&id)
+	if err == sql.ErrNoRows {
+		var result sql.Result
+		result, err = tx.Exec("INSERT INTO series (measurement, tags, field) VALUES (?, ?, ?)", measurement, tags, field)
+		if err == nil {
+			id, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	created[key] = id
+	return id, nil
+}
+
+// migrate applies any migrations a file is missing
+func migrate(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteValues places a field value in its typed column: int, float, string or bool
+func sqliteValues(value interface{}) ([]interface{}, error) {
+	values := make([]interface{}, 4)
+	switch vv := value.(type) {
+	case bool:
+		values[3] = vv
+	case string:
+		values[2] = vv
+	case float32:
+		values[1] = float64(vv)
+	case float64:
+		if math.IsNaN(vv) || math.IsInf(vv, 0) {
+			return nil, fmt.Errorf("%v is not a valid float", vv)
+		}
+		values[1] = vv
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		values[0] = vv
+	case uint:
+		if uint64(vv) > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows a signed integer", vv)
+		}
+		values[0] = int64(vv)
+	case uint64:
+		if vv > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows a signed integer", vv)
+		}
+		values[0] = int64(vv)
+	default:
+		return nil, fmt.Errorf("Cannot process type %T of %v", value, value)
+	}
+	return values, nil
+}
+
+// sqliteQuery reads one file's points of a measurement
+func sqliteQuery(conn *sql.DB, measurement string, from time.Time, to time.Time) ([]Point, error) {
+	rows, err := conn.Query(`SELECT series.tags, series.field, points.time,
+			points.int_value, points.float_value, points.string_value, points.bool_value
+		FROM points JOIN series ON series.id = points.series_id
+		WHERE series.measurement = ? AND points.time >= ? AND points.time < ?
+		ORDER BY points.time`, measurement, from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var (
+			tags, field string
+			timestamp   int64
+			intValue    sql.NullInt64
+			floatValue  sql.NullFloat64
+			stringValue sql.NullString
+			boolValue   sql.NullBool
+		)
+		if err := rows.Scan(&tags, &field, &timestamp, &intValue, &floatValue, &stringValue, &boolValue); err != nil {
+			return nil, err
+		}
+
+		p := Point{Measurement: measurement, Fields: make(map[string]interface{}, 1), Time: time.Unix(0, timestamp)}
+		if err := json.Unmarshal([]byte(tags), &p.Tags); err != nil {
+			return nil, err
+		}
+		switch {
+		case intValue.Valid:
+			p.Fields[field] = intValue.Int64
+		case floatValue.Valid:
+			p.Fields[field] = floatValue.Float64
+		case stringValue.Valid:
+			p.Fields[field] = stringValue.String
+		case boolValue.Valid:
+			p.Fields[field] = boolValue.Bool
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
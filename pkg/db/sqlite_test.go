@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStart is a whole hour, so minute and hour windows start on it
+var testStart = time.Date(2020, 5, 1, 18, 0, 0, 0, time.UTC)
+
+// valuePoint is a point of the value measurement at an offset from testStart
+func valuePoint(offset time.Duration, value interface{}) Point {
+	return Point{Measurement: "value", Tags: map[string]string{"source": "test"}, Fields: map[string]interface{}{"value": value}, Time: testStart.Add(offset)}
+}
+
+// newTestSQLite creates a sink in a temporary directory that keeps every write in one file,
+// or starts a new file on every write with a maximum size of 1 byte
+func newTestSQLite(t *testing.T, dir string, maxSize int64) *SQLite {
+	database, err := newSQLite("points", filepath.Join(dir, "points.db"), false, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func userVersion(t *testing.T, conn *sql.DB) int {
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	dir := t.TempDir()
+
+	// A file from before rollups, with a point in it
+	old := filepath.Join(dir, "points.db")
+	conn, err := sql.Open("sqlite3", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userVersion(t, conn) != 0 {
+		t.Fatal("Expected a new file to have no migrations")
+	}
+	for _, statement := range []string{
+		sqliteMigrations[0],
+		"PRAGMA user_version = 1",
+		`INSERT INTO series (measurement, tags, field) VALUES ('value', '{"source":"test"}', 'value')`,
+		"INSERT INTO points (series_id, time, float_value) VALUES (1, " + fmt.Sprint(testStart.UnixNano()) + ", 2.5)",
+	} {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	// Opening the sink brings it up to date, keeping what was there
+	database := newTestSQLite(t, dir, 0)
+	if version := userVersion(t, database.conn); version != len(sqliteMigrations) {
+		t.Fatalf("Expected the file to be migrated to %d, it's at %d", len(sqliteMigrations), version)
+	}
+	if _, err := database.conn.Exec("SELECT count FROM rollups"); err != nil {
+		t.Fatalf("Rollups weren't created: %s", err.Error())
+	}
+	points, err := database.Query("value", testStart, testStart.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1 || points[0].Fields["value"] != 2.5 || points[0].Tags["source"] != "test" {
+		t.Fatalf("Unexpected points after migrating %+v", points)
+	}
+
+	// Migrating again changes nothing
+	if err := migrate(database.conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh file gets every migration
+	fresh, err := sql.Open("sqlite3", filepath.Join(dir, "fresh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if err := migrate(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if version := userVersion(t, fresh); version != len(sqliteMigrations) {
+		t.Fatalf("Expected a fresh file to be at %d, it's at %d", len(sqliteMigrations), version)
+	}
+}
+
+func TestSQLiteRollsBySize(t *testing.T) {
+	dir := t.TempDir()
+	database := newTestSQLite(t, dir, 1)
+
+	values := []interface{}{1.5, int64(2), true, "text"}
+	for i, value := range values {
+		if err := database.Write([]Point{valuePoint(time.Duration(i)*time.Second, value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every write filled its file, so each is in its own
+	files, err := database.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(values)+1 {
+		t.Fatalf("Expected %d files, got %+v", len(values)+1, files)
+	}
+	for i, file := range files {
+		if expected := database.fileName("", i); file.path != expected {
+			t.Fatalf("Expected file %d to be %s, got %s", i, expected, file.path)
+		}
+	}
+
+	points, err := database.Query("value", testStart, testStart.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(values) {
+		t.Fatalf("Expected %d points across files, got %+v", len(values), points)
+	}
+	for i, p := range points {
+		if p.Fields["value"] != values[i] || !p.Time.Equal(testStart.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("Expected point %d to be %v, got %+v", i, values[i], p)
+		}
+	}
+
+	// Files outside the window aren't read
+	if points, err := database.Query("value", testStart.Add(time.Hour), testStart.Add(2*time.Hour)); err != nil || len(points) != 0 {
+		t.Fatalf("Expected no points an hour later, got %+v: %v", points, err)
+	}
+
+	// A restart keeps appending to the latest file
+	database.Close()
+	restarted := newTestSQLite(t, dir, 0)
+	if restarted.file != files[len(files)-1].path {
+		t.Fatalf("Expected to reopen %s, opened %s", files[len(files)-1].path, restarted.file)
+	}
+}
+
+func TestSQLiteDailyFile(t *testing.T) {
+	dir := t.TempDir()
+	today := time.Now().Format("2006-01-02")
+
+	// A day's second file is picked up again after a restart
+	for _, name := range []string{"points-" + today + ".db", "points-" + today + ".1.db"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database, err := newSQLite("points", dir, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if expected := filepath.Join(dir, "points-"+today+".1.db"); database.file != expected {
+		t.Fatalf("Expected to write to %s, got %s", expected, database.file)
+	}
+	if database.day != today {
+		t.Fatalf("Expected the file's day to be %s, got %s", today, database.day)
+	}
+}
+
+func TestSQLiteFileNames(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"points-2020-05-02.db",
+		"points-2020-05-01.10.db",
+		"points-2020-05-01.2.db",
+		"points-2020-05-01.db",
+		"points.db",
+		"points.1.db",
+		// Other sinks and files that only look like this sink's
+		"points-gps.db",
+		"points-gps-2020-05-01.db",
+		"points-2020-05-01.db-journal",
+		"points.db.bak",
+		"points-2020-5-1.db",
+		"other-2020-05-01.db",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	database := newTestSQLite(t, dir, 0)
+	files, err := database.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without a day come first, then by day and number
+	expected := []string{
+		"points.db",
+		"points.1.db",
+		"points-2020-05-01.db",
+		"points-2020-05-01.2.db",
+		"points-2020-05-01.10.db",
+		"points-2020-05-02.db",
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected files %v, got %+v", expected, files)
+	}
+	for i, file := range files {
+		if filepath.Base(file.path) != expected[i] {
+			t.Fatalf("Expected files %v, got %+v", expected, files)
+		}
+	}
+}
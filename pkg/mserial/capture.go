@@ -0,0 +1,121 @@
+package mserial
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// Captures hold one line per read or write, tab separated:
+//
+//	2020-05-01T18:04:05.123456789-04:00	<	"{\"ACC_POWER\": true}"
+//	2020-05-01T18:04:05.923456789-04:00	>	"powerOn:USB_HUB"
+//
+// Lines read from the device are marked with <, lines written to it with >.
+const (
+	captureRead  = "<"
+	captureWrite = ">"
+)
+
+// capture appends a device's traffic to a file
+type capture struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// openCapture opens a capture file for appending
+func openCapture(path string) (*capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{file: file}, nil
+}
+
+// record a single line of traffic, ignored if capturing is disabled
+func (cp *capture) record(direction string, line []byte) {
+	if cp == nil {
+		return
+	}
+
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	_, err := fmt.Fprintf(cp.file, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339Nano), direction, strconv.Quote(string(line)))
+	if err != nil {
+		log.Error().Msgf("Failed to write serial capture: %s", err.Error())
+	}
+}
+
+// captureLine is a single parsed line from a capture file
+type captureLine struct {
+	time      time.Time
+	direction string
+	data      []byte
+}
+
+func parseCaptureLine(line string) (captureLine, error) {
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return captureLine{}, fmt.Errorf("expected 3 tab separated columns, got %d", len(parts))
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return captureLine{}, err
+	}
+	data, err := strconv.Unquote(parts[2])
+	if err != nil {
+		return captureLine{}, err
+	}
+	return captureLine{time: t, direction: parts[1], data: []byte(data)}, nil
+}
+
+// Replay feeds the lines read in a capture file back through a device's parser.
+// Speed scales the original timing, i.e. 2 replays twice as fast. Zero replays as fast as possible.
+func Replay(c *core.Core, d *Device, path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Info().Msgf("Replaying serial capture %s through device %s at %vx speed", path, d.Name, speed)
+	c.Publish(fmt.Sprintf("session.serial.%s.replaying", d.Name), core.Message{Content: true})
+	defer c.Publish(fmt.Sprintf("session.serial.%s.replaying", d.Name), core.Message{Content: false})
+
+	var (
+		previous time.Time
+		lines    int
+		scanner  = bufio.NewScanner(file)
+	)
+	for scanner.Scan() {
+		line, err := parseCaptureLine(scanner.Text())
+		if err != nil {
+			log.Warn().Msgf("Skipping bad line in serial capture %s: %s", path, err.Error())
+			continue
+		}
+
+		// Writes are only kept for context, they're not sent anywhere
+		if line.direction != captureRead {
+			continue
+		}
+
+		if speed > 0 && !previous.IsZero() {
+			time.Sleep(time.Duration(float64(line.time.Sub(previous)) / speed))
+		}
+		previous = line.time
+
+		handleLine(c, d, line.data)
+		lines++
+	}
+
+	log.Info().Msgf("Finished replaying %d lines from serial capture %s", lines, path)
+	return scanner.Err()
+}
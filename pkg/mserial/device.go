@@ -0,0 +1,264 @@
+package mserial
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+	"github.com/tarm/serial"
+)
+
+// Role decides if a device is read from, written to, or both
+type Role string
+
+const (
+	// RoleReader devices only have their lines parsed into the session
+	RoleReader Role = "reader"
+	// RoleWriter devices only have queued messages written to them
+	RoleWriter Role = "writer"
+	// RoleBoth devices are read from and written to
+	RoleBoth Role = "both"
+)
+
+// Device is a named serial port and its write queue
+type Device struct {
+	Name         string
+	Port         string
+	SerialNumber string
+	Baud         int
+	Parity       serial.Parity
+	Role         Role
+	Framed       bool
+	Prefix       string
+
+	parser      Parser
+	capture     *capture
+	simulator   *Simulator
+	replay      string
+	replaySpeed float64
+
+	mutex sync.RWMutex
+	conn  Port
+	// writeLock is held while writing to conn, so only one write is ever on the wire
+	writeLock sync.Mutex
+	queue     *queue
+	replies   map[string]*Message
+}
+
+// defaultBaudrate is used for devices that don't define their own
+const defaultBaudrate = 115200
+
+var (
+	devices     map[string]*Device
+	devicesLock sync.RWMutex
+)
+
+func init() {
+	devices = make(map[string]*Device, 0)
+}
+
+// CanRead returns if the device's lines should be parsed
+func (d *Device) CanRead() bool {
+	return d.Role == RoleReader || d.Role == RoleBoth
+}
+
+// CanWrite returns if messages can be written to the device
+func (d *Device) CanWrite() bool {
+	return d.Role == RoleWriter || d.Role == RoleBoth
+}
+
+// IsConnected returns if the device's port is currently open
+func (d *Device) IsConnected() bool {
+	if d == nil {
+		return false
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.conn != nil
+}
+
+// setConn replaces the open port, publishing the change in connection state
+func (d *Device) setConn(c *core.Core, conn Port) {
+	d.mutex.Lock()
+	d.conn = conn
+	d.mutex.Unlock()
+	c.Publish(fmt.Sprintf("session.serial.%s.connected", d.Name), core.Message{Content: conn != nil})
+}
+
+func (d *Device) getConn() Port {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.conn
+}
+
+// SetSimulator replaces the device's hardware with a simulator, taking effect on its next connection
+func (d *Device) SetSimulator(sim *Simulator) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.simulator = sim
+}
+
+func (d *Device) getSimulator() *Simulator {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.simulator
+}
+
+// Get returns the named serial device, or nil if it isn't configured
+func Get(name string) *Device {
+	devicesLock.RLock()
+	defer devicesLock.RUnlock()
+	return devices[strings.ToLower(name)]
+}
+
+// Devices returns the names of all configured serial devices
+func Devices() []string {
+	devicesLock.RLock()
+	defer devicesLock.RUnlock()
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseDevices reads serial devices from settings, i.e.
+//
+//	serial:
+//	  devices:
+//	    arduino:
+//	      port: /dev/ttyACM0
+//	      serial_number: 55736303831351E0F1A1 # optional, finds the port by USB serial number instead
+//	      baud: 115200
+//	      parity: none
+//	      role: both
+//	      framed: true
+//	      parser: json # or kv, csv, nmea
+//	      header: time,x,y,z # csv only, otherwise the first line read
+//	      prefix: imu # optional, namespaces session keys
+//	      capture: /tmp/arduino.capture # optional, records all traffic
+//	      replay: /tmp/arduino.capture # optional, reads from a capture instead of the port
+//	      replay_speed: 1 # 0 replays as fast as possible
+//	      simulate: true # optional, talks to a simulated Arduino instead of the port
+//	      simulate_imu: 10 # optional, simulated IMU readings per second
+//	      default: true
+//
+// The legacy mdroid.HARDWARE_SERIAL_PORT is used as a read / write device if no others are defined.
+func parseDevices(c *core.Core) ([]*Device, string) {
+	var parsed []*Device
+	defaultWriter := ""
+
+	for name := range c.Settings.GetStringMap("serial.devices") {
+		key := fmt.Sprintf("serial.devices.%s", name)
+		d := &Device{
+			Name:         strings.ToLower(name),
+			Port:         c.Settings.GetString(key + ".port"),
+			SerialNumber: c.Settings.GetString(key + ".serial_number"),
+			Baud:         c.Settings.GetInt(key + ".baud"),
+			Role:         Role(strings.ToLower(c.Settings.GetString(key + ".role"))),
+			Framed:       c.Settings.GetBool(key + ".framed"),
+			Prefix:       c.Settings.GetString(key + ".prefix"),
+			queue:        newQueue(),
+			replies:      make(map[string]*Message),
+		}
+		d.replay = c.Settings.GetString(key + ".replay")
+		d.replaySpeed = 1
+		if c.Settings.IsSet(key + ".replay_speed") {
+			d.replaySpeed = c.Settings.GetFloat64(key + ".replay_speed")
+		}
+		if c.Settings.GetBool(key + ".simulate") {
+			d.simulator = NewSimulator(ArduinoResponder)
+			if hz := c.Settings.GetFloat64(key + ".simulate_imu"); hz > 0 {
+				d.simulator.EmitEvery(time.Duration(float64(time.Second)/hz), simulatedIMU)
+			}
+		}
+		if d.Port == "" && d.SerialNumber == "" && d.replay == "" && d.simulator == nil {
+			log.Error().Msgf("Serial device %s has no port defined, skipping it", name)
+			continue
+		}
+		if d.Baud == 0 {
+			d.Baud = defaultBaudrate
+		}
+		if d.Role == "" {
+			d.Role = RoleBoth
+		}
+		if d.Role != RoleReader && d.Role != RoleWriter && d.Role != RoleBoth {
+			log.Error().Msgf("Serial device %s has invalid role %s, skipping it", name, d.Role)
+			continue
+		}
+
+		parity, err := parseParity(c.Settings.GetString(key + ".parity"))
+		if err != nil {
+			log.Error().Msgf("Serial device %s: %s, skipping it", name, err.Error())
+			continue
+		}
+		d.Parity = parity
+
+		d.parser, err = newParser(c.Settings.GetString(key+".parser"), c.Settings.GetString(key+".header"))
+		if err != nil {
+			log.Error().Msgf("Serial device %s: %s, skipping it", name, err.Error())
+			continue
+		}
+
+		if path := c.Settings.GetString(key + ".capture"); path != "" {
+			d.capture, err = openCapture(path)
+			if err != nil {
+				log.Error().Msgf("Serial device %s: failed to open capture file: %s", name, err.Error())
+			} else {
+				log.Info().Msgf("Capturing serial device %s traffic to %s", name, path)
+			}
+		}
+
+		if c.Settings.GetBool(key+".default") && d.CanWrite() {
+			defaultWriter = d.Name
+		}
+		parsed = append(parsed, d)
+	}
+
+	if len(parsed) == 0 && c.Settings.IsSet("mdroid.HARDWARE_SERIAL_PORT") {
+		parsed = append(parsed, &Device{
+			Name:    "default",
+			Port:    c.Settings.GetString("mdroid.HARDWARE_SERIAL_PORT"),
+			Baud:    defaultBaudrate,
+			Parity:  serial.ParityNone,
+			Role:    RoleBoth,
+			parser:  &jsonParser{},
+			queue:   newQueue(),
+			replies: make(map[string]*Message),
+		})
+	}
+
+	// Without an explicit default, use the first writable device alphabetically
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Name < parsed[j].Name })
+	if defaultWriter == "" {
+		for _, d := range parsed {
+			if d.CanWrite() {
+				defaultWriter = d.Name
+				break
+			}
+		}
+	}
+
+	return parsed, defaultWriter
+}
+
+func parseParity(parity string) (serial.Parity, error) {
+	switch strings.ToLower(parity) {
+	case "", "n", "none":
+		return serial.ParityNone, nil
+	case "o", "odd":
+		return serial.ParityOdd, nil
+	case "e", "even":
+		return serial.ParityEven, nil
+	case "m", "mark":
+		return serial.ParityMark, nil
+	case "s", "space":
+		return serial.ParitySpace, nil
+	}
+	return serial.ParityNone, fmt.Errorf("unknown parity %s", parity)
+}
@@ -0,0 +1,79 @@
+package mserial
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Framed devices exchange lines tagged with a message ID, so replies can be matched to their request:
+//
+//	MDroid -> device:  @1a2b3c4d powerOn:USB_HUB\n
+//	device -> MDroid:  @1a2b3c4d {"USB_HUB": true}\n
+//
+// Lines without a tag are parsed into the session as usual.
+const framePrefix = '@'
+
+// newID creates a short random ID for a framed message
+func newID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Error().Msgf("Failed to generate serial message ID: %s", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// frame tags outgoing text with its message ID
+func frame(id string, text string) string {
+	return fmt.Sprintf("%c%s %s\n", framePrefix, id, text)
+}
+
+// unframe splits a tagged line into its message ID and payload
+func unframe(line []byte) (string, string, bool) {
+	if len(line) < 2 || line[0] != framePrefix {
+		return "", "", false
+	}
+	line = line[1:]
+	space := bytes.IndexByte(line, ' ')
+	if space < 0 {
+		return string(line), "", true
+	}
+	return string(line[:space]), string(bytes.TrimSpace(line[space+1:])), true
+}
+
+// expectReply registers a message awaiting a reply from the device
+func (d *Device) expectReply(m *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.replies[m.UUID] = m
+}
+
+// forgetReply stops waiting for a reply to the message
+func (d *Device) forgetReply(m *Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.replies, m.UUID)
+}
+
+// handleReply passes a tagged line to the message awaiting it, returning false if the line isn't a reply
+func (d *Device) handleReply(line []byte) bool {
+	id, payload, ok := unframe(line)
+	if !ok {
+		return false
+	}
+
+	d.mutex.Lock()
+	m, ok := d.replies[id]
+	delete(d.replies, id)
+	d.mutex.Unlock()
+
+	if !ok {
+		log.Warn().Msgf("[%s] Serial device %s replied to an unknown message: %s", id, d.Name, payload)
+		return true
+	}
+	m.reply <- payload
+	return true
+}
@@ -0,0 +1,274 @@
+package mserial
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parser turns a single line read from a serial device into session keys and values
+type Parser interface {
+	Parse(line []byte) (map[string]interface{}, error)
+}
+
+// resetter is implemented by parsers that keep state between lines, which is reset when the device reconnects
+type resetter interface {
+	reset()
+}
+
+// newParser creates the parser named in a device's settings
+func newParser(name string, header string) (Parser, error) {
+	switch strings.ToLower(name) {
+	case "", "json":
+		return &jsonParser{}, nil
+	case "kv", "keyvalue", "key=value":
+		return &kvParser{}, nil
+	case "csv":
+		p := &csvParser{}
+		if header != "" {
+			if err := p.setHeader([]byte(header)); err != nil {
+				return nil, err
+			}
+			p.configured = p.header
+		}
+		return p, nil
+	case "nmea":
+		return &nmeaParser{}, nil
+	}
+	return nil, fmt.Errorf("unknown parser %s", name)
+}
+
+// jsonParser reads JSON objects, flattening nested objects and arrays into dotted keys
+type jsonParser struct{}
+
+// legacyMeasurements are IMU readings kept under their original gyros.* keys
+var legacyMeasurements = map[string]bool{"ACCELERATION": true, "GYROSCOPE": true, "MAGNETIC": true}
+
+func (p *jsonParser) Parse(line []byte) (map[string]interface{}, error) {
+	var data interface{}
+	if err := json.Unmarshal(line, &data); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	switch vv := data.(type) {
+	case map[string]interface{}:
+		for key, value := range vv {
+			if _, ok := value.(map[string]interface{}); ok && legacyMeasurements[key] {
+				flatten(values, "gyros."+strings.ToLower(key), value, true)
+				continue
+			}
+			flatten(values, key, value, false)
+		}
+	case []interface{}:
+		for i, value := range vv {
+			flatten(values, strconv.Itoa(i), value, false)
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("expected a JSON object or array, got %v", vv)
+	}
+	return values, nil
+}
+
+// flatten walks nested JSON, adding leaf values under their dotted path
+func flatten(values map[string]interface{}, prefix string, value interface{}, lower bool) {
+	switch vv := value.(type) {
+	case map[string]interface{}:
+		for key, child := range vv {
+			if lower {
+				key = strings.ToLower(key)
+			}
+			flatten(values, prefix+"."+key, child, lower)
+		}
+	case []interface{}:
+		for i, child := range vv {
+			flatten(values, fmt.Sprintf("%s.%d", prefix, i), child, lower)
+		}
+	case nil:
+	default:
+		values[prefix] = vv
+	}
+}
+
+// kvParser reads key=value pairs separated by spaces, commas or semicolons
+type kvParser struct{}
+
+func (p *kvParser) Parse(line []byte) (map[string]interface{}, error) {
+	fields := strings.FieldsFunc(string(line), func(r rune) bool {
+		return r == ' ' || r == ',' || r == ';' || r == '\t'
+	})
+
+	values := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("%s is not a key=value pair", field)
+		}
+		values[pair[0]] = parseValue(pair[1])
+	}
+	return values, nil
+}
+
+// csvParser reads comma separated values, naming them after a header line
+type csvParser struct {
+	header []string
+	// configured is the header from settings, without one the header is read from the device
+	configured []string
+}
+
+// reset forgets a header read from the device, expecting it to be sent again
+func (p *csvParser) reset() {
+	p.header = p.configured
+}
+
+func (p *csvParser) setHeader(line []byte) error {
+	header, err := readCSV(line)
+	if err != nil {
+		return err
+	}
+	p.header = header
+	return nil
+}
+
+func (p *csvParser) Parse(line []byte) (map[string]interface{}, error) {
+	// Without a configured header, the first line is taken as one
+	if p.header == nil {
+		return nil, p.setHeader(line)
+	}
+
+	record, err := readCSV(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(record) != len(p.header) {
+		return nil, fmt.Errorf("expected %d columns, got %d", len(p.header), len(record))
+	}
+
+	values := make(map[string]interface{}, len(record))
+	for i, value := range record {
+		values[p.header[i]] = parseValue(value)
+	}
+	return values, nil
+}
+
+func readCSV(line []byte) ([]string, error) {
+	record, err := csv.NewReader(strings.NewReader(string(line))).Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	return record, nil
+}
+
+// nmeaParser reads NMEA 0183 sentences from GPS receivers
+type nmeaParser struct{}
+
+func (p *nmeaParser) Parse(line []byte) (map[string]interface{}, error) {
+	sentence := strings.TrimSpace(string(line))
+	if !strings.HasPrefix(sentence, "$") {
+		return nil, fmt.Errorf("%s is not an NMEA sentence", sentence)
+	}
+	sentence = sentence[1:]
+
+	// Verify the checksum if one is given
+	if star := strings.LastIndex(sentence, "*"); star >= 0 {
+		expected, err := strconv.ParseUint(sentence[star+1:], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NMEA checksum %s", sentence[star+1:])
+		}
+		sentence = sentence[:star]
+		var sum byte
+		for i := 0; i < len(sentence); i++ {
+			sum ^= sentence[i]
+		}
+		if sum != byte(expected) {
+			return nil, fmt.Errorf("NMEA checksum mismatch, expected %02X got %02X", expected, sum)
+		}
+	}
+
+	fields := strings.Split(sentence, ",")
+	if len(fields[0]) < 5 {
+		return nil, fmt.Errorf("invalid NMEA sentence type %s", fields[0])
+	}
+
+	// Talker IDs (GP, GN, GL...) are dropped, only the sentence type matters
+	values := make(map[string]interface{})
+	switch fields[0][2:] {
+	case "GGA":
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("GGA sentence too short")
+		}
+		setCoordinate(values, "gps.latitude", fields[2], fields[3])
+		setCoordinate(values, "gps.longitude", fields[4], fields[5])
+		setNumber(values, "gps.fix_quality", fields[6])
+		setNumber(values, "gps.satellites", fields[7])
+		setNumber(values, "gps.hdop", fields[8])
+		setNumber(values, "gps.altitude", fields[9])
+		values["gps.time"] = fields[1]
+	case "RMC":
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("RMC sentence too short")
+		}
+		values["gps.valid"] = fields[2] == "A"
+		setCoordinate(values, "gps.latitude", fields[3], fields[4])
+		setCoordinate(values, "gps.longitude", fields[5], fields[6])
+		setNumber(values, "gps.speed_knots", fields[7])
+		setNumber(values, "gps.course", fields[8])
+		values["gps.time"] = fields[1]
+		values["gps.date"] = fields[9]
+	case "VTG":
+		if len(fields) < 8 {
+			return nil, fmt.Errorf("VTG sentence too short")
+		}
+		setNumber(values, "gps.course", fields[1])
+		setNumber(values, "gps.speed_kph", fields[7])
+	default:
+		// Keep unknown sentences around by field index
+		for i, field := range fields[1:] {
+			if field != "" {
+				values[fmt.Sprintf("nmea.%s.%d", strings.ToLower(fields[0]), i+1)] = parseValue(field)
+			}
+		}
+	}
+	return values, nil
+}
+
+// setCoordinate converts an NMEA ddmm.mmmm coordinate and hemisphere into signed decimal degrees
+func setCoordinate(values map[string]interface{}, key string, coordinate string, hemisphere string) {
+	raw, err := strconv.ParseFloat(coordinate, 64)
+	if err != nil {
+		return
+	}
+	degrees := float64(int(raw / 100))
+	decimal := degrees + (raw-degrees*100)/60
+	if hemisphere == "S" || hemisphere == "W" {
+		decimal = -decimal
+	}
+	values[key] = decimal
+}
+
+func setNumber(values map[string]interface{}, key string, field string) {
+	if number, err := strconv.ParseFloat(field, 64); err == nil {
+		values[key] = number
+	}
+}
+
+// parseValue infers a bool, number or string from text
+func parseValue(value string) interface{} {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return value
+}
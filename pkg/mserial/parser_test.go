@@ -0,0 +1,198 @@
+package mserial
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+)
+
+// parseCase is a line and the values it should parse into, or nil values if it should be rejected
+type parseCase struct {
+	name   string
+	line   string
+	values map[string]interface{}
+}
+
+// checkParses runs each case through a parser, comparing floats to within a millionth
+func checkParses(t *testing.T, p Parser, cases []parseCase) {
+	for _, tc := range cases {
+		values, err := p.Parse([]byte(tc.line))
+		if tc.values == nil {
+			if err == nil {
+				t.Errorf("%s: expected %q to be rejected, parsed %v", tc.name, tc.line, values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to parse %q: %s", tc.name, tc.line, err.Error())
+			continue
+		}
+		if !sameValues(values, tc.values) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.values, values)
+		}
+	}
+}
+
+func sameValues(got map[string]interface{}, expected map[string]interface{}) bool {
+	if len(got) != len(expected) {
+		return false
+	}
+	for key, value := range expected {
+		f, isFloat := value.(float64)
+		g, gotFloat := got[key].(float64)
+		if isFloat && gotFloat {
+			if math.Abs(f-g) > 1e-6 {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(got[key], value) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNMEAParser(t *testing.T) {
+	checkParses(t, &nmeaParser{}, []parseCase{
+		{"GGA", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47", map[string]interface{}{
+			"gps.latitude":    48 + 7.038/60,
+			"gps.longitude":   11 + 31.0/60,
+			"gps.fix_quality": 1.0,
+			"gps.satellites":  8.0,
+			"gps.hdop":        0.9,
+			"gps.altitude":    545.4,
+			"gps.time":        "123519",
+		}},
+		{"RMC southern and western", "$GNRMC,081836,A,3751.65,S,14507.36,W,000.0,360.0,130998,011.3,E*6E", map[string]interface{}{
+			"gps.valid":       true,
+			"gps.latitude":    -(37 + 51.65/60),
+			"gps.longitude":   -(145 + 7.36/60),
+			"gps.speed_knots": 0.0,
+			"gps.course":      360.0,
+			"gps.time":        "081836",
+			"gps.date":        "130998",
+		}},
+		{"RMC without a fix", "$GPRMC,,V,,,,,,,,,,N", map[string]interface{}{
+			"gps.valid": false,
+			"gps.time":  "",
+			"gps.date":  "",
+		}},
+		{"VTG", "$GPVTG,054.7,T,034.4,M,005.5,N,010.2,K", map[string]interface{}{
+			"gps.course":    54.7,
+			"gps.speed_kph": 10.2,
+		}},
+		{"unknown sentence", "$GPGSA,A,3,,04", map[string]interface{}{
+			"nmea.gpgsa.1": "A",
+			"nmea.gpgsa.2": 3.0,
+			"nmea.gpgsa.4": 4.0,
+		}},
+		{"bad checksum", "$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48", nil},
+		{"unreadable checksum", "$GPVTG,054.7,T,034.4,M,005.5,N,010.2,K*ZZ", nil},
+		{"not NMEA", "GPGGA,123519", nil},
+		{"short type", "$GP,1,2", nil},
+		{"short GGA", "$GPGGA,123519,4807.038,N", nil},
+	})
+}
+
+func TestKVParser(t *testing.T) {
+	checkParses(t, &kvParser{}, []parseCase{
+		{"separators", "speed=12.5 ACC_POWER=true;mode=sport,\tdoors=FALSE", map[string]interface{}{
+			"speed":     12.5,
+			"ACC_POWER": true,
+			"mode":      "sport",
+			"doors":     false,
+		}},
+		{"equals in a value", "url=a=b", map[string]interface{}{"url": "a=b"}},
+		{"empty value", "name=", map[string]interface{}{"name": ""}},
+		{"empty line", "", map[string]interface{}{}},
+		{"missing equals", "speed=1 broken", nil},
+		{"missing key", "=1", nil},
+	})
+}
+
+func TestJSONParser(t *testing.T) {
+	checkParses(t, &jsonParser{}, []parseCase{
+		{"nested", `{"engine": {"rpm": 800, "temps": [90, 91]}, "on": true, "gone": null}`, map[string]interface{}{
+			"engine.rpm":     800.0,
+			"engine.temps.0": 90.0,
+			"engine.temps.1": 91.0,
+			"on":             true,
+		}},
+		{"top level array", `[1, {"a": "b"}, [true]]`, map[string]interface{}{
+			"0":   1.0,
+			"1.a": "b",
+			"2.0": true,
+		}},
+		{"legacy IMU", `{"GYROSCOPE": {"X": 1, "Y": 2, "Z": 3}}`, map[string]interface{}{
+			"gyros.gyroscope.x": 1.0,
+			"gyros.gyroscope.y": 2.0,
+			"gyros.gyroscope.z": 3.0,
+		}},
+		{"null", `null`, map[string]interface{}{}},
+		{"scalar", `42`, nil},
+		{"invalid", `{"a": `, nil},
+	})
+}
+
+func TestCSVParser(t *testing.T) {
+	p, err := newParser("csv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkParses(t, p, []parseCase{
+		{"header", "speed, rpm ,mode", map[string]interface{}{}},
+		{"record", `12.5,800,"sport, plus"`, map[string]interface{}{"speed": 12.5, "rpm": 800.0, "mode": "sport, plus"}},
+		{"too few columns", "1,2", nil},
+		{"too many columns", "1,2,3,4", nil},
+	})
+
+	// A reconnected device sends its header again, which mustn't be read as a record
+	p.(resetter).reset()
+	checkParses(t, p, []parseCase{
+		{"new header", "gear,throttle", map[string]interface{}{}},
+		{"new record", "3,0.4", map[string]interface{}{"gear": 3.0, "throttle": 0.4}},
+	})
+
+	// A configured header is kept across reconnects
+	configured, err := newParser("csv", "a,b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured.(resetter).reset()
+	checkParses(t, configured, []parseCase{
+		{"configured record", "1,x", map[string]interface{}{"a": 1.0, "b": "x"}},
+	})
+
+	if _, err := newParser("csv", `"a,b`); err == nil {
+		t.Error("Expected an unreadable header to be rejected")
+	}
+	if _, err := newParser("xml", ""); err == nil {
+		t.Error("Expected an unknown parser to be rejected")
+	}
+}
+
+func TestHandleLineLowercase(t *testing.T) {
+	c := core.New("serial_test")
+	d, _ := newTestDevice("board", false, nil)
+	d.parser = &kvParser{}
+
+	updates := make(chan core.Message, 1)
+	c.Subscribe("session.acc_power", updates)
+
+	handleLine(c, d, []byte("ACC_POWER=true"))
+	select {
+	case m := <-updates:
+		if m.Content != true {
+			t.Fatalf("Unexpected power update %+v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ACC_POWER didn't reach subscribers of session.acc_power")
+	}
+	if c.SessionValue("acc_power") != true {
+		t.Fatalf("Expected acc_power in the session, got %v", c.SessionValue("acc_power"))
+	}
+}
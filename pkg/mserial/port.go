@@ -0,0 +1,41 @@
+package mserial
+
+import (
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tarm/serial"
+)
+
+// Port is the connection a device reads lines from and writes messages to.
+// Hardware ports are opened with tarm/serial, but anything else (i.e. a Simulator) can stand in.
+type Port interface {
+	io.ReadWriteCloser
+}
+
+// readTimeout bounds each read from a hardware port
+const readTimeout = 10 * time.Second
+
+// openHardware opens the device's serial port at the given node
+func openHardware(d *Device, node string) (Port, error) {
+	s, err := serial.OpenPort(&serial.Config{Name: node, Baud: d.Baud, Parity: d.Parity, ReadTimeout: readTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open connects to the device's simulator if it has one, otherwise its hardware port
+func (d *Device) open() (Port, error) {
+	if sim := d.getSimulator(); sim != nil {
+		return sim.Open()
+	}
+
+	node, err := d.resolvePort()
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Opening serial device %s (%s) at baud %d", d.Name, node, d.Baud)
+	return openHardware(d, node)
+}
@@ -0,0 +1,143 @@
+package mserial
+
+import (
+	"time"
+)
+
+// Priority of a serial message. Higher priorities are written first, equal priorities in the order they were pushed
+type Priority int
+
+const (
+	// PriorityLow is for telemetry requests that can wait behind everything else
+	PriorityLow Priority = iota - 1
+	// PriorityNormal is the default priority of a message
+	PriorityNormal
+	// PriorityCritical is for safety related commands like door locks, which jump ahead of the queue
+	PriorityCritical
+)
+
+// numPriorities is the number of lanes in each queue
+const numPriorities = int(PriorityCritical-PriorityLow) + 1
+
+// queue holds pending messages for one device in FIFO lanes, one per priority
+type queue struct {
+	lanes  [numPriorities][]*Message
+	notify chan struct{}
+
+	written   int64
+	totalWait time.Duration
+	maxWait   time.Duration
+	lastWait  time.Duration
+}
+
+// QueueStats describes the pending messages and wait times of a device's queue
+type QueueStats struct {
+	Length      int            `json:"length"`
+	Lanes       map[string]int `json:"lanes"`
+	Written     int64          `json:"written"`
+	AverageWait time.Duration  `json:"averageWait"`
+	MaxWait     time.Duration  `json:"maxWait"`
+	LastWait    time.Duration  `json:"lastWait"`
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// lane clamps a priority into a valid lane index
+func (p Priority) lane() int {
+	if p < PriorityLow {
+		p = PriorityLow
+	} else if p > PriorityCritical {
+		p = PriorityCritical
+	}
+	return int(p - PriorityLow)
+}
+
+func newQueue() *queue {
+	return &queue{notify: make(chan struct{}, 1)}
+}
+
+// signal wakes the device's writer, without blocking if it's already been woken
+func (q *queue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// push appends a message to the back of its priority lane
+func (q *queue) push(m *Message) {
+	m.queued = time.Now()
+	lane := m.Priority.lane()
+	q.lanes[lane] = append(q.lanes[lane], m)
+}
+
+// pop takes the oldest message from the highest non-empty priority lane
+func (q *queue) pop() *Message {
+	for lane := numPriorities - 1; lane >= 0; lane-- {
+		if len(q.lanes[lane]) == 0 {
+			continue
+		}
+
+		m := q.lanes[lane][0]
+		q.lanes[lane][0] = nil
+		q.lanes[lane] = q.lanes[lane][1:]
+
+		wait := time.Since(m.queued)
+		q.written++
+		q.totalWait += wait
+		q.lastWait = wait
+		if wait > q.maxWait {
+			q.maxWait = wait
+		}
+		return m
+	}
+	return nil
+}
+
+// remove drops a pending message from its lane, returning false if it isn't queued
+func (q *queue) remove(m *Message) bool {
+	lane := m.Priority.lane()
+	for i, pending := range q.lanes[lane] {
+		if pending == m {
+			q.lanes[lane] = append(q.lanes[lane][:i], q.lanes[lane][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of pending messages across all lanes
+func (q *queue) len() int {
+	length := 0
+	for _, lane := range q.lanes {
+		length += len(lane)
+	}
+	return length
+}
+
+func (q *queue) stats() QueueStats {
+	s := QueueStats{
+		Length:   q.len(),
+		Lanes:    make(map[string]int, numPriorities),
+		Written:  q.written,
+		MaxWait:  q.maxWait,
+		LastWait: q.lastWait,
+	}
+	for lane := range q.lanes {
+		s.Lanes[(Priority(lane) + PriorityLow).String()] = len(q.lanes[lane])
+	}
+	if q.written > 0 {
+		s.AverageWait = q.totalWait / time.Duration(q.written)
+	}
+	return s
+}
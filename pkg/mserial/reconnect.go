@@ -0,0 +1,198 @@
+package mserial
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// reconnectMinDelay is the first wait after a failed open or disconnect
+	reconnectMinDelay = 500 * time.Millisecond
+	// reconnectMaxDelay caps the wait between reconnect attempts
+	reconnectMaxDelay = 30 * time.Second
+	// stableConnection is how long a connection must last before reconnect delays start over
+	stableConnection = 10 * time.Second
+	// hotplugSettle gives udev a moment to set permissions on a new device node before it's opened
+	hotplugSettle = 250 * time.Millisecond
+)
+
+// backoff doubles the wait between reconnect attempts, with jitter so devices sharing a hub don't retry in lockstep
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+}
+
+func newBackoff() *backoff {
+	return &backoff{min: reconnectMinDelay, max: reconnectMaxDelay}
+}
+
+// next returns how long to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		delay = b.min << b.attempt
+		b.attempt++
+	}
+
+	// Spread the delay by +/- 25%
+	jitter := time.Duration(rand.Int63n(int64(delay)/2+1)) - delay/4
+	return delay + jitter
+}
+
+// reset starts the delays over after a stable connection
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// hotplug watches /dev for new device nodes, fanning their paths out to every waiting device
+type hotplug struct {
+	once    sync.Once
+	mutex   sync.Mutex
+	err     error
+	waiting map[chan string]bool
+}
+
+var devWatcher = &hotplug{waiting: make(map[chan string]bool)}
+
+// devDir is where device nodes are created when they're plugged in
+const devDir = "/dev"
+
+func (h *hotplug) start() {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(devDir)
+	}
+	if err != nil {
+		h.err = err
+		log.Warn().Msgf("Failed to watch %s for serial devices, falling back to timed reconnects: %s", devDir, err.Error())
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Create == 0 {
+					continue
+				}
+				h.mutex.Lock()
+				for waiting := range h.waiting {
+					select {
+					case waiting <- event.Name:
+					default:
+					}
+				}
+				h.mutex.Unlock()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Msgf("Error watching %s for serial devices: %s", devDir, err.Error())
+			}
+		}
+	}()
+}
+
+// subscribe returns a channel receiving created device node paths, and a function to stop receiving them.
+// The channel is nil if /dev can't be watched.
+func (h *hotplug) subscribe() (chan string, func()) {
+	h.once.Do(h.start)
+	if h.err != nil {
+		return nil, func() {}
+	}
+
+	created := make(chan string, 1)
+	h.mutex.Lock()
+	h.waiting[created] = true
+	h.mutex.Unlock()
+	return created, func() {
+		h.mutex.Lock()
+		delete(h.waiting, created)
+		h.mutex.Unlock()
+	}
+}
+
+// waitToReconnect sleeps for the given delay, returning early if the device's node reappears in /dev
+func waitToReconnect(d *Device, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	// Simulated devices never show up in /dev
+	var created chan string
+	if d.getSimulator() == nil {
+		var stop func()
+		created, stop = devWatcher.subscribe()
+		defer stop()
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case node := <-created:
+			if d.matchesNode(node) {
+				log.Info().Msgf("Serial device %s may have been plugged in as %s", d.Name, node)
+				time.Sleep(hotplugSettle)
+				return
+			}
+		}
+	}
+}
+
+// matchesNode returns if a newly created device node could be this device.
+// Ports given by symlink or serial number can't be known until they're resolved, so any new tty is worth a try.
+func (d *Device) matchesNode(node string) bool {
+	if d.SerialNumber == "" && filepath.Dir(d.Port) == devDir {
+		return node == d.Port
+	}
+	return strings.HasPrefix(filepath.Base(node), "tty")
+}
+
+// resolvePort returns the device node to open, looking it up by USB serial number if one is configured.
+// This keeps a device's identity when it's plugged back in under a different node, i.e. ttyACM1 instead of ttyACM0.
+func (d *Device) resolvePort() (string, error) {
+	if d.SerialNumber == "" {
+		return d.Port, nil
+	}
+
+	// udev creates stable links named after the serial number
+	links, _ := filepath.Glob("/dev/serial/by-id/*")
+	for _, link := range links {
+		if strings.Contains(filepath.Base(link), d.SerialNumber) {
+			return filepath.EvalSymlinks(link)
+		}
+	}
+
+	// Without udev, find the tty whose USB parent reports the serial number
+	ttys, _ := filepath.Glob("/sys/class/tty/*/device")
+	for _, tty := range ttys {
+		dir, err := filepath.EvalSymlinks(tty)
+		if err != nil {
+			continue
+		}
+		for ; strings.HasPrefix(dir, "/sys/devices/"); dir = filepath.Dir(dir) {
+			serial, err := ioutil.ReadFile(filepath.Join(dir, "serial"))
+			if err != nil {
+				continue
+			}
+			if strings.TrimSpace(string(serial)) == d.SerialNumber {
+				return filepath.Join(devDir, filepath.Base(filepath.Dir(tty))), nil
+			}
+			break
+		}
+	}
+
+	return "", fmt.Errorf("no device with serial number %s is plugged in", d.SerialNumber)
+}
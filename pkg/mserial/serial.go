@@ -2,202 +2,315 @@ package mserial
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/mitchellh/mapstructure"
 	"github.com/qcasey/MDroid-Core/internal/core"
 	"github.com/rs/zerolog/log"
-	"github.com/tarm/serial"
 )
 
 // Message for the serial writer, and a channel to await it
 type Message struct {
-	Device     *serial.Port
+	Device     *Device
 	Text       string
+	Priority   Priority
+	Timeout    time.Duration
 	isComplete chan error
 	UUID       string
+	queued     time.Time
+	reply      chan string
 }
 
-// Measurement contains a simple X,Y,Z output from the IMU
-type Measurement struct {
-	X float64 `json:"X"`
-	Y float64 `json:"Y"`
-	Z float64 `json:"Z"`
-}
-
-var writerLock sync.Mutex
-
-var (
-	// Writer is our one main port to default to
-	Writer         *serial.Port
-	writeQueue     map[*serial.Port][]*Message
-	writeQueueLock sync.Mutex
+const (
+	// defaultWriteTimeout is used for messages that don't set their own
+	defaultWriteTimeout = 2 * time.Second
+	// defaultReplyTimeout is how long to wait for a framed device to answer, unless the context ends first
+	defaultReplyTimeout = 3 * time.Second
+	// AwaitTimeout is the deadline callers should give Await, covering the queue, write and reply
+	AwaitTimeout = 10 * time.Second
 )
 
-func init() {
-	writeQueue = make(map[*serial.Port][]*Message, 0)
-}
+// Writer is our one main device to default to
+var Writer *Device
 
-// Start will set up the serial port and ReadSerial goroutine
+// Start will set up each configured serial device with its reader and writer goroutines
 func Start(c *core.Core) {
-	if !c.Settings.IsSet("mdroid.HARDWARE_SERIAL_PORT") {
-		log.Warn().Msgf("No hardware serial port defined. Not setting up serial devices.")
+	parsed, defaultWriter := parseDevices(c)
+	if len(parsed) == 0 {
+		log.Warn().Msgf("No serial devices defined. Not setting up serial devices.")
 		return
 	}
 
-	hardwareSerialPort := c.Settings.GetString("mdroid.HARDWARE_SERIAL_PORT")
+	devicesLock.Lock()
+	for _, d := range parsed {
+		devices[d.Name] = d
+	}
+	devicesLock.Unlock()
 
-	// Start initial reader / writer
-	log.Info().Msgf("Registering %s as serial writer", hardwareSerialPort)
-	go begin(c, hardwareSerialPort, 115200)
+	if defaultWriter != "" {
+		Writer = Get(defaultWriter)
+		log.Info().Msgf("Using serial device %s as default writer", defaultWriter)
+	}
 
-	// Setup other devices
-	/*
-		for device, baudrate := range parseSerialDevices(settings.GetAll()) {
-			go startSerialComms(device, baudrate)
-		}*/
+	for _, d := range parsed {
+		c.Publish(fmt.Sprintf("session.serial.%s.connected", d.Name), core.Message{Content: false})
+		c.Publish(fmt.Sprintf("session.serial.%s.reconnects", d.Name), core.Message{Content: 0})
+
+		// Replayed devices are fed from their capture instead of hardware
+		if d.replay != "" {
+			go func(d *Device) {
+				if err := Replay(c, d, d.replay, d.replaySpeed); err != nil {
+					log.Error().Msgf("Failed to replay serial capture %s: %s", d.replay, err.Error())
+				}
+			}(d)
+			continue
+		}
 
+		if d.SerialNumber != "" {
+			log.Info().Msgf("Registering %s with serial number %s as serial %s", d.Name, d.SerialNumber, d.Role)
+		} else {
+			log.Info().Msgf("Registering %s on %s as serial %s", d.Name, d.Port, d.Role)
+		}
+		go run(c, d)
+	}
 }
 
-func begin(c *core.Core, deviceName string, baudrate int) {
-	log.Info().Msgf("Opening serial device %s at baud %d", deviceName, baudrate)
-	serialConfig := &serial.Config{Name: deviceName, Baud: baudrate, ReadTimeout: time.Second * 10}
-	s, err := serial.OpenPort(serialConfig)
-	if err != nil {
-		log.Error().Msgf("Failed to open serial port %s", deviceName)
-		log.Error().Msg(err.Error())
-		time.Sleep(time.Second * 2)
-		go begin(c, deviceName, baudrate)
-		return
+// run keeps the device connected, reopening it with backoff whenever it fails to open or disconnects
+func run(c *core.Core, d *Device) {
+	retry := newBackoff()
+	reconnects := 0
+	for connected := false; ; {
+		s, err := d.open()
+		if err != nil {
+			delay := retry.next()
+			log.Error().Msgf("Failed to open serial device %s, retrying in %s: %s", d.Name, delay.Round(time.Millisecond), err.Error())
+			waitToReconnect(d, delay)
+			continue
+		}
+
+		if connected {
+			reconnects++
+			c.Publish(fmt.Sprintf("session.serial.%s.reconnects", d.Name), core.Message{Content: reconnects})
+		}
+		connected = true
+
+		// A port that opens but fails straight away keeps backing off
+		if serve(c, d, s) {
+			retry.reset()
+		}
+
+		delay := retry.next()
+		log.Error().Msgf("Serial device %s disconnected, reopening in %s", d.Name, delay.Round(time.Millisecond))
+		waitToReconnect(d, delay)
 	}
+}
+
+// serve reads from and writes to an open port until it disconnects, returning if the connection was
+// stable: it read a line or stayed up for stableConnection
+func serve(c *core.Core, d *Device, s Port) bool {
+	started := time.Now()
+	readLine := false
+
 	defer s.Close()
+	d.setConn(c, s)
+
+	// A reconnected device may start over, i.e. by sending its CSV header again
+	if r, ok := d.parser.(resetter); ok {
+		r.reset()
+	}
 
-	// Use first Serial device as a R/W, all others will only be read from
-	isWriter := false
-	if Writer == nil {
-		Writer = s
-		isWriter = true
-		log.Info().Msgf("Using serial device %s as default writer", deviceName)
+	// Drain the write queue independently of reads
+	ctx, cancel := context.WithCancel(context.Background())
+	if d.CanWrite() {
+		go writeLoop(ctx, d)
 	}
 
-	// Continually read from serial port
-	log.Info().Msgf("Starting new serial reader on device %s", deviceName)
+	// Continually read from serial port. Write only devices still need to notice disconnects
+	log.Info().Msgf("Starting new serial reader on device %s", d.Name)
+	reader := bufio.NewReader(s)
 	for {
-		// Write to device if is necessary
-		if isWriter {
-			Pop(s)
+		readStarted := time.Now()
+		err := read(c, d, reader)
+		if err == nil {
+			readLine = true
+			continue
 		}
-
-		err := read(c, s)
-		if err != nil {
-			// The device is nil, break out of this read loop
-			log.Error().Msg("Failed to read from serial port")
-			log.Error().Msg(err.Error())
-			break
+		// Hardware ports return EOF once a read times out, a quiet port is idle rather than gone.
+		// An unplugged port returns EOF straight away.
+		if err == io.EOF && time.Since(readStarted) >= readTimeout/2 {
+			continue
 		}
+		log.Error().Msgf("Failed to read from serial device %s", d.Name)
+		log.Error().Msg(err.Error())
+		break
 	}
-	log.Error().Msg("Serial disconnected, closing port and reopening in 10 seconds")
+	cancel()
+
+	// Messages queued for this port can't be written anymore. The queue is swapped along with the
+	// connection, so Push can't add to it after it's been drained
+	d.mutex.Lock()
+	d.conn = nil
+	pending := d.queue
+	d.queue = newQueue()
+	d.mutex.Unlock()
+	c.Publish(fmt.Sprintf("session.serial.%s.connected", d.Name), core.Message{Content: false})
+	for msg := pending.pop(); msg != nil; msg = pending.pop() {
+		msg.complete(fmt.Errorf("Serial device %s disconnected before message was written", d.Name))
+	}
+	return readLine || time.Since(started) >= stableConnection
+}
 
-	// Replace main serial writer
-	if Writer == s {
-		Writer = nil
+// writeLoop writes queued messages to the device as soon as they're pushed, until the context is cancelled
+func writeLoop(ctx context.Context, d *Device) {
+	q := d.getQueue()
+	log.Info().Msgf("Starting new serial writer on device %s", d.Name)
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msgf("Stopping serial writer on device %s", d.Name)
+			return
+		case <-q.notify:
+			for Pop(d) {
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
 	}
+}
 
-	s.Close()
-	time.Sleep(time.Second * 10)
-	log.Error().Msg("Reopening serial port...")
-	go begin(c, deviceName, baudrate)
+// getQueue returns the device's current write queue
+func (d *Device) getQueue() *queue {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.queue
 }
 
 // Push queues a message for writing
-func Push(m *Message) {
-	writeQueueLock.Lock()
-	defer writeQueueLock.Unlock()
-	_, ok := writeQueue[m.Device]
-	if !ok {
-		writeQueue[m.Device] = []*Message{}
+func Push(m *Message) error {
+	if m.Device == nil {
+		return fmt.Errorf("Serial device is not set, nothing to write to")
+	}
+	if !m.Device.CanWrite() {
+		return fmt.Errorf("Serial device %s is read only", m.Device.Name)
 	}
 
-	writeQueue[m.Device] = append(writeQueue[m.Device], m)
+	d := m.Device
+	d.mutex.Lock()
+	if d.conn == nil {
+		d.mutex.Unlock()
+		return fmt.Errorf("Serial device %s is not connected", d.Name)
+	}
+	d.queue.push(m)
+	q := d.queue
+	d.mutex.Unlock()
+	q.signal()
+	return nil
 }
 
 // PushText creates a new message with the default writer, and appends it for sending
 func PushText(message string) {
 	m := &Message{Device: Writer, Text: message}
-	Push(m)
+	if err := Push(m); err != nil {
+		log.Error().Msgf("Dropping serial message %s: %s", message, err.Error())
+	}
 }
 
-// Await queues a message for writing, and waits for it to be sent
-func Await(m *Message) error {
-	//m.UUID, _ = format.NewShortUUID()
-	m.isComplete = make(chan error)
-	//log.Info().Msgf("[%s] Awaiting serial message write", m.UUID)
-	Push(m)
-	err := <-m.isComplete
-	//log.Info().Msgf("[%s] Message write is complete", m.UUID)
-	return err
-}
+// Await queues a message for writing, and waits for it to be sent or the context to be done.
+// Framed devices tag the message with an ID, and the matching reply's payload is returned.
+func Await(ctx context.Context, m *Message) (string, error) {
+	// Buffered, so a writer finishing after we've given up doesn't block
+	m.isComplete = make(chan error, 1)
+	if m.Device != nil && m.Device.Framed {
+		m.UUID = newID()
+		m.reply = make(chan string, 1)
+		m.Device.expectReply(m)
+		defer m.Device.forgetReply(m)
+	}
 
-// AwaitText creates a new message with the default writer, appends it for sending, and waits for it to be sent
-func AwaitText(message string) error {
-	//uuid, _ := format.NewShortUUID()
-	m := &Message{Device: Writer, Text: message, isComplete: make(chan error)}
-	//log.Info().Msgf("[%s] Awaiting serial message write", m.UUID)
-	Push(m)
-	err := <-m.isComplete
-	//log.Info().Msgf("[%s] Message write is complete", m.UUID)
-	return err
-}
+	if err := Push(m); err != nil {
+		return "", err
+	}
 
-// Pop the last message off the queue and write it to the respective serial
-func Pop(device *serial.Port) {
-	if device == nil {
-		log.Error().Msg("Serial port is not set, nothing to write to.")
-		return
+	select {
+	case err := <-m.isComplete:
+		if err != nil {
+			return "", err
+		}
+	case <-ctx.Done():
+		if cancel(m) {
+			return "", fmt.Errorf("Serial message %s was cancelled before being written: %s", m.Text, ctx.Err().Error())
+		}
+		// Already being written, wait for the write timeout instead of leaving the outcome unknown
+		if err := <-m.isComplete; err != nil {
+			return "", err
+		}
 	}
 
-	writeQueueLock.Lock()
-	defer writeQueueLock.Unlock()
-	queue, ok := writeQueue[device]
-	if !ok || len(queue) == 0 {
-		return
+	if m.reply == nil {
+		return "", nil
 	}
 
-	var msg *Message
-	msg, writeQueue[device] = writeQueue[device][len(writeQueue[device])-1], writeQueue[device][:len(writeQueue[device])-1]
+	select {
+	case reply := <-m.reply:
+		return reply, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("[%s] Gave up waiting for a reply to %s: %s", m.UUID, m.Text, ctx.Err().Error())
+	case <-time.After(defaultReplyTimeout):
+		return "", fmt.Errorf("[%s] Timed out after %s waiting for a reply to %s", m.UUID, defaultReplyTimeout.String(), m.Text)
+	}
+}
 
-	err := write(msg)
-	msg.isComplete <- err
+// AwaitText creates a new message with the default writer, appends it for sending, and waits for it to be sent
+func AwaitText(ctx context.Context, message string) (string, error) {
+	return Await(ctx, &Message{Device: Writer, Text: message})
 }
 
-// parseSerialDevices parses through other serial devices, if enabled
-/*
-func parseSerialDevices(settingsData map[string]map[string]string) map[string]int {
+// cancel removes a message from its queue, returning false if it was already taken by the writer
+func cancel(m *Message) bool {
+	m.Device.mutex.Lock()
+	defer m.Device.mutex.Unlock()
+	return m.Device.queue.remove(m)
+}
 
-	serialDevices, additionalSerialDevices := settingsData["Serial Devices"]
-	var devices map[string]int
+// Pop the oldest, highest priority message off the queue and write it to the respective serial.
+// Returns false if there was nothing to write.
+func Pop(d *Device) bool {
+	if d == nil {
+		log.Error().Msg("Serial device is not set, nothing to write to.")
+		return false
+	}
 
-	if additionalSerialDevices {
-		for deviceName, baudrateString := range serialDevices {
-			deviceBaud, err := strconv.Atoi(baudrateString)
-			if err != nil {
-				log.Error().Msgf("Failed to convert given baudrate string to int. Found values: %s: %s", deviceName, baudrateString)
-			} else {
-				devices[deviceName] = deviceBaud
-			}
-		}
+	d.mutex.Lock()
+	msg := d.queue.pop()
+	d.mutex.Unlock()
+	if msg == nil {
+		return false
 	}
 
-	return devices
-}*/
+	msg.complete(writeWithTimeout(msg))
+	return true
+}
+
+// Stats returns the queue length and wait times of each serial device
+func Stats() map[string]QueueStats {
+	devicesLock.RLock()
+	defer devicesLock.RUnlock()
 
-// readSerial takes one line from the serial device and parses it into the session
-func read(c *core.Core, device *serial.Port) error {
-	reader := bufio.NewReader(device)
+	stats := make(map[string]QueueStats, len(devices))
+	for name, d := range devices {
+		d.mutex.RLock()
+		stats[name] = d.queue.stats()
+		d.mutex.RUnlock()
+	}
+	return stats
+}
+
+// read takes one line from the serial device and parses it into the session
+func read(c *core.Core, d *Device, reader *bufio.Reader) error {
 	msg, _, err := reader.ReadLine()
 	if err != nil {
 		return err
@@ -207,79 +320,108 @@ func read(c *core.Core, device *serial.Port) error {
 		return nil
 	}
 
-	// Parse serial data
-	var jsonData interface{}
-	err = json.Unmarshal(msg, &jsonData)
-	if err != nil {
-		return err
+	d.capture.record(captureRead, msg)
+	handleLine(c, d, msg)
+	return nil
+}
+
+// handleLine routes a line from the device to an awaiting message, or parses it into the session
+func handleLine(c *core.Core, d *Device, msg []byte) {
+	// Replies to framed messages go back to whoever is awaiting them
+	if d.Framed && d.handleReply(msg) {
+		return
 	}
-	if jsonData == nil {
-		return nil
+
+	if !d.CanRead() {
+		return
 	}
 
-	// Handle parse errors here instead of passing up
-	data := jsonData.(map[string]interface{})
-	// Switch through various types of JSON data
-	for key, value := range data {
-		switch vv := value.(type) {
-		case bool:
-			c.Session.Set(key, vv)
-		case int:
-			c.Session.Set(key, vv)
-		case float64:
-			c.Session.Set(key, vv)
-		case string:
-			c.Session.Set(key, vv)
-		case map[string]interface{}:
-			var m Measurement
-			err := mapstructure.Decode(value, &m)
-			if err != nil {
-				return err
-			}
-			if key != "ACCELERATION" && key != "GYROSCOPE" && key != "MAGNETIC" {
-				return fmt.Errorf("Measurement key %s not registered for input", key)
-			}
+	// Bad lines are dropped rather than treated as a disconnect
+	values, err := d.parser.Parse(msg)
+	if err != nil {
+		log.Warn().Msgf("Failed to parse line from serial device %s: %s", d.Name, err.Error())
+		return
+	}
 
-			// Skip publishing values
-			c.Session.Set(fmt.Sprintf("gyros.%s.x", strings.ToLower(key)), m.X)
-			c.Session.Set(fmt.Sprintf("gyros.%s.y", strings.ToLower(key)), m.Y)
-			c.Session.Set(fmt.Sprintf("gyros.%s.z", strings.ToLower(key)), m.Z)
-		case []interface{}:
-			log.Error().Msg(key + " is an array. Data: ")
-			for i, u := range vv {
-				fmt.Println(i, u)
-			}
-		case nil:
-			break
-		default:
-			return fmt.Errorf("%s is of a type I don't know how to handle (%s: %s)", key, vv, value)
+	for key, value := range values {
+		if d.Prefix != "" {
+			key = fmt.Sprintf("%s.%s", d.Prefix, key)
 		}
+		// Session keys are lowercase, so ACC_POWER reaches subscribers of session.acc_power
+		key = strings.ToLower(key)
+		c.Publish(fmt.Sprintf("session.%s", key), core.Message{Content: value})
 	}
-
-	return nil
 }
 
 // write pushes out a message to the open serial port
 func write(msg *Message) error {
 	if msg.Device == nil {
-		return fmt.Errorf("Serial port is not set, nothing to write to")
+		return fmt.Errorf("Serial device is not set, nothing to write to")
 	}
 
 	if len(msg.Text) == 0 {
 		return fmt.Errorf("Empty message, not writing to serial")
 	}
 
-	writerLock.Lock()
-	n, err := msg.Device.Write([]byte(msg.Text))
-	writerLock.Unlock()
+	conn := msg.Device.getConn()
+	if conn == nil {
+		return fmt.Errorf("Serial device %s is not connected", msg.Device.Name)
+	}
+
+	text := msg.Text
+	if msg.Device.Framed && msg.UUID != "" {
+		text = frame(msg.UUID, msg.Text)
+	}
+
+	n, err := conn.Write([]byte(text))
 	if err != nil {
-		return fmt.Errorf("Failed to write to serial port: %s", err.Error())
+		return fmt.Errorf("Failed to write to serial device %s: %s", msg.Device.Name, err.Error())
 	}
+	msg.Device.capture.record(captureWrite, []byte(text))
 
 	if msg.UUID == "" {
-		log.Info().Msgf("Successfully wrote %s (%d bytes) to serial.", msg.Text, n)
+		log.Info().Msgf("Successfully wrote %s (%d bytes) to serial device %s.", msg.Text, n, msg.Device.Name)
 	} else {
-		log.Info().Msgf("[%s] Successfully wrote %s (%d bytes) to serial.", msg.UUID, msg.Text, n)
+		log.Info().Msgf("[%s] Successfully wrote %s (%d bytes) to serial device %s.", msg.UUID, msg.Text, n, msg.Device.Name)
 	}
 	return nil
 }
+
+// writeWithTimeout gives up on a write that takes longer than the message's timeout.
+// Writes to a device are serialized, and a stuck port is closed so the device reconnects
+// rather than having the next write interleave with the abandoned one.
+func writeWithTimeout(msg *Message) error {
+	d := msg.Device
+	if d == nil {
+		return fmt.Errorf("Serial device is not set, nothing to write to")
+	}
+	timeout := msg.Timeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		d.writeLock.Lock()
+		defer d.writeLock.Unlock()
+		result <- write(msg)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		if conn := d.getConn(); conn != nil {
+			log.Error().Msgf("Serial device %s is stuck writing, closing it to reconnect", d.Name)
+			conn.Close()
+		}
+		return fmt.Errorf("Timed out after %s writing %s to serial", timeout.String(), msg.Text)
+	}
+}
+
+// complete reports the outcome of a write to anyone awaiting it
+func (m *Message) complete(err error) {
+	if m.isComplete != nil {
+		m.isComplete <- err
+	}
+}
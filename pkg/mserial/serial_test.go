@@ -0,0 +1,298 @@
+package mserial
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+)
+
+// newTestDevice creates a read / write device backed by a simulator
+func newTestDevice(name string, framed bool, responder Responder) (*Device, *Simulator) {
+	sim := NewSimulator(responder)
+	d := &Device{
+		Name:      name,
+		Role:      RoleBoth,
+		Framed:    framed,
+		parser:    &jsonParser{},
+		simulator: sim,
+		queue:     newQueue(),
+		replies:   make(map[string]*Message),
+	}
+	return d, sim
+}
+
+// connect opens the device's simulator without starting its writer, so messages stay queued
+func connect(t *testing.T, d *Device, sim *Simulator) Port {
+	port, err := sim.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mutex.Lock()
+	d.conn = port
+	d.mutex.Unlock()
+	return port
+}
+
+// waitFor polls a condition until it's true or the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	d, sim := newTestDevice("queue", false, nil)
+	connect(t, d, sim)
+
+	pushes := []struct {
+		text     string
+		priority Priority
+	}{
+		{"low1", PriorityLow},
+		{"normal1", PriorityNormal},
+		{"critical1", PriorityCritical},
+		{"normal2", PriorityNormal},
+		{"low2", PriorityLow},
+		{"critical2", PriorityCritical},
+		{"normal3", PriorityNormal},
+	}
+	for _, p := range pushes {
+		if err := Push(&Message{Device: d, Text: p.text, Priority: p.priority}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := d.queue.stats()
+	if stats.Length != len(pushes) || stats.Lanes["critical"] != 2 || stats.Lanes["normal"] != 3 || stats.Lanes["low"] != 2 {
+		t.Fatalf("Unexpected queue stats %+v", stats)
+	}
+
+	for Pop(d) {
+	}
+	expected := []string{"critical1", "critical2", "normal1", "normal2", "normal3", "low1", "low2"}
+	if written := sim.Written(); strings.Join(written, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected writes %v, got %v", expected, written)
+	}
+}
+
+func TestPushWhileDisconnected(t *testing.T) {
+	d, _ := newTestDevice("disconnected", false, nil)
+	if err := Push(&Message{Device: d, Text: "hello"}); err == nil {
+		t.Fatal("Expected pushing to a disconnected device to fail")
+	}
+	if d.queue.len() != 0 {
+		t.Fatal("Message was queued for a disconnected device")
+	}
+}
+
+func TestAwaitWritten(t *testing.T) {
+	c := core.New("serial_test")
+	d, sim := newTestDevice("await", false, nil)
+	port := connect(t, d, sim)
+	go serve(c, d, port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := Await(ctx, &Message{Device: d, Text: "powerOn:USB_HUB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "" {
+		t.Fatalf("Unframed device replied %q", reply)
+	}
+	if written := sim.Written(); len(written) != 1 || written[0] != "powerOn:USB_HUB" {
+		t.Fatalf("Unexpected writes %v", written)
+	}
+}
+
+func TestAwaitTimeoutBeforeWrite(t *testing.T) {
+	d, sim := newTestDevice("timeout", false, nil)
+	connect(t, d, sim)
+
+	// Nothing drains the queue, so the deadline passes while the message is still queued
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Await(ctx, &Message{Device: d, Text: "never"})
+	if err == nil || !strings.Contains(err.Error(), "cancelled before being written") {
+		t.Fatalf("Expected the message to be cancelled, got %v", err)
+	}
+	if d.queue.len() != 0 {
+		t.Fatal("Cancelled message was left in the queue")
+	}
+}
+
+func TestAwaitCancelled(t *testing.T) {
+	d, sim := newTestDevice("cancel", false, nil)
+	connect(t, d, sim)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := Await(ctx, &Message{Device: d, Text: "never"})
+		result <- err
+	}()
+
+	waitFor(t, time.Second, "the message to be queued", func() bool {
+		d.mutex.RLock()
+		defer d.mutex.RUnlock()
+		return d.queue.len() == 1
+	})
+	cancel()
+
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("Expected a cancellation error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Await didn't return after its context was cancelled")
+	}
+	if written := sim.Written(); len(written) != 0 {
+		t.Fatalf("Cancelled message was written: %v", written)
+	}
+}
+
+func TestAwaitReplyTimeout(t *testing.T) {
+	c := core.New("serial_test")
+	d, sim := newTestDevice("silent", true, nil)
+	port := connect(t, d, sim)
+	go serve(c, d, port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := Await(ctx, &Message{Device: d, Text: "ping"})
+	if err == nil || !strings.Contains(err.Error(), "Gave up waiting for a reply") {
+		t.Fatalf("Expected to give up on the reply, got %v", err)
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if len(d.replies) != 0 {
+		t.Fatal("Abandoned message is still waiting for a reply")
+	}
+}
+
+func TestFramedReplies(t *testing.T) {
+	c := core.New("serial_test")
+	d, sim := newTestDevice("framed", true, func(command string) []string {
+		return []string{fmt.Sprintf(`{"echo": %q}`, command)}
+	})
+	port := connect(t, d, sim)
+	go serve(c, d, port)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			command := fmt.Sprintf("command%d", i)
+			reply, err := Await(ctx, &Message{Device: d, Text: command})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if expected := fmt.Sprintf(`{"echo": %q}`, command); reply != expected {
+				t.Errorf("Expected reply %s to %s, got %s", expected, command, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Replies are taken by their message rather than parsed into the session
+	if c.SessionValue("echo") != nil {
+		t.Fatal("Framed reply was parsed into the session")
+	}
+}
+
+// stuckPort never finishes a write until it's closed
+type stuckPort struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (port *stuckPort) Read(p []byte) (int, error) {
+	<-port.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (port *stuckPort) Write(p []byte) (int, error) {
+	<-port.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (port *stuckPort) Close() error {
+	port.once.Do(func() { close(port.closed) })
+	return nil
+}
+
+func TestWriteTimeoutClosesPort(t *testing.T) {
+	d, _ := newTestDevice("stuck", false, nil)
+	port := &stuckPort{closed: make(chan struct{})}
+	d.conn = port
+
+	err := writeWithTimeout(&Message{Device: d, Text: "hello", Timeout: 50 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected the write to time out, got %v", err)
+	}
+	select {
+	case <-port.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Stuck port wasn't closed")
+	}
+
+	// The abandoned write has given up, so the next one isn't held behind it
+	d.writeLock.Lock()
+	d.writeLock.Unlock()
+}
+
+func TestReconnect(t *testing.T) {
+	c := core.New("serial_test")
+	d, sim := newTestDevice("reconnect", false, nil)
+	go run(c, d)
+
+	connected := func() bool { return c.SessionValue("serial.reconnect.connected") == true }
+	waitFor(t, time.Second, "the connection to be published", connected)
+
+	sim.Disconnect()
+	waitFor(t, time.Second, "the disconnect to be published", func() bool { return !connected() })
+	if err := Push(&Message{Device: d, Text: "dropped"}); err == nil {
+		t.Fatal("Expected pushing while disconnected to fail")
+	}
+
+	waitFor(t, 5*time.Second, "the device to reconnect", connected)
+	waitFor(t, time.Second, "the reconnect to be counted", func() bool {
+		return c.SessionValue("serial.reconnect.reconnects") == 1
+	})
+
+	// Writes work again over the new connection
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := Await(ctx, &Message{Device: d, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if written := sim.Written(); len(written) != 1 || written[0] != "hello" {
+		t.Fatalf("Unexpected writes %v", written)
+	}
+
+	// Unplugged devices keep retrying until they're plugged back in
+	sim.Unplug()
+	waitFor(t, time.Second, "the unplug to be published", func() bool { return !connected() })
+	sim.Plug()
+	waitFor(t, 10*time.Second, "the device to be plugged back in", connected)
+	waitFor(t, time.Second, "the second reconnect to be counted", func() bool {
+		return c.SessionValue("serial.reconnect.reconnects") == 2
+	})
+}
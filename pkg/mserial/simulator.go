@@ -0,0 +1,192 @@
+package mserial
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Responder scripts how a simulated device answers a command, returning the lines it should emit
+type Responder func(command string) []string
+
+// Simulator is an in-memory stand in for a serial device, used when no hardware is available
+type Simulator struct {
+	mutex     sync.Mutex
+	responder Responder
+	port      *simulatedPort
+	unplugged bool
+	written   []string
+}
+
+// simulatedPort is a single connection to a Simulator, lasting until it's disconnected
+type simulatedPort struct {
+	sim    *Simulator
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// NewSimulator creates a simulated device answering commands with the given responder.
+// A nil responder never answers.
+func NewSimulator(responder Responder) *Simulator {
+	if responder == nil {
+		responder = func(string) []string { return nil }
+	}
+	return &Simulator{responder: responder}
+}
+
+// Open connects to the simulator, failing while it's unplugged
+func (sim *Simulator) Open() (Port, error) {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+
+	if sim.unplugged {
+		return nil, fmt.Errorf("simulated device is unplugged")
+	}
+	if sim.port != nil {
+		return nil, fmt.Errorf("simulated device is already open")
+	}
+
+	reader, writer := io.Pipe()
+	sim.port = &simulatedPort{sim: sim, reader: reader, writer: writer}
+	return sim.port, nil
+}
+
+// Emit sends a line to the connected reader, as if the device printed it
+func (sim *Simulator) Emit(line string) error {
+	sim.mutex.Lock()
+	port := sim.port
+	sim.mutex.Unlock()
+
+	if port == nil {
+		return fmt.Errorf("simulated device is not connected")
+	}
+	_, err := port.writer.Write([]byte(line + "\n"))
+	return err
+}
+
+// EmitEvery sends a generated line on an interval, until the returned function is called
+func (sim *Simulator) EmitEvery(interval time.Duration, generate func() string) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sim.Emit(generate())
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// Disconnect drops the current connection, the reader sees an error as if the cable was pulled
+func (sim *Simulator) Disconnect() {
+	sim.mutex.Lock()
+	port := sim.port
+	sim.port = nil
+	sim.mutex.Unlock()
+
+	if port != nil {
+		port.writer.CloseWithError(io.ErrUnexpectedEOF)
+	}
+}
+
+// Unplug disconnects the simulator and refuses new connections until it's plugged back in
+func (sim *Simulator) Unplug() {
+	sim.mutex.Lock()
+	sim.unplugged = true
+	sim.mutex.Unlock()
+	sim.Disconnect()
+}
+
+// Plug allows connections to the simulator again
+func (sim *Simulator) Plug() {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	sim.unplugged = false
+}
+
+// Written returns every command written to the simulator, in order
+func (sim *Simulator) Written() []string {
+	sim.mutex.Lock()
+	defer sim.mutex.Unlock()
+	return append([]string{}, sim.written...)
+}
+
+// Read lines emitted by the simulated device
+func (port *simulatedPort) Read(p []byte) (int, error) {
+	return port.reader.Read(p)
+}
+
+// Write a command to the simulated device, which may answer through its responder
+func (port *simulatedPort) Write(p []byte) (int, error) {
+	sim := port.sim
+	sim.mutex.Lock()
+	if sim.port != port {
+		sim.mutex.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	command := strings.TrimSpace(string(p))
+	sim.written = append(sim.written, command)
+	responder := sim.responder
+	sim.mutex.Unlock()
+
+	// Framed commands are answered with the same ID
+	id, text, framed := unframe([]byte(command))
+	if !framed {
+		text = command
+	}
+
+	lines := responder(text)
+	go func() {
+		for i, line := range lines {
+			if framed && i == 0 {
+				line = strings.TrimSpace(frame(id, line))
+			}
+			if _, err := port.writer.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+	return len(p), nil
+}
+
+// Close the connection to the simulated device
+func (port *simulatedPort) Close() error {
+	port.sim.mutex.Lock()
+	if port.sim.port == port {
+		port.sim.port = nil
+	}
+	port.sim.mutex.Unlock()
+	port.writer.Close()
+	return port.reader.Close()
+}
+
+// ArduinoResponder mimics the MDroid Arduino, acknowledging power commands with the component's new state
+func ArduinoResponder(command string) []string {
+	parts := strings.SplitN(command, ":", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+
+	switch parts[0] {
+	case "powerOn":
+		return []string{fmt.Sprintf(`{"%s": true}`, parts[1])}
+	case "powerOff":
+		return []string{fmt.Sprintf(`{"%s": false}`, parts[1])}
+	}
+	return nil
+}
+
+// simulatedIMU generates a noisy IMU reading in the Arduino's JSON format
+func simulatedIMU() string {
+	noise := func() float64 { return rand.Float64()*0.2 - 0.1 }
+	return fmt.Sprintf(`{"ACCELERATION": {"X": %.3f, "Y": %.3f, "Z": %.3f}, "GYROSCOPE": {"X": %.3f, "Y": %.3f, "Z": %.3f}}`,
+		noise(), noise(), 9.81+noise(), noise(), noise(), noise())
+}
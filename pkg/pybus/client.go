@@ -0,0 +1,318 @@
+package pybus
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// Client is a bridge to the pyBus HTTP server, with timeouts, retries and a circuit breaker
+type Client struct {
+	Endpoint string
+	// PingPath is requested to check pyBus is up, it must not send anything onto the bus
+	PingPath         string
+	Timeout          time.Duration
+	Retries          int
+	RetryDelay       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	core *core.Core
+	http *http.Client
+
+	mutex     sync.Mutex
+	online    bool
+	failures  int
+	state     breakerState
+	openUntil time.Time
+
+	inFlight  int32
+	sent      int64
+	failed    int64
+	rejected  int64
+	lastError string
+}
+
+// ClientStats holds counters describing the health of the pyBus bridge
+type ClientStats struct {
+	Endpoint     string    `json:"endpoint"`
+	Online       bool      `json:"online"`
+	BreakerOpen  bool      `json:"breakerOpen"`
+	BreakerUntil time.Time `json:"breakerUntil,omitempty"`
+	BreakerState string    `json:"breakerState"`
+	InFlight     int32     `json:"inFlight"`
+	Sent         int64     `json:"sent"`
+	Failed       int64     `json:"failed"`
+	Rejected     int64     `json:"rejected"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// breakerState is whether requests are let through to pyBus
+type breakerState int
+
+const (
+	// breakerClosed lets every request through
+	breakerClosed breakerState = iota
+	// breakerOpen refuses requests until the cooldown ends
+	breakerOpen
+	// breakerHalfOpen lets a single trial request through after the cooldown
+	breakerHalfOpen
+)
+
+func (state breakerState) String() string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Default values used when the matching setting isn't defined
+const (
+	defaultEndpoint         = "http://localhost:8080"
+	defaultPingPath         = "/"
+	defaultTimeout          = 2 * time.Second
+	defaultRetries          = 2
+	defaultRetryDelay       = 250 * time.Millisecond
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	maxOnlineWait           = 5 * time.Second
+)
+
+// ErrBreakerOpen is returned when requests are refused because pyBus has failed too often recently
+var ErrBreakerOpen = fmt.Errorf("pybus circuit breaker is open")
+
+// NewClient creates a pyBus bridge configured from the core's settings
+func NewClient(c *core.Core) *Client {
+	client := &Client{
+		Endpoint:         defaultEndpoint,
+		PingPath:         defaultPingPath,
+		Timeout:          defaultTimeout,
+		Retries:          defaultRetries,
+		RetryDelay:       defaultRetryDelay,
+		BreakerThreshold: defaultBreakerThreshold,
+		BreakerCooldown:  defaultBreakerCooldown,
+		core:             c,
+	}
+
+	if c.Settings.IsSet("pybus.endpoint") {
+		client.Endpoint = strings.TrimSuffix(c.Settings.GetString("pybus.endpoint"), "/")
+	}
+	if c.Settings.IsSet("pybus.ping_path") {
+		client.PingPath = "/" + strings.TrimPrefix(c.Settings.GetString("pybus.ping_path"), "/")
+	}
+	if c.Settings.IsSet("pybus.timeout") {
+		client.Timeout = c.Settings.GetDuration("pybus.timeout")
+	}
+	if c.Settings.IsSet("pybus.retries") {
+		client.Retries = c.Settings.GetInt("pybus.retries")
+	}
+	if c.Settings.IsSet("pybus.retry_delay") {
+		client.RetryDelay = c.Settings.GetDuration("pybus.retry_delay")
+	}
+	if c.Settings.IsSet("pybus.breaker_threshold") {
+		client.BreakerThreshold = c.Settings.GetInt("pybus.breaker_threshold")
+	}
+	if c.Settings.IsSet("pybus.breaker_cooldown") {
+		client.BreakerCooldown = c.Settings.GetDuration("pybus.breaker_cooldown")
+	}
+
+	client.http = &http.Client{Timeout: client.Timeout}
+	client.publishOnline(false)
+	return client
+}
+
+// Send pushes a single command to pyBus, retrying on failure.
+// While the breaker is half open the command is a single trial attempt.
+func (client *Client) Send(command string) error {
+	client.addInFlight(1)
+	defer client.addInFlight(-1)
+
+	trial, ok := client.allow()
+	if !ok {
+		atomic.AddInt64(&client.rejected, 1)
+		return ErrBreakerOpen
+	}
+	retries := client.Retries
+	if trial {
+		retries = 0
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(client.RetryDelay * time.Duration(attempt))
+		}
+
+		if err = client.get(command); err == nil {
+			atomic.AddInt64(&client.sent, 1)
+			client.recordSuccess()
+			return nil
+		}
+		log.Debug().Msgf("Attempt %d to send %s to pybus failed: %s", attempt+1, command, err.Error())
+	}
+
+	atomic.AddInt64(&client.failed, 1)
+	client.recordFailure(err)
+	return fmt.Errorf("Failed to send %s to pybus after %d attempts: %s", command, retries+1, err.Error())
+}
+
+// Ping checks if the pyBus server is responding by requesting PingPath, which doesn't reach the bus.
+// Any response short of a server error means it's up. Pings only change if pyBus is online,
+// background health checks alone mustn't open the breaker in front of real commands.
+func (client *Client) Ping() error {
+	resp, err := client.http.Get(client.Endpoint + client.PingPath)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("pybus responded with code %d", resp.StatusCode)
+		}
+	}
+	client.setOnline(err == nil, err)
+	return err
+}
+
+// WaitUntilOnline blocks until pyBus responds, backing off between attempts
+func (client *Client) WaitUntilOnline() {
+	log.Info().Msgf("Waiting for pybus to come online at %s...", client.Endpoint)
+	delay := 100 * time.Millisecond
+	for {
+		if err := client.Ping(); err == nil {
+			log.Info().Msg("Pybus is online")
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxOnlineWait {
+			delay = maxOnlineWait
+		}
+	}
+}
+
+// IsOnline returns if the last request to pyBus was successful
+func (client *Client) IsOnline() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.online
+}
+
+// Stats returns a snapshot of the bridge's health counters
+func (client *Client) Stats() ClientStats {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return ClientStats{
+		Endpoint:     client.Endpoint,
+		Online:       client.online,
+		BreakerOpen:  client.state == breakerOpen && time.Now().Before(client.openUntil),
+		BreakerState: client.state.String(),
+		BreakerUntil: client.openUntil,
+		InFlight:     atomic.LoadInt32(&client.inFlight),
+		Sent:         atomic.LoadInt64(&client.sent),
+		Failed:       atomic.LoadInt64(&client.failed),
+		Rejected:     atomic.LoadInt64(&client.rejected),
+		LastError:    client.lastError,
+	}
+}
+
+// get performs one GET request against pyBus
+func (client *Client) get(command string) error {
+	resp, err := client.http.Get(fmt.Sprintf("%s/%s", client.Endpoint, command))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pybus responded with code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// allow checks the breaker before a request, returning if it's the trial request of a half open breaker
+func (client *Client) allow() (trial bool, ok bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	switch client.state {
+	case breakerOpen:
+		if time.Now().Before(client.openUntil) {
+			return false, false
+		}
+		client.state = breakerHalfOpen
+		log.Info().Msg("Pybus breaker is half open, trying one request")
+		return true, true
+	case breakerHalfOpen:
+		// The trial request hasn't finished yet
+		return false, false
+	}
+	return false, true
+}
+
+func (client *Client) recordSuccess() {
+	client.mutex.Lock()
+	client.failures = 0
+	client.state = breakerClosed
+	client.openUntil = time.Time{}
+	client.mutex.Unlock()
+
+	client.setOnline(true, nil)
+}
+
+func (client *Client) recordFailure(err error) {
+	client.mutex.Lock()
+	client.failures++
+	if client.state == breakerHalfOpen || (client.state == breakerClosed && client.BreakerThreshold > 0 && client.failures >= client.BreakerThreshold) {
+		client.state = breakerOpen
+		client.openUntil = time.Now().Add(client.BreakerCooldown)
+		log.Warn().Msgf("Pybus failed %d times in a row, refusing requests until %s", client.failures, client.openUntil.Format(time.Kitchen))
+	}
+	client.mutex.Unlock()
+
+	client.setOnline(false, err)
+}
+
+// setOnline records if the last request reached pyBus, publishing any change
+func (client *Client) setOnline(online bool, err error) {
+	client.mutex.Lock()
+	changed := client.online != online
+	client.online = online
+	if err != nil {
+		client.lastError = err.Error()
+	}
+	client.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if err != nil {
+		log.Error().Msgf("Lost connection to pybus: %s", err.Error())
+	}
+	client.publishOnline(online)
+}
+
+func (client *Client) publishOnline(online bool) {
+	if client.core == nil {
+		return
+	}
+	client.core.Publish("session.pybus_online", core.Message{Content: online})
+}
+
+// addInFlight counts requests being sent to pyBus, publishing the new count
+func (client *Client) addInFlight(delta int32) {
+	inFlight := atomic.AddInt32(&client.inFlight, delta)
+	if client.core == nil {
+		return
+	}
+	client.core.Publish("session.pybus_in_flight", core.Message{Content: int(inFlight)})
+}
@@ -0,0 +1,73 @@
+package pybus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient points a client without a core at a fake pyBus that answers with the given status
+func newTestClient(status *int32) (*Client, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+	client := &Client{
+		Endpoint:         server.URL,
+		PingPath:         defaultPingPath,
+		Retries:          0,
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+		http:             &http.Client{Timeout: time.Second},
+	}
+	return client, server
+}
+
+func TestPingDoesNotOpenBreaker(t *testing.T) {
+	status := int32(http.StatusInternalServerError)
+	client, server := newTestClient(&status)
+	defer server.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := client.Ping(); err == nil {
+			t.Fatal("Expected pinging a failing pyBus to fail")
+		}
+	}
+	if stats := client.Stats(); stats.Online || stats.BreakerState != "closed" || stats.LastError == "" {
+		t.Fatalf("Failed pings should only mark pyBus offline, got %+v", stats)
+	}
+
+	// Commands still get through once pyBus recovers
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := client.Send("requestVehicleStatus"); err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsOnline() {
+		t.Fatal("Expected pyBus to be online after a command was sent")
+	}
+}
+
+func TestSendOpensBreaker(t *testing.T) {
+	status := int32(http.StatusInternalServerError)
+	client, server := newTestClient(&status)
+	defer server.Close()
+
+	for i := 0; i < client.BreakerThreshold; i++ {
+		if err := client.Send("toggleDoorLocks"); err == nil {
+			t.Fatal("Expected sending to a failing pyBus to fail")
+		}
+	}
+	if err := client.Send("toggleDoorLocks"); err != ErrBreakerOpen {
+		t.Fatalf("Expected the breaker to refuse commands, got %v", err)
+	}
+
+	// A successful ping shows pyBus is back, but the breaker waits for its trial command
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := client.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.Stats(); !stats.Online || !stats.BreakerOpen || stats.Rejected != 1 {
+		t.Fatalf("Unexpected stats after pinging %+v", stats)
+	}
+}
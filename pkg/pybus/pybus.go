@@ -2,6 +2,7 @@
 package pybus
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -9,25 +10,31 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/qcasey/MDroid-Core/internal/core"
-	"github.com/qcasey/MDroid-Core/internal/core/settings"
 	"github.com/qcasey/MDroid-Core/pkg/mserial"
+	"github.com/qcasey/MDroid-Core/pkg/tracker"
 	"github.com/rs/zerolog/log"
 )
 
+// bridge is the client used to reach the pyBus server
+var bridge *Client
+
 // Setup parses this module's implementation
-func Setup(router *mux.Router) {
+func Setup(c *core.Core, router *mux.Router) {
+	bridge = NewClient(c)
+
 	// Set up pybus repeat commands
 	go func() {
 		time.Sleep(500)
-		if settings.Data.IsSet("mdroid.pybus_device") {
+		if c.Settings.IsSet("mdroid.pybus_device") {
 			runStartup()
-			startRepeats()
+			startRepeats(c)
 		}
 	}()
 
 	//
 	// PyBus Routes
 	//
+	router.HandleFunc("/pybus/status", Status).Methods("GET")
 	router.HandleFunc("/pybus/{src}/{dest}/{data}/{checksum}", StartRoutine).Methods("POST")
 	router.HandleFunc("/pybus/{src}/{dest}/{data}", StartRoutine).Methods("POST")
 	router.HandleFunc("/pybus/{command}/{checksum}", StartRoutine).Methods("GET")
@@ -37,7 +44,7 @@ func Setup(router *mux.Router) {
 	// Catch-Alls for (hopefully) a pre-approved pybus function
 	// i.e. /doors/lock
 	//
-	router.HandleFunc("/{device}/{command}", ParseCommand).Methods("GET")
+	router.HandleFunc("/{device}/{command}", ParseCommand(c)).Methods("GET")
 }
 
 // IsPositiveRequest helps translate UP or LOCK into true or false
@@ -54,18 +61,18 @@ func isPositiveRequest(request string) (bool, error) {
 }
 
 // startRepeats that will send a command only on ACC power
-func startRepeats() {
-	go repeatCommand("requestIgnitionStatus", 10)
-	go repeatCommand("requestLampStatus", 20)
-	go repeatCommand("requestVehicleStatus", 30)
-	go repeatCommand("requestOdometer", 45)
-	go repeatCommand("requestTimeStatus", 60)
-	go repeatCommand("requestTemperatureStatus", 120)
+func startRepeats(c *core.Core) {
+	go repeatCommand(c, "requestIgnitionStatus", 10)
+	go repeatCommand(c, "requestLampStatus", 20)
+	go repeatCommand(c, "requestVehicleStatus", 30)
+	go repeatCommand(c, "requestOdometer", 45)
+	go repeatCommand(c, "requestTimeStatus", 60)
+	go repeatCommand(c, "requestTemperatureStatus", 120)
 }
 
 // runStartup queues the startup scripts to gather initial data from PyBus
 func runStartup() {
-	waitUntilOnline()
+	bridge.WaitUntilOnline()
 	go PushQueue("requestIgnitionStatus")
 	go PushQueue("requestLampStatus")
 	go PushQueue("requestVehicleStatus")
@@ -91,7 +98,7 @@ func runStartup() {
 // msg can either be a directive (e.g. 'openTrunk')
 // or a Python formatted list of three byte strings: src, dest, and data
 // e.g. '["50", "68", "3B01"]'
-func PushQueue(command string) {
+func PushQueue(command string) error {
 
 	//
 	// First, interrupt with some special cases
@@ -100,22 +107,34 @@ func PushQueue(command string) {
 	case "rollWindowsUp":
 		go PushQueue("popWindowsUp")
 		go PushQueue("popWindowsUp")
-		return
+		return nil
 	case "rollWindowsDown":
 		go PushQueue("popWindowsDown")
 		go PushQueue("popWindowsDown")
-		return
+		return nil
+	}
+
+	if bridge == nil {
+		return fmt.Errorf("Pybus has not been set up, dropping %s", command)
 	}
 
 	// Send request to pybus server
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8080/%s", command))
-	if err != nil {
+	if err := bridge.Send(command); err != nil {
 		log.Error().Msgf("Failed to request %s from pybus: \n %s", command, err.Error())
-		return
+		return err
 	}
-	defer resp.Body.Close()
 
 	log.Debug().Msgf("Added %s to the Pybus Queue", command)
+	return nil
+}
+
+// Status responds with the health of the pyBus bridge
+func Status(w http.ResponseWriter, r *http.Request) {
+	if bridge == nil {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Pybus has not been set up", OK: false})
+		return
+	}
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: bridge.Stats(), OK: true})
 }
 
 // StartRoutine handles incoming requests to the pybus program, will add routines to the queue
@@ -139,150 +158,164 @@ func StartRoutine(w http.ResponseWriter, r *http.Request) {
 }
 
 // repeatCommand endlessly, helps with request functions
-func repeatCommand(command string, sleepSeconds int) {
+func repeatCommand(c *core.Core, command string, sleepSeconds int) {
 	log.Info().Msgf("Running Pybus command %s every %d seconds", command, sleepSeconds)
 	for {
 		// Only push repeated pybus commands when powered, otherwise the car won't sleep
-		if core.Sessions.GetBool("acc_power.value") {
+		if c.SessionBool("acc_power") {
 			PushQueue(command)
 		}
 		time.Sleep(time.Duration(sleepSeconds) * time.Second)
 	}
 }
 
-func waitUntilOnline() {
-	log.Info().Msg("Waiting for pybus to come online...")
-	for {
-		if _, err := http.Get("http://localhost:8080/requestIgnitionStatus"); err == nil {
-			break
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-}
-
 // ParseCommand is a list of pre-approved routes to PyBus for easier routing
 // These GET requests can be used instead of knowing the implementation function in pybus
 // and are actually preferred, since we can handle strange cases
-func ParseCommand(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+func ParseCommand(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
 
-	if len(params["device"]) == 0 || len(params["command"]) == 0 {
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Error: One or more required params is empty", OK: false})
-		return
-	}
+		if len(params["device"]) == 0 || len(params["command"]) == 0 {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Error: One or more required params is empty", OK: false})
+			return
+		}
 
-	// Format similarly to the rest of MDroid suite, removing plurals
-	// Formatting allows for fuzzier requests
-	device := strings.TrimSuffix(core.FormatName(params["device"]), "S")
-	command := strings.TrimSuffix(core.FormatName(params["command"]), "S")
+		// Format similarly to the rest of MDroid suite, removing plurals
+		// Formatting allows for fuzzier requests
+		device := strings.TrimSuffix(core.FormatName(params["device"]), "S")
+		command := strings.TrimSuffix(core.FormatName(params["command"]), "S")
 
-	// Parse command into a bool, make either "on" or "off" effectively
-	isPositive, err := isPositiveRequest(command)
-	cannotBeParsedIntoBoolean := err != nil
+		// Parse command into a bool, make either "on" or "off" effectively
+		isPositive, err := isPositiveRequest(command)
+		cannotBeParsedIntoBoolean := err != nil
 
-	// Check if we care that the request isn't formatted into an "on" or "off"
-	if cannotBeParsedIntoBoolean {
-		switch device {
-		case "DOOR", "TOP", "CONVERTIBLE_TOP", "HAZARD", "FLASHER", "INTERIOR":
-			log.Error().Msg(err.Error())
-			return
+		// Check if we care that the request isn't formatted into an "on" or "off"
+		if cannotBeParsedIntoBoolean {
+			switch device {
+			case "DOOR", "TOP", "CONVERTIBLE_TOP", "HAZARD", "FLASHER", "INTERIOR":
+				log.Error().Msg(err.Error())
+				return
+			}
 		}
-	}
 
-	log.Info().Msgf("Attempting to send command %s to device %s", command, device)
+		log.Info().Msgf("Attempting to send command %s to device %s", command, device)
 
-	// If the car's ACC power isn't on, it won't be ready for requests. Wake it up first
-	if !core.Sessions.GetBool("acc_power.value") {
-		PushQueue("requestVehicleStatus") // this will be swallowed
-	}
+		// If the car's ACC power isn't on, it won't be ready for requests. Wake it up first
+		if !c.SessionBool("acc_power") {
+			PushQueue("requestVehicleStatus") // this will be swallowed
+		}
+
+		// All I wanted was a moment or two
+		// To see if you could do that switch-a-roo
+		var (
+			directive string
+			expect    *tracker.Expectation
+		)
+		switch device {
+		case "DOOR":
+			target := "FALSE"
+			if isPositive {
+				target = "TRUE"
+			}
+			expect = &tracker.Expectation{Key: "doors_locked", Value: target, Timeout: 5 * time.Second}
+
+			doorStatus := c.SessionString("doors_locked")
+			if mserial.Writer.IsConnected() &&
+				((isPositive && doorStatus == "FALSE") || (!isPositive && doorStatus == "TRUE")) {
+				cmd := tracker.Default.Run("toggleDoorLocks", expect, func() error {
+					ctx, cancel := context.WithTimeout(context.Background(), mserial.AwaitTimeout)
+					defer cancel()
+					_, err := mserial.Await(ctx, &mserial.Message{Device: mserial.Writer, Text: "toggleDoorLocks", Priority: mserial.PriorityCritical})
+					return err
+				})
+				core.WriteNewResponse(&w, r, core.JSONResponse{Output: device, OK: true, ID: cmd.ID})
+				return
+			}
+
+			// Doors are already where they were asked to be, no new write will come to confirm it
+			if doorStatus == target {
+				log.Info().Msgf("Doors are already %s, not toggling", command)
+				cmd := tracker.Default.Confirm("toggleDoorLocks", expect)
+				core.WriteNewResponse(&w, r, core.JSONResponse{Output: device, OK: true, ID: cmd.ID})
+				return
+			}
 
-	// All I wanted was a moment or two
-	// To see if you could do that switch-a-roo
-	switch device {
-	case "DOOR":
-		doorStatus := core.Sessions.GetString("doors_locked.value")
-		if mserial.Writer != nil &&
-			((isPositive && doorStatus == "FALSE") || (!isPositive && doorStatus == "TRUE")) {
-			mserial.PushText("toggleDoorLocks")
-		} else {
 			log.Info().Msgf("Request to %s doors denied, door status is %s", command, doorStatus)
-		}
-	case "WINDOW":
-		if command == "POPDOWN" {
-			PushQueue("popWindowsDown")
-		} else if command == "POPUP" {
-			PushQueue("popWindowsUp")
-		} else if isPositive {
-			PushQueue("rollWindowsUp")
-		} else {
-			PushQueue("rollWindowsDown")
-		}
-	case "TOP", "CONVERTIBLE_TOP":
-		if isPositive {
-			PushQueue("convertibleTopUp")
-		} else {
-			PushQueue("convertibleTopDown")
-		}
-	case "TRUNK":
-		PushQueue("openTrunk")
-	case "HAZARD":
-		if isPositive {
-			PushQueue("turnOnHazards")
-		} else {
-			PushQueue("turnOffAllExteriorLights")
-		}
-	case "FLASHER":
-		if isPositive {
-			PushQueue("flashAllExteriorLights")
-		} else {
-			PushQueue("turnOffAllExteriorLights")
-		}
-	case "INTERIOR":
-		if isPositive {
-			PushQueue("interiorLightsOff")
-		} else {
-			PushQueue("interiorLightsOn")
-		}
-	case "CLOWN", "NOSE":
-		PushQueue("turnOnClownNose")
-	case "MODE":
-		PushQueue("pressMode")
-	case "RADIO", "NAV", "STEREO":
-		switch command {
-		case "AM":
-			PushQueue("pressAM")
-		case "FM":
-			PushQueue("pressFM")
-		case "NEXT":
-			PushQueue("pressNext")
-		case "PREV":
-			PushQueue("pressPrev")
+			cmd := tracker.Default.Fail("toggleDoorLocks", fmt.Errorf("Request to %s doors denied, door status is %s", command, doorStatus))
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: device, OK: false, ID: cmd.ID})
+			return
+		case "WINDOW":
+			if command == "POPDOWN" {
+				directive = "popWindowsDown"
+			} else if command == "POPUP" {
+				directive = "popWindowsUp"
+			} else if isPositive {
+				directive = "rollWindowsUp"
+			} else {
+				directive = "rollWindowsDown"
+			}
+		case "TOP", "CONVERTIBLE_TOP":
+			if isPositive {
+				directive = "convertibleTopUp"
+			} else {
+				directive = "convertibleTopDown"
+			}
+		case "TRUNK":
+			directive = "openTrunk"
+		case "HAZARD":
+			if isPositive {
+				directive = "turnOnHazards"
+			} else {
+				directive = "turnOffAllExteriorLights"
+			}
+		case "FLASHER":
+			if isPositive {
+				directive = "flashAllExteriorLights"
+			} else {
+				directive = "turnOffAllExteriorLights"
+			}
+		case "INTERIOR":
+			if isPositive {
+				directive = "interiorLightsOff"
+			} else {
+				directive = "interiorLightsOn"
+			}
+		case "CLOWN", "NOSE":
+			directive = "turnOnClownNose"
 		case "MODE":
-			PushQueue("pressMode")
-		case "NUM":
-			PushQueue("pressNumPad")
-		case "1":
-			PushQueue("press1")
-		case "2":
-			PushQueue("press2")
-		case "3":
-			PushQueue("press3")
-		case "4":
-			PushQueue("press4")
-		case "5":
-			PushQueue("press5")
-		case "6":
-			PushQueue("press6")
+			directive = "pressMode"
+		case "RADIO", "NAV", "STEREO":
+			switch command {
+			case "AM":
+				directive = "pressAM"
+				expect = &tracker.Expectation{Key: "radio_band", Value: "AM", Timeout: 5 * time.Second}
+			case "FM":
+				directive = "pressFM"
+				expect = &tracker.Expectation{Key: "radio_band", Value: "FM", Timeout: 5 * time.Second}
+			case "NEXT":
+				directive = "pressNext"
+			case "PREV":
+				directive = "pressPrev"
+			case "MODE":
+				directive = "pressMode"
+			case "NUM":
+				directive = "pressNumPad"
+			case "1", "2", "3", "4", "5", "6":
+				directive = "press" + command
+				expect = &tracker.Expectation{Key: "radio_preset", Value: command, Timeout: 5 * time.Second}
+			default:
+				directive = "pressStereoPower"
+			}
 		default:
-			PushQueue("pressStereoPower")
+			log.Error().Msgf("Invalid device %s", device)
+			response := core.JSONResponse{Output: fmt.Sprintf("Invalid device %s", device), OK: false}
+			response.Write(&w, r)
+			return
 		}
-	default:
-		log.Error().Msgf("Invalid device %s", device)
-		response := core.JSONResponse{Output: fmt.Sprintf("Invalid device %s", device), OK: false}
-		response.Write(&w, r)
-		return
-	}
 
-	// Yay
-	core.WriteNewResponse(&w, r, core.JSONResponse{Output: device, OK: true})
+		// Yay
+		cmd := tracker.Default.Run(directive, expect, func() error { return PushQueue(directive) })
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: device, OK: true, ID: cmd.ID})
+	}
 }
@@ -0,0 +1,315 @@
+// Package stereo tracks the factory radio's state and translates requests into button presses
+package stereo
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/qcasey/MDroid-Core/pkg/pybus"
+	"github.com/qcasey/MDroid-Core/pkg/tracker"
+	"github.com/rs/zerolog/log"
+)
+
+// State of the stereo, as last reported on the bus
+type State struct {
+	Source    string                     `json:"source"`
+	Band      string                     `json:"band"`
+	Frequency float64                    `json:"frequency"`
+	Preset    int                        `json:"preset"`
+	Presets   map[string]map[int]float64 `json:"presets"`
+}
+
+var (
+	state      = State{Presets: make(map[string]map[int]float64)}
+	stateLock  sync.RWMutex
+	tuningLock sync.Mutex
+)
+
+// feedbackKeys are the session keys pyBus reports the stereo's state in
+var feedbackKeys = []string{"radio_source", "radio_band", "radio_frequency", "radio_preset"}
+
+const (
+	// feedbackQueue is how many session changes can wait for the stereo
+	feedbackQueue = 64
+	// seekSettleTime is how long to wait for the radio to report back after a button press
+	seekSettleTime = 1500 * time.Millisecond
+	// maxSeekSteps bounds the number of seeks when tuning to a frequency
+	maxSeekSteps = 30
+	// maxSourceSteps bounds the number of mode presses when changing source
+	maxSourceSteps = 6
+)
+
+// buttons maps logical stereo buttons to pybus directives
+var buttons = map[string]string{
+	"AM":    "pressAM",
+	"FM":    "pressFM",
+	"NEXT":  "pressNext",
+	"PREV":  "pressPrev",
+	"MODE":  "pressMode",
+	"NUM":   "pressNumPad",
+	"POWER": "pressStereoPower",
+	"1":     "press1",
+	"2":     "press2",
+	"3":     "press3",
+	"4":     "press4",
+	"5":     "press5",
+	"6":     "press6",
+}
+
+// Setup starts tracking stereo feedback and adds its routes
+func Setup(c *core.Core, router *mux.Router) {
+	go watch(c)
+
+	//
+	// Stereo routes
+	//
+	router.HandleFunc("/stereo", GetState).Methods("GET")
+	router.HandleFunc("/stereo/press/{button}", Press).Methods("GET")
+	router.HandleFunc("/stereo/preset/{preset}", SelectPreset).Methods("GET")
+	router.HandleFunc("/stereo/band/{band}", SelectBand).Methods("GET")
+	router.HandleFunc("/stereo/source/{source}", SelectSource(c)).Methods("GET")
+	router.HandleFunc("/stereo/tune/{frequency}", Tune(c)).Methods("GET")
+}
+
+// watch reads stereo feedback as pyBus writes it to the session, and publishes any changes
+func watch(c *core.Core) {
+	ch := make(chan core.Message, feedbackQueue)
+	for _, key := range feedbackKeys {
+		c.Subscribe("session."+key, ch)
+	}
+
+	refresh(c)
+	for range ch {
+		refresh(c)
+	}
+}
+
+func refresh(c *core.Core) {
+	source := core.FormatName(c.SessionString("radio_source"))
+	band := core.FormatName(c.SessionString("radio_band"))
+	frequency := c.SessionFloat64("radio_frequency")
+	preset := c.SessionInt("radio_preset")
+
+	stateLock.Lock()
+	changed := map[string]interface{}{}
+	if source != state.Source {
+		state.Source = source
+		changed["source"] = source
+	}
+	if band != state.Band {
+		state.Band = band
+		changed["band"] = band
+	}
+	if frequency != state.Frequency {
+		state.Frequency = frequency
+		changed["frequency"] = frequency
+	}
+	if preset != state.Preset {
+		state.Preset = preset
+		changed["preset"] = preset
+	}
+
+	// Learn which frequency sits behind each preset as they're reported
+	if band != "" && preset > 0 && frequency > 0 {
+		if _, ok := state.Presets[band]; !ok {
+			state.Presets[band] = make(map[int]float64)
+		}
+		state.Presets[band][preset] = frequency
+	}
+	stateLock.Unlock()
+
+	for key, value := range changed {
+		c.Publish(fmt.Sprintf("session.stereo.%s", key), core.Message{Content: value})
+	}
+}
+
+// Current returns a copy of the stereo's last known state
+func Current() State {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+
+	s := state
+	s.Presets = make(map[string]map[int]float64, len(state.Presets))
+	for band, presets := range state.Presets {
+		s.Presets[band] = make(map[int]float64, len(presets))
+		for preset, frequency := range presets {
+			s.Presets[band][preset] = frequency
+		}
+	}
+	return s
+}
+
+// PressButton sends a single logical button press to the stereo
+func PressButton(button string) error {
+	directive, ok := buttons[core.FormatName(button)]
+	if !ok {
+		return fmt.Errorf("%s is not a stereo button", button)
+	}
+	return pybus.PushQueue(directive)
+}
+
+// GetState responds with the stereo's last known state
+func GetState(w http.ResponseWriter, r *http.Request) {
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: Current(), OK: true})
+}
+
+// Press a single stereo button
+func Press(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	button := core.FormatName(params["button"])
+	if _, ok := buttons[button]; !ok {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("%s is not a stereo button", button), OK: false})
+		return
+	}
+
+	cmd := tracker.Default.Run(buttons[button], nil, func() error { return PressButton(button) })
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: button, OK: true, ID: cmd.ID})
+}
+
+// SelectPreset recalls one of the six stereo presets
+func SelectPreset(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	preset, err := strconv.Atoi(params["preset"])
+	if err != nil || preset < 1 || preset > 6 {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Preset must be between 1 and 6", OK: false})
+		return
+	}
+
+	expect := &tracker.Expectation{Key: "radio_preset", Value: strconv.Itoa(preset), Timeout: 5 * time.Second}
+	cmd := tracker.Default.Run(fmt.Sprintf("press%d", preset), expect, func() error { return PressButton(strconv.Itoa(preset)) })
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: preset, OK: true, ID: cmd.ID})
+}
+
+// SelectBand switches the radio to AM or FM
+func SelectBand(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	band := core.FormatName(params["band"])
+	if band != "AM" && band != "FM" {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Band must be AM or FM", OK: false})
+		return
+	}
+
+	expect := &tracker.Expectation{Key: "radio_band", Value: band, Timeout: 5 * time.Second}
+	cmd := tracker.Default.Run(buttons[band], expect, func() error { return PressButton(band) })
+	core.WriteNewResponse(&w, r, core.JSONResponse{Output: band, OK: true, ID: cmd.ID})
+}
+
+// SelectSource cycles the stereo's mode until the requested source is reported
+func SelectSource(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		source := core.FormatName(params["source"])
+
+		cmd := tracker.Default.Run(fmt.Sprintf("source:%s", source), nil, func() error {
+			return selectSource(c, source)
+		})
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: source, OK: true, ID: cmd.ID})
+	}
+}
+
+// Tune the radio to a frequency, using a preset if one is known or seeking otherwise
+func Tune(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		frequency, err := strconv.ParseFloat(params["frequency"], 64)
+		if err != nil || frequency <= 0 {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Frequency must be a positive number", OK: false})
+			return
+		}
+
+		cmd := tracker.Default.Run(fmt.Sprintf("tune:%v", frequency), nil, func() error {
+			return tune(c, frequency)
+		})
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: frequency, OK: true, ID: cmd.ID})
+	}
+}
+
+func selectSource(c *core.Core, source string) error {
+	tuningLock.Lock()
+	defer tuningLock.Unlock()
+
+	for i := 0; i < maxSourceSteps; i++ {
+		refresh(c)
+		if Current().Source == source {
+			return nil
+		}
+		if err := PressButton("MODE"); err != nil {
+			return err
+		}
+		time.Sleep(seekSettleTime)
+	}
+	return fmt.Errorf("Stereo source never became %s", source)
+}
+
+func tune(c *core.Core, frequency float64) error {
+	tuningLock.Lock()
+	defer tuningLock.Unlock()
+
+	// AM frequencies are in kHz, FM in MHz
+	band := "FM"
+	if frequency >= 500 {
+		band = "AM"
+	}
+
+	refresh(c)
+	current := Current()
+	if current.Band != band {
+		if err := PressButton(band); err != nil {
+			return err
+		}
+		time.Sleep(seekSettleTime)
+		refresh(c)
+		current = Current()
+	}
+
+	// Jump straight to a preset if we've seen this frequency on one
+	for preset, presetFrequency := range current.Presets[band] {
+		if sameFrequency(presetFrequency, frequency) {
+			log.Info().Msgf("Tuning to %v using preset %d", frequency, preset)
+			if err := PressButton(strconv.Itoa(preset)); err != nil {
+				return err
+			}
+			time.Sleep(seekSettleTime)
+			refresh(c)
+			if sameFrequency(Current().Frequency, frequency) {
+				return nil
+			}
+			break
+		}
+	}
+
+	// Otherwise seek towards the frequency until the radio reports it, or we pass it
+	for i := 0; i < maxSeekSteps; i++ {
+		current := Current().Frequency
+		if sameFrequency(current, frequency) {
+			return nil
+		}
+
+		button := "NEXT"
+		if current > frequency {
+			button = "PREV"
+		}
+		if err := PressButton(button); err != nil {
+			return err
+		}
+		time.Sleep(seekSettleTime)
+		refresh(c)
+
+		// Seeking skips empty frequencies, so stop if we jumped over the target
+		next := Current().Frequency
+		if (button == "NEXT" && next > frequency) || (button == "PREV" && next < frequency) {
+			return fmt.Errorf("Seeked past %v, radio is now at %v", frequency, next)
+		}
+	}
+	return fmt.Errorf("Could not tune to %v after %d seeks", frequency, maxSeekSteps)
+}
+
+func sameFrequency(a float64, b float64) bool {
+	return math.Abs(a-b) < 0.05
+}
@@ -0,0 +1,177 @@
+// Package tracker follows vehicle commands from request to their outcome in the session
+package tracker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/rs/zerolog/log"
+)
+
+// Status of a tracked command
+type Status string
+
+const (
+	// Pending commands have been accepted but haven't reached their expected outcome yet
+	Pending Status = "pending"
+	// Sent commands were sent, but have no outcome the session can confirm
+	Sent Status = "sent"
+	// Confirmed commands were sent, and their expected outcome was seen in the session
+	Confirmed Status = "confirmed"
+	// Failed commands could not be sent
+	Failed Status = "failed"
+	// TimedOut commands were sent, but their expected outcome never appeared
+	TimedOut Status = "timed-out"
+)
+
+// Expectation describes the session state a command should produce
+type Expectation struct {
+	Key     string        `json:"key"`
+	Value   string        `json:"value"`
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Command is a single vehicle action and its outcome
+type Command struct {
+	ID       int          `json:"id"`
+	Name     string       `json:"name"`
+	Status   Status       `json:"status"`
+	Expect   *Expectation `json:"expect,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Created  time.Time    `json:"created"`
+	Resolved time.Time    `json:"resolved,omitempty"`
+}
+
+// Tracker assigns IDs to commands and watches the session for their outcome
+type Tracker struct {
+	core     *core.Core
+	mutex    sync.RWMutex
+	nextID   int
+	commands map[int]*Command
+	history  []int
+}
+
+const (
+	// maxHistory is the number of resolved commands kept around for lookups
+	maxHistory = 256
+	// pollInterval is how often the session is checked for an expected outcome
+	pollInterval = 100 * time.Millisecond
+)
+
+// Default tracker used by the HTTP routes
+var Default *Tracker
+
+// Setup creates the default tracker
+func Setup(c *core.Core) {
+	Default = New(c)
+}
+
+// New creates a command tracker reading outcomes from the given core's session
+func New(c *core.Core) *Tracker {
+	return &Tracker{core: c, nextID: 1, commands: make(map[int]*Command)}
+}
+
+// Run registers a new command and sends it in the background.
+// Commands without an expectation are only reported as sent once send succeeds.
+func (t *Tracker) Run(name string, expect *Expectation, send func() error) Command {
+	cmd := t.add(name, expect)
+	go func() {
+		if err := send(); err != nil {
+			t.resolve(cmd.ID, Failed, err)
+			return
+		}
+		if expect == nil {
+			t.resolve(cmd.ID, Sent, nil)
+			return
+		}
+		t.await(cmd.ID, cmd.Created, *expect)
+	}()
+	return cmd
+}
+
+// Fail registers a command that was rejected before being sent
+func (t *Tracker) Fail(name string, err error) Command {
+	cmd := t.add(name, nil)
+	t.resolve(cmd.ID, Failed, err)
+	cmd, _ = t.Get(cmd.ID)
+	return cmd
+}
+
+// Confirm registers a command whose expected outcome was already in the session, so there's nothing to send or wait for
+func (t *Tracker) Confirm(name string, expect *Expectation) Command {
+	cmd := t.add(name, expect)
+	t.resolve(cmd.ID, Confirmed, nil)
+	cmd, _ = t.Get(cmd.ID)
+	return cmd
+}
+
+// Get returns a copy of the command with the given ID
+func (t *Tracker) Get(id int) (Command, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	cmd, ok := t.commands[id]
+	if !ok {
+		return Command{}, false
+	}
+	return *cmd, true
+}
+
+func (t *Tracker) add(name string, expect *Expectation) Command {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cmd := &Command{ID: t.nextID, Name: name, Status: Pending, Expect: expect, Created: time.Now()}
+	t.nextID++
+	t.commands[cmd.ID] = cmd
+
+	// Forget the oldest commands once history is full
+	t.history = append(t.history, cmd.ID)
+	if len(t.history) > maxHistory {
+		delete(t.commands, t.history[0])
+		t.history = t.history[1:]
+	}
+
+	log.Debug().Msgf("[%d] Tracking command %s", cmd.ID, name)
+	return *cmd
+}
+
+func (t *Tracker) resolve(id int, status Status, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cmd, ok := t.commands[id]
+	if !ok {
+		return
+	}
+	cmd.Status = status
+	cmd.Resolved = time.Now()
+	if err != nil {
+		cmd.Error = err.Error()
+	}
+	log.Info().Msgf("[%d] Command %s is %s", id, cmd.Name, status)
+}
+
+// await polls the session until the expectation is met by a write since the command was created, or times out
+func (t *Tracker) await(id int, created time.Time, expect Expectation) {
+	deadline := time.Now().Add(expect.Timeout)
+	for time.Now().Before(deadline) {
+		if t.matches(expect, created) {
+			t.resolve(id, Confirmed, nil)
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+	t.resolve(id, TimedOut, fmt.Errorf("%s did not become %s within %s", expect.Key, expect.Value, expect.Timeout))
+}
+
+// matches checks the expected key was written after a time, a value left over from before the command confirms nothing
+func (t *Tracker) matches(expect Expectation, after time.Time) bool {
+	value, written := t.core.SessionWrite(expect.Key)
+	if value == nil || !written.After(after) {
+		return false
+	}
+	return strings.EqualFold(fmt.Sprintf("%v", value), expect.Value)
+}
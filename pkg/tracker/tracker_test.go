@@ -0,0 +1,98 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/qcasey/MDroid-Core/internal/server/routes/session"
+)
+
+// newTestTracker routes session posts to a fresh core, the way pyBus reports what the car did
+func newTestTracker() (*Tracker, *mux.Router) {
+	c := core.New("tracker_test")
+	router := mux.NewRouter()
+	router.HandleFunc("/session/{name}", session.Set(c)).Methods("POST")
+	return New(c), router
+}
+
+// post sets a session value through the HTTP route
+func post(t *testing.T, router *mux.Router, name string, body string) {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/session/"+name, strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Failed to post %s: %s", name, recorder.Body.String())
+	}
+}
+
+// waitForStatus polls a command until it leaves pending, failing unless it resolves to the given status
+func waitForStatus(t *testing.T, tracker *Tracker, id int, status Status) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cmd, ok := tracker.Get(id)
+		if !ok {
+			t.Fatalf("Command %d was forgotten", id)
+		}
+		if cmd.Status != Pending {
+			if cmd.Status != status {
+				t.Fatalf("Expected command %d to be %s, it's %s: %s", id, status, cmd.Status, cmd.Error)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for command %d to be %s", id, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfirmedByPost(t *testing.T) {
+	tracker, router := newTestTracker()
+	expect := &Expectation{Key: "doors_locked", Value: "true", Timeout: time.Second}
+
+	cmd := tracker.Run("toggleDoorLocks", expect, func() error { return nil })
+	// Keys are matched the way viper stores them, whatever case pyBus posts
+	post(t, router, "DOORS_LOCKED", `{"value": "TRUE"}`)
+	waitForStatus(t, tracker, cmd.ID, Confirmed)
+}
+
+func TestStaleValueTimesOut(t *testing.T) {
+	tracker, router := newTestTracker()
+	post(t, router, "doors_locked", `{"value": "TRUE"}`)
+	time.Sleep(10 * time.Millisecond)
+
+	// The doors were already locked, so only a new write could confirm the command
+	expect := &Expectation{Key: "doors_locked", Value: "true", Timeout: 200 * time.Millisecond}
+	cmd := tracker.Run("toggleDoorLocks", expect, func() error { return nil })
+	waitForStatus(t, tracker, cmd.ID, TimedOut)
+}
+
+func TestWrongValueTimesOut(t *testing.T) {
+	tracker, router := newTestTracker()
+	expect := &Expectation{Key: "radio_band", Value: "FM", Timeout: 200 * time.Millisecond}
+
+	cmd := tracker.Run("radioFM", expect, func() error { return nil })
+	post(t, router, "radio_band", `{"value": "AM"}`)
+	waitForStatus(t, tracker, cmd.ID, TimedOut)
+}
+
+func TestSendResults(t *testing.T) {
+	tracker, _ := newTestTracker()
+
+	sent := tracker.Run("radioPower", nil, func() error { return nil })
+	waitForStatus(t, tracker, sent.ID, Sent)
+
+	failed := tracker.Run("radioPower", nil, func() error { return http.ErrHandlerTimeout })
+	waitForStatus(t, tracker, failed.ID, Failed)
+
+	if confirmed := tracker.Confirm("toggleDoorLocks", nil); confirmed.Status != Confirmed {
+		t.Fatalf("Unexpected confirmed command %+v", confirmed)
+	}
+	if rejected := tracker.Fail("toggleDoorLocks", http.ErrNotSupported); rejected.Status != Failed || rejected.Error == "" {
+		t.Fatalf("Unexpected rejected command %+v", rejected)
+	}
+}
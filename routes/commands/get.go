@@ -0,0 +1,29 @@
+package commands
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/qcasey/MDroid-Core/pkg/tracker"
+)
+
+// Get responds with the status of a previously issued vehicle command
+func Get(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		id, err := strconv.Atoi(params["id"])
+		if err != nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Command ID must be a number", OK: false})
+			return
+		}
+
+		cmd, ok := tracker.Default.Get(id)
+		if !ok {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "Command not found", OK: false, ID: id})
+			return
+		}
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: cmd, Status: string(cmd.Status), OK: cmd.Status != tracker.Failed, ID: id})
+	}
+}
@@ -0,0 +1,15 @@
+package serial
+
+import (
+	"net/http"
+
+	"github.com/qcasey/MDroid-Core/internal/core"
+	"github.com/qcasey/MDroid-Core/pkg/mserial"
+)
+
+// Stats responds with the write queue length and wait times of each serial device
+func Stats(c *core.Core) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: mserial.Stats(), OK: true})
+	}
+}
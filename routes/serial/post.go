@@ -1,6 +1,9 @@
 package serial
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -8,13 +11,43 @@ import (
 	"github.com/qcasey/MDroid-Core/pkg/mserial"
 )
 
-// WriteSerial handles messages sent through the server
+// WriteSerial handles messages sent through the server, to the named device or the default writer.
+// Responds with the device's reply if it speaks the framed protocol.
 func WriteSerial(c *core.Core) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		params := mux.Vars(r)
-		if params["command"] != "" {
-			mserial.AwaitText(params["command"])
+
+		device := mserial.Writer
+		if name, ok := params["device"]; ok {
+			device = mserial.Get(name)
+			if device == nil {
+				core.WriteNewResponse(&w, r, core.JSONResponse{Output: fmt.Sprintf("Serial device %s not found", name), OK: false})
+				return
+			}
+		}
+
+		if params["command"] == "" {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), mserial.AwaitTimeout)
+		defer cancel()
+		reply, err := mserial.Await(ctx, &mserial.Message{Device: device, Text: params["command"]})
+		if err != nil {
+			core.WriteNewResponse(&w, r, core.JSONResponse{Output: err.Error(), OK: false})
+			return
+		}
+
+		// Framed devices answer with their own response, others are just acknowledged
+		var output interface{} = "OK"
+		if reply != "" {
+			output = reply
+			var decoded interface{}
+			if json.Unmarshal([]byte(reply), &decoded) == nil {
+				output = decoded
+			}
 		}
-		core.WriteNewResponse(&w, r, core.JSONResponse{Output: "OK", OK: true})
+		core.WriteNewResponse(&w, r, core.JSONResponse{Output: output, OK: true})
 	}
 }